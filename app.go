@@ -3,34 +3,211 @@ package main
 import (
 	"amigo-tech-test/util"
 	"amigo-tech-test/service"
+	"context"
 	"os"
-	"fmt"
-	"log"
+	"os/signal"
+	"log/slog"
 	"net/http"
-	"github.com/gorilla/handlers"
 	"database/sql"
+	"fmt"
 	_ "github.com/lib/pq"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 type App struct {
-	router http.Handler
-	db     *sql.DB
-}
+	// ShutdownTimeout is how long to wait for in-flight requests and background workers to finish
+	// on shutdown, defaulting to 30 seconds.
+	ShutdownTimeout time.Duration
+	// DrainDelay is how long to keep accepting requests after readiness starts failing on shutdown,
+	// giving load balancers time to stop routing new requests to the app.
+	DrainDelay time.Duration
 
-func (a *App) Initialise(router service.ServiceRouter, dbConnector util.DatabaseConnector, dbUser, dbPassword, dbName string) {
-	connectionString :=
-		fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", dbUser, dbPassword, dbName)
+	router   http.Handler
+	db       *sql.DB
+	replicas []*sql.DB
+	service service.ServiceRouter
+	server  util.HttpServer
+}
 
+func (a *App) Initialise(router service.ServiceRouter, dbConnector util.DatabaseConnector, dbConfig DatabaseConfig) {
 	var err error
-	a.db, err = dbConnector.Open(connectionString)
+	a.db, err = openDatabase(dbConnector, dbConfig)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Error opening database", "error", err)
+	}
+	if err := waitForDatabase(a.db, dbConfig); err != nil {
+		fatal("Database is unavailable", "error", err)
+	}
+	a.replicas, err = openReplicas(dbConnector, dbConfig)
+	if err != nil {
+		fatal("Error opening read replica", "error", err)
 	}
 
-	sr := router.NewServiceRouter(a.db)
-	a.router = handlers.LoggingHandler(os.Stdout, sr)
+	a.service = router
+	sr := router.NewServiceRouter(a.db, a.replicas...)
+	a.router = service.TraceRequests(service.LogRequests(sr))
 }
 
+// Run serves requests until the server fails, or until SIGINT or SIGTERM is received, at which point
+// the app is shut down gracefully.
 func (a *App) Run(httpServer util.HttpServer, addr string) {
-	log.Fatal(httpServer.ListenAndServe(addr, a.router))
-}
\ No newline at end of file
+	a.server = httpServer
+
+	signals, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() { errs <- httpServer.ListenAndServe(addr, a.router) }()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			fatal("Error serving requests", "error", err)
+		}
+	case <-signals.Done():
+		slog.Info("Shutting down")
+
+		timeout := a.ShutdownTimeout
+		if timeout <= 0 {
+			timeout = defaultShutdownTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := a.Shutdown(ctx); err != nil {
+			slog.Error("Error shutting down", "error", err)
+		}
+		<-errs
+	}
+}
+
+// Shutdown fails readiness checks, then stops accepting connections and waits for in-flight requests
+// to drain, then stops background workers and closes the database, giving up on anything unfinished
+// when the context expires.
+func (a *App) Shutdown(ctx context.Context) error {
+	a.service.Drain()
+
+	select {
+	case <-time.After(a.DrainDelay):
+	case <-ctx.Done():
+	}
+
+	var result error
+	if a.server != nil {
+		result = a.server.Shutdown(ctx)
+	}
+	if err := a.service.Shutdown(ctx); err != nil && result == nil {
+		result = err
+	}
+	for _, replica := range a.replicas {
+		if err := replica.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	if err := a.db.Close(); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
+
+// openDatabase connects to the database and sizes its connection pool.
+func openDatabase(connector util.DatabaseConnector, config DatabaseConfig) (*sql.DB, error) {
+	db, err := connector.Open(connectionString(config))
+	if err != nil {
+		return nil, err
+	}
+
+	if config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+	return db, nil
+}
+
+// openReplicas connects to each read replica. Unlike the primary, startup does not wait for the
+// replicas, as reads fall back to the primary until they pass their health checks.
+func openReplicas(connector util.DatabaseConnector, config DatabaseConfig) ([]*sql.DB, error) {
+	var replicas []*sql.DB
+	for _, addr := range config.Replicas {
+		replica, err := openReplica(connector, config, addr)
+		if err != nil {
+			for _, opened := range replicas {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+		replicas = append(replicas, replica)
+	}
+	return replicas, nil
+}
+
+func openReplica(connector util.DatabaseConnector, config DatabaseConfig, addr string) (*sql.DB, error) {
+	replicaConfig, err := config.replica(addr)
+	if err != nil {
+		return nil, err
+	}
+	return openDatabase(connector, replicaConfig)
+}
+
+// waitForDatabase pings the database until it responds, backing off between attempts, giving up
+// once the connect timeout has passed. Opening the database does not connect to it, so a database
+// which is down would otherwise go unnoticed until the first request.
+func waitForDatabase(db *sql.DB, config DatabaseConfig) error {
+	if config.ConnectTimeout <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ConnectTimeout)
+	defer cancel()
+
+	// The ping in flight when the timeout passes fails because of it, so report the last failure
+	// from the database instead.
+	var lastErr error
+	retryable := func(error) bool { return true }
+	err := util.Retry(ctx, 0, config.backoff(), retryable, func(ctx context.Context) error {
+		err := db.PingContext(ctx)
+		if err != nil && ctx.Err() == nil {
+			lastErr = err
+			slog.Warn("Waiting for database", "error", err)
+		}
+		return err
+	})
+	if err != nil && lastErr != nil {
+		return lastErr
+	}
+	return err
+}
+
+// connectionString builds a key/value connection string, leaving out unset values and quoting the
+// rest so that passwords containing spaces or quotes are passed through intact.
+func connectionString(config DatabaseConfig) string {
+	var params []string
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if strings.ContainsAny(value, ` '\`) {
+			value = "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+		}
+		params = append(params, key+"="+value)
+	}
+
+	add("host", config.Host)
+	if config.Port != 0 {
+		add("port", strconv.Itoa(config.Port))
+	}
+	add("user", config.Username)
+	add("password", config.Password)
+	add("dbname", config.Database)
+	add("sslmode", config.SSLMode)
+	return strings.Join(params, " ")
+}
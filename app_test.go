@@ -2,35 +2,56 @@ package main
 
 import (
 	"testing"
+	"context"
 	"database/sql"
+	"errors"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"net/http"
+	"reflect"
+	"time"
 )
 
 type stubDatabaseConnector struct{
 	DB *sql.DB
+	Mock sqlmock.Sqlmock
 	ConnString string
+	Opened []string
 }
 func (dc *stubDatabaseConnector) Open(connectionString string) (*sql.DB, error) {
 	dc.ConnString = connectionString
-	dc.DB, _, _ = sqlmock.New()
+	dc.Opened = append(dc.Opened, connectionString)
+	dc.DB, dc.Mock, _ = sqlmock.New()
 	return dc.DB, nil
 }
 
 type stubServiceRouter struct {
 	DB *sql.DB
+	Replicas []*sql.DB
+	DrainCalled bool
+	ShutdownCalled bool
 }
 
-func (sr *stubServiceRouter) NewServiceRouter(db *sql.DB) *mux.Router {
+func (sr *stubServiceRouter) NewServiceRouter(db *sql.DB, replicas ...*sql.DB) *mux.Router {
 	sr.DB = db
+	sr.Replicas = replicas
 	return mux.NewRouter()
 }
 
+func (sr *stubServiceRouter) Drain() {
+	sr.DrainCalled = true
+}
+
+func (sr *stubServiceRouter) Shutdown(ctx context.Context) error {
+	sr.ShutdownCalled = true
+	return nil
+}
+
 type stubHttpServer struct {
 	Addr string
 	Router http.Handler
+	ShutdownCalled bool
 }
 
 func (hs *stubHttpServer) ListenAndServe(addr string, router http.Handler) error {
@@ -39,26 +60,98 @@ func (hs *stubHttpServer) ListenAndServe(addr string, router http.Handler) error
 	return nil
 }
 
+func (hs *stubHttpServer) Shutdown(ctx context.Context) error {
+	hs.ShutdownCalled = true
+	return nil
+}
+
 func TestApp_Initialisation(t *testing.T){
 	app := App{}
 	router := &stubServiceRouter{}
 	connector := &stubDatabaseConnector{}
 
-	app.Initialise(router, connector, "username", "password", "database")
+	app.Initialise(router, connector, DatabaseConfig{Username: "username", Password: "password", Database: "database", SSLMode: "disable"})
 
 	assert.Equal(t, "user=username password=password dbname=database sslmode=disable", connector.ConnString, "Connection string does not match the expected value")
 	assert.Equal(t, connector.DB, router.DB, "Database object was not injected into the router")
 }
 
+func TestApp_InitialisationWithReplicas(t *testing.T){
+	app := App{}
+	router := &stubServiceRouter{}
+	connector := &stubDatabaseConnector{}
+
+	app.Initialise(router, connector, DatabaseConfig{Host: "primary", Username: "username", Database: "database", Replicas: []string{"replica-1", "replica-2:6432"}})
+
+	assert.Equal(t, []string{
+		"host=primary user=username dbname=database",
+		"host=replica-1 user=username dbname=database",
+		"host=replica-2 port=6432 user=username dbname=database",
+	}, connector.Opened, "Replicas should be opened with the primary's settings")
+	assert.Len(t, router.Replicas, 2, "Replicas were not injected into the router")
+}
+
+func TestApp_ConnectionString(t *testing.T){
+	config := DatabaseConfig{Host: "db.internal", Port: 6432, Username: "username", Password: "it's secret", Database: "database", SSLMode: "verify-full"}
+
+	assert.Equal(t, `host=db.internal port=6432 user=username password='it\'s secret' dbname=database sslmode=verify-full`, connectionString(config), "Connection string does not match the expected value")
+}
+
+func TestApp_WaitForDatabase(t *testing.T){
+	db, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	defer db.Close()
+
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	mock.ExpectPing()
+
+	err := waitForDatabase(db, DatabaseConfig{ConnectTimeout: time.Second, RetryBackoff: time.Millisecond})
+
+	assert.Nil(t, err, "Database should be reached once it responds")
+	assert.Nil(t, mock.ExpectationsWereMet(), "Database should be pinged until it responds")
+}
+
+func TestApp_WaitForDatabaseGivesUp(t *testing.T){
+	db, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	}
+
+	err := waitForDatabase(db, DatabaseConfig{ConnectTimeout: 20 * time.Millisecond, RetryBackoff: time.Millisecond, RetryMaxBackoff: 5 * time.Millisecond})
+
+	assert.EqualError(t, err, "connection refused", "Last error should be returned once the connect timeout has passed")
+}
+
 func TestApp_Run(t *testing.T){
 	app := App{}
 	router := &stubServiceRouter{}
 	connector := &stubDatabaseConnector{}
 	server := &stubHttpServer{}
 
-	app.Initialise(router, connector, "username", "password", "database")
+	app.Initialise(router, connector, DatabaseConfig{Username: "username", Password: "password", Database: "database", SSLMode: "disable"})
 	app.Run(server, ":8080")
 
 	assert.Equal(t, ":8080", server.Addr, "Server address was not set correctly")
-	assert.Equal(t, server.Router, app.router, "Http router was not configured correctly")
-}
\ No newline at end of file
+	// The traced handler is a func, so compare what it points to
+	assert.Equal(t, reflect.ValueOf(app.router).Pointer(), reflect.ValueOf(server.Router).Pointer(), "Http router was not configured correctly")
+}
+
+func TestApp_Shutdown(t *testing.T){
+	app := App{}
+	router := &stubServiceRouter{}
+	connector := &stubDatabaseConnector{}
+	server := &stubHttpServer{}
+
+	app.Initialise(router, connector, DatabaseConfig{Username: "username", Password: "password", Database: "database", SSLMode: "disable"})
+	app.Run(server, ":8080")
+	connector.Mock.ExpectClose()
+
+	err := app.Shutdown(context.Background())
+	assert.Nil(t, err)
+
+	assert.True(t, router.DrainCalled, "Service router was not drained")
+	assert.True(t, server.ShutdownCalled, "Http server was not shut down")
+	assert.True(t, router.ShutdownCalled, "Service router was not shut down")
+	assert.Nil(t, connector.Mock.ExpectationsWereMet(), "Database was not closed")
+}
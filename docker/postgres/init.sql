@@ -1,11 +1,197 @@
 CREATE USER docker;
 CREATE DATABASE amigo OWNER docker;
 \connect amigo;
+CREATE TABLE schema_migrations (
+    version integer PRIMARY KEY,
+    date_applied TIMESTAMP DEFAULT NOW()
+);
+INSERT INTO schema_migrations (version) VALUES (1);
+GRANT SELECT ON TABLE schema_migrations TO docker;
 CREATE TABLE messages (
     id SERIAL PRIMARY KEY,
     value text,
     ip_address inet,
-    date_created TIMESTAMP DEFAULT NOW()
+    date_created TIMESTAMP DEFAULT NOW(),
+    moderation_status text NOT NULL DEFAULT 'approved',
+    moderation_reason text NOT NULL DEFAULT '',
+    key_id text,
+    value_tokens text[]
 );
+CREATE INDEX messages_value_tokens_idx ON messages USING GIN (value_tokens);
+CREATE INDEX messages_moderation_status_idx ON messages (moderation_status) WHERE moderation_status IN ('flagged', 'quarantined');
 GRANT ALL PRIVILEGES ON TABLE messages TO docker;
-GRANT USAGE, SELECT ON SEQUENCE messages_id_seq TO docker;
\ No newline at end of file
+GRANT USAGE, SELECT ON SEQUENCE messages_id_seq TO docker;
+CREATE TABLE blocked_networks (
+    id SERIAL PRIMARY KEY,
+    network cidr NOT NULL,
+    reason text NOT NULL DEFAULT '',
+    expires_at TIMESTAMP,
+    date_created TIMESTAMP DEFAULT NOW()
+);
+GRANT ALL PRIVILEGES ON TABLE blocked_networks TO docker;
+GRANT USAGE, SELECT ON SEQUENCE blocked_networks_id_seq TO docker;
+CREATE TABLE message_redactions (
+    id SERIAL PRIMARY KEY,
+    message_id integer NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    kind text NOT NULL,
+    original bytea,
+    key_id text,
+    date_created TIMESTAMP DEFAULT NOW()
+);
+CREATE INDEX message_redactions_message_id_idx ON message_redactions (message_id);
+GRANT ALL PRIVILEGES ON TABLE message_redactions TO docker;
+GRANT USAGE, SELECT ON SEQUENCE message_redactions_id_seq TO docker;
+CREATE TABLE audit_log (
+    id SERIAL PRIMARY KEY,
+    action text NOT NULL,
+    entity text NOT NULL,
+    entity_id integer NOT NULL,
+    actor text NOT NULL,
+    client_ip text NOT NULL,
+    request_id text NOT NULL,
+    before json,
+    after json,
+    prev_hash text NOT NULL,
+    hash text NOT NULL,
+    date_created TIMESTAMP NOT NULL
+);
+CREATE INDEX audit_log_entity_idx ON audit_log (entity, entity_id);
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_append_only();
+GRANT SELECT, INSERT ON TABLE audit_log TO docker;
+GRANT USAGE, SELECT ON SEQUENCE audit_log_id_seq TO docker;
+CREATE FUNCTION notify_message_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        PERFORM pg_notify(TG_ARGV[0], json_build_object('type', 'created', 'id', NEW.id)::text);
+    ELSIF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify(TG_ARGV[0], json_build_object('type', 'deleted', 'id', OLD.id)::text);
+    ELSIF OLD.moderation_status = 'quarantined' THEN
+        IF NEW.moderation_status = 'approved' THEN
+            PERFORM pg_notify(TG_ARGV[0], json_build_object('type', 'created', 'id', NEW.id)::text);
+        END IF;
+    ELSIF NEW.moderation_status = 'rejected' THEN
+        PERFORM pg_notify(TG_ARGV[0], json_build_object('type', 'deleted', 'id', NEW.id)::text);
+    ELSE
+        PERFORM pg_notify(TG_ARGV[0], json_build_object('type', 'updated', 'id', NEW.id)::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER messages_notify_change AFTER INSERT OR DELETE ON messages
+    FOR EACH ROW EXECUTE PROCEDURE notify_message_change('message_events');
+CREATE TRIGGER messages_notify_moderation AFTER UPDATE OF moderation_status ON messages
+    FOR EACH ROW WHEN (OLD.moderation_status IS DISTINCT FROM NEW.moderation_status)
+    EXECUTE PROCEDURE notify_message_change('message_events');
+INSERT INTO schema_migrations (version) VALUES (2);
+CREATE TABLE webhooks (
+    id SERIAL PRIMARY KEY,
+    url text NOT NULL,
+    events text[] NOT NULL,
+    filter_message text NOT NULL DEFAULT '',
+    filter_ip text NOT NULL DEFAULT '',
+    secret text NOT NULL,
+    key_id text,
+    date_created TIMESTAMP DEFAULT NOW()
+);
+GRANT ALL PRIVILEGES ON TABLE webhooks TO docker;
+GRANT USAGE, SELECT ON SEQUENCE webhooks_id_seq TO docker;
+CREATE TABLE webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    webhook_id integer NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+    event text NOT NULL,
+    message_id integer NOT NULL,
+    payload text NOT NULL,
+    key_id text,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    response_status integer,
+    last_error text NOT NULL DEFAULT '',
+    date_created TIMESTAMP DEFAULT NOW(),
+    date_delivered TIMESTAMP
+);
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id);
+GRANT ALL PRIVILEGES ON TABLE webhook_deliveries TO docker;
+GRANT USAGE, SELECT ON SEQUENCE webhook_deliveries_id_seq TO docker;
+INSERT INTO schema_migrations (version) VALUES (3);
+CREATE TABLE outbox (
+    id BIGSERIAL PRIMARY KEY,
+    event_id uuid NOT NULL DEFAULT gen_random_uuid() UNIQUE,
+    event text NOT NULL,
+    message_id integer NOT NULL,
+    payload text NOT NULL,
+    key_id text,
+    txid xid8 NOT NULL DEFAULT pg_current_xact_id(),
+    date_created TIMESTAMP NOT NULL DEFAULT NOW(),
+    date_sent TIMESTAMP,
+    date_parked TIMESTAMP,
+    park_reason text
+);
+CREATE INDEX outbox_unsent_idx ON outbox (id) WHERE date_sent IS NULL AND date_parked IS NULL;
+CREATE INDEX outbox_date_sent_idx ON outbox (date_sent) WHERE date_sent IS NOT NULL;
+GRANT ALL PRIVILEGES ON TABLE outbox TO docker;
+GRANT USAGE, SELECT ON SEQUENCE outbox_id_seq TO docker;
+INSERT INTO schema_migrations (version) VALUES (4);
+ALTER TABLE messages ADD COLUMN owner text;
+INSERT INTO schema_migrations (version) VALUES (5);
+ALTER TABLE messages
+    ADD COLUMN queue text,
+    ADD COLUMN lease_id uuid,
+    ADD COLUMN leased_until TIMESTAMP,
+    ADD COLUMN deliveries integer NOT NULL DEFAULT 0,
+    ADD COLUMN date_acknowledged TIMESTAMP;
+CREATE INDEX messages_queue_idx ON messages (queue, id) WHERE queue IS NOT NULL AND date_acknowledged IS NULL;
+INSERT INTO schema_migrations (version) VALUES (6);
+CREATE SEQUENCE messages_delivery_seq;
+ALTER TABLE messages
+    ADD COLUMN deliver_at TIMESTAMP,
+    ADD COLUMN scheduled boolean NOT NULL DEFAULT false,
+    ADD COLUMN delivery_seq bigint;
+UPDATE messages SET delivery_seq = numbered.seq
+    FROM (SELECT id, row_number() OVER (ORDER BY id) AS seq FROM messages) AS numbered
+    WHERE messages.id = numbered.id;
+SELECT setval('messages_delivery_seq', COALESCE(MAX(delivery_seq), 0) + 1, false) FROM messages;
+ALTER TABLE messages
+    ALTER COLUMN delivery_seq SET DEFAULT nextval('messages_delivery_seq'),
+    ALTER COLUMN delivery_seq SET NOT NULL;
+ALTER SEQUENCE messages_delivery_seq OWNED BY messages.delivery_seq;
+CREATE INDEX messages_scheduled_idx ON messages (deliver_at) WHERE scheduled;
+CREATE INDEX messages_delivery_seq_idx ON messages (delivery_seq);
+GRANT USAGE, SELECT ON SEQUENCE messages_delivery_seq TO docker;
+CREATE OR REPLACE FUNCTION notify_message_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        IF NOT NEW.scheduled THEN
+            PERFORM pg_notify(TG_ARGV[0], json_build_object('type', 'created', 'id', NEW.id)::text);
+        END IF;
+    ELSIF TG_OP = 'DELETE' THEN
+        IF NOT OLD.scheduled THEN
+            PERFORM pg_notify(TG_ARGV[0], json_build_object('type', 'deleted', 'id', OLD.id)::text);
+        END IF;
+    ELSIF OLD.scheduled AND NOT NEW.scheduled THEN
+        PERFORM pg_notify(TG_ARGV[0], json_build_object('type', 'created', 'id', NEW.id)::text);
+    ELSIF NEW.scheduled THEN
+        RETURN NULL;
+    ELSIF OLD.moderation_status = 'quarantined' THEN
+        IF NEW.moderation_status = 'approved' THEN
+            PERFORM pg_notify(TG_ARGV[0], json_build_object('type', 'created', 'id', NEW.id)::text);
+        END IF;
+    ELSIF NEW.moderation_status = 'rejected' THEN
+        PERFORM pg_notify(TG_ARGV[0], json_build_object('type', 'deleted', 'id', NEW.id)::text);
+    ELSE
+        PERFORM pg_notify(TG_ARGV[0], json_build_object('type', 'updated', 'id', NEW.id)::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER messages_notify_delivery AFTER UPDATE OF scheduled ON messages
+    FOR EACH ROW WHEN (OLD.scheduled AND NOT NEW.scheduled)
+    EXECUTE PROCEDURE notify_message_change('message_events');
+INSERT INTO schema_migrations (version) VALUES (7);
\ No newline at end of file
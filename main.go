@@ -1,25 +1,280 @@
 package main
 
 import (
-	"github.com/spf13/viper"
-	"log"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+	"amigo-tech-test/service/model"
 	"amigo-tech-test/service"
+	"amigo-tech-test/service/broker"
+	"amigo-tech-test/service/redaction"
 	"amigo-tech-test/util"
 )
 
 func main() {
-	viper.SetConfigFile("./config/conf.json")
+	config, args, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var logLevel slog.LevelVar
+	level, _ := util.ParseLogLevel(config.Log.Level)
+	logLevel.Set(level)
+
+	logger, err := util.NewLogger(os.Stdout, &logLevel, config.Log.Format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring logging, %s\n", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	slog.Info("Loaded config", "files", config.Files)
+
+	keyring := newKeyring(config.Encryption)
+	var storage model.Storage
+	if keyring != nil && config.Encryption.EncryptValues {
+		storage.Cipher = keyring
+	}
+	if keyring != nil && config.Redaction.Mode == "encrypt" {
+		storage.Originals = keyring
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "rotate-keys":
+			rotateKeys(config, storage, keyring)
+		case "verify-audit":
+			verifyAudit(config)
+		default:
+			fatal("Unknown command", "command", args[0])
+		}
+		return
+	}
+
+	tracerProvider, err := util.StartTracing(context.Background(), config.Tracing)
+	if err != nil {
+		fatal("Error configuring tracing", "error", err)
+	}
+	if tracerProvider != nil {
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tracerProvider.Shutdown(ctx); err != nil {
+				slog.Error("Error flushing traces", "error", err)
+			}
+		}()
+	}
+
+	settings, err := config.routerSettings()
+	if err != nil {
+		fatal("Error configuring moderation", "error", err)
+	}
+
+	trustedProxies, err := config.Audit.trustedProxies()
+	if err != nil {
+		fatal("Error configuring audit log", "error", err)
+	}
+
+	router := &service.MessageServiceRouter{
+		BlockMode:        config.Security.BlockMode,
+		BlockListRefresh: config.Security.BlockListRefresh,
+		Admin:            config.Security.Admin,
+		Payload:          settings.Payload,
+		Moderator:        settings.Moderator,
+		Redactor:         newRedactor(config.Redaction, keyring),
+		AuditLog:         config.Audit.Enabled,
+		TrustedProxies:   trustedProxies,
+		Metrics:          config.Metrics.Enabled,
+		Timeouts:         settings.Timeouts,
+		Paging:           settings.Paging,
+		Resilience: service.Resilience{
+			ReadRetries:      config.DB.ReadRetries,
+			RetryBackoff:     config.DB.RetryBackoff,
+			RetryMaxBackoff:  config.DB.RetryMaxBackoff,
+			BreakerThreshold: config.DB.BreakerThreshold,
+			BreakerCooldown:  config.DB.BreakerCooldown,
+		},
+		ReadYourWrites:       config.DB.ReadYourWrites,
+		ReplicaCheckInterval: config.DB.ReplicaCheckInterval,
+		Streams:              config.Stream,
+		Webhooks:             config.Webhooks,
+		Outbox:               config.Outbox,
+		Queues:               config.Queues,
+		Scheduling:           config.Scheduling,
+		Storage:              storage,
+	}
+	if !router.Admin.Configured() {
+		slog.Warn("Admin API is disabled, set security.admin.token or security.admin.client_certs to enable it")
+	}
+	if config.Events.Channel != "" {
+		router.EventListener = util.NewPostgresListener(connectionString(config.DB), config.Events.Channel)
+	}
+	if router.Publisher = newPublisher(config.Events); router.Publisher != nil {
+		router.Storage.Outbox = true
+		if closer, ok := router.Publisher.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+	reloader := newConfigReloader(os.Args[1:], config, &logLevel, router)
+	router.Config = reloader.maskedConfig
+
+	a := App{
+		ShutdownTimeout: config.App.ShutdownTimeout,
+		DrainDelay:      config.App.DrainDelay,
+	}
+	a.Initialise(router, util.PostgresDatabaseConnector{}, config.DB)
+	reloader.watch()
+	a.Run(&util.DefaultHttpServer{
+		TLS:               newTLSConfig(config.TLS),
+		ReadHeaderTimeout: config.App.ReadHeaderTimeout,
+		ReadTimeout:       config.App.ReadTimeout,
+		WriteTimeout:      config.App.WriteTimeout,
+		IdleTimeout:       config.App.IdleTimeout,
+	}, config.App.Port)
+}
+
+// newTLSConfig returns the TLS settings for the server, or nil to serve plain HTTP.
+func newTLSConfig(config util.TLSConfig) *util.TLSConfig {
+	if config.CertFile == "" {
+		return nil
+	}
+	return &config
+}
+
+// newKeyring loads the keyring used for encryption at rest, returning nil if none is configured.
+func newKeyring(config EncryptionConfig) *util.Keyring {
+	if config.KeyringFile == "" {
+		return nil
+	}
+
+	keyring, err := util.LoadKeyring(config.KeyringFile)
+	if err != nil {
+		fatal("Error reading keyring", "error", err)
+	}
+	return keyring
+}
+
+// rotateKeys re-encrypts every message, webhook secret and delivery, outbox event, and redaction
+// original not yet encrypted with the active key, e.g. `./amigo-tech-test rotate-keys` after adding a
+// new key to the keyring and making it active. Only redaction originals are encrypted unless
+// encryption.encrypt_values is set.
+func rotateKeys(config *Config, storage model.Storage, keyring *util.Keyring) {
+	if keyring == nil {
+		fatal("Error rotating keys", "error", "encryption.keyring_file is not set")
+	}
+
+	db := connectDatabase(config.DB)
+	defer db.Close()
+
+	if storage.Cipher != nil {
+		rotated, err := model.RotateKeys(context.Background(), db, storage.Cipher, config.Encryption.RotationBatchSize)
+		slog.Info("Re-encrypted messages", "count", rotated)
+		if err != nil {
+			fatal("Error rotating keys", "error", err)
+		}
+
+		rotated, err = model.RotateWebhookKeys(context.Background(), db, storage.Cipher, config.Encryption.RotationBatchSize)
+		slog.Info("Re-encrypted webhook secrets and deliveries", "count", rotated)
+		if err != nil {
+			fatal("Error rotating keys", "error", err)
+		}
+
+		rotated, err = model.RotateOutboxKeys(context.Background(), db, storage.Cipher, config.Encryption.RotationBatchSize)
+		slog.Info("Re-encrypted outbox events", "count", rotated)
+		if err != nil {
+			fatal("Error rotating keys", "error", err)
+		}
+	}
+
+	rotated, err := model.RotateRedactionKeys(context.Background(), db, keyring, config.Encryption.RotationBatchSize)
+	slog.Info("Re-encrypted redactions", "count", rotated)
+	if err != nil {
+		fatal("Error rotating keys", "error", err)
+	}
+}
+
+// verifyAudit checks every entry in the audit log links to the one before it and has not been altered,
+// exiting with an error at the first broken entry.
+func verifyAudit(config *Config) {
+	db := connectDatabase(config.DB)
+	defer db.Close()
 
-	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("Error reading config file, %s", err)
+	checked, err := model.VerifyAuditLog(context.Background(), db, 1000)
+	if err != nil {
+		fatal("Audit log verification failed", "checked", checked, "error", err)
 	}
+	slog.Info("Verified audit log", "checked", checked)
+}
+
+func connectDatabase(config DatabaseConfig) *sql.DB {
+	db, err := openDatabase(util.PostgresDatabaseConnector{}, config)
+	if err != nil {
+		fatal("Error opening database", "error", err)
+	}
+	if err := waitForDatabase(db, config); err != nil {
+		fatal("Database is unavailable", "error", err)
+	}
+	return db
+}
+
+func newRedactor(config RedactionConfig, keyring *util.Keyring) *redaction.Redactor {
+	mode := config.Mode
+	if mode == "" {
+		return nil
+	}
+
+	detectors, err := redaction.DetectorsByKind(config.Kinds...)
+	if err != nil {
+		fatal("Error configuring redaction", "error", err)
+	}
+
+	switch mode {
+	case "mask":
+		return redaction.NewRedactor(false, detectors...)
+	case "encrypt":
+		if keyring == nil {
+			fatal("Redaction mode \"encrypt\" requires encryption.keyring_file to be set")
+		}
+		return redaction.NewRedactor(true, detectors...)
+	}
+
+	fatal("Unknown redaction mode", "mode", mode)
+	return nil
+}
+
+// newPublisher returns the publisher events are relayed to from the outbox, or nil if the outbox is
+// disabled.
+func newPublisher(config EventsConfig) service.Publisher {
+	codec := broker.Codec{Encoding: config.Encoding, KeyBy: config.KeyBy}
+	switch config.Publisher {
+	case "":
+		return nil
+	case "log":
+		return util.LogPublisher{}
+	case "nats":
+		publisher, err := broker.NewNatsPublisher(config.Nats, codec)
+		if err != nil {
+			fatal("Error connecting to NATS", "error", err)
+		}
+		return publisher
+	case "kafka":
+		return broker.NewKafkaPublisher(config.Kafka, codec)
+	}
+
+	fatal("Unknown event publisher", "publisher", config.Publisher)
+	return nil
+}
 
-	a := App{}
-	a.Initialise(
-		&service.MessageServiceRouter{},
-		util.PostgresDatabaseConnector{},
-		viper.GetString("db.username"),
-		viper.GetString("db.password"),
-		viper.GetString("db.database"))
-	a.Run(util.DefaultHttpServer{}, viper.GetString("app.port"))
-}
\ No newline at end of file
+// fatal logs the error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"amigo-tech-test/service"
+	"amigo-tech-test/util"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// reloadableKeys are the config values applied without a restart, by key or by section.
+var reloadableKeys = []string{"log.level", "paging", "messages", "moderation", "db.read_timeout", "db.search_timeout", "db.write_timeout"}
+
+func isReloadable(key string) bool {
+	for _, reloadable := range reloadableKeys {
+		if key == reloadable || strings.HasPrefix(key, reloadable+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// configReloader reloads the config when any of its files change, applying the values which are
+// safe to change while the service is running. A reload which fails to load or validate is rejected,
+// keeping the running config, and changes to any other values are logged as needing a restart.
+type configReloader struct {
+	args     []string
+	logLevel *slog.LevelVar
+	router   *service.MessageServiceRouter
+
+	mu     sync.Mutex
+	config atomic.Pointer[Config]
+}
+
+func newConfigReloader(args []string, config *Config, logLevel *slog.LevelVar, router *service.MessageServiceRouter) *configReloader {
+	cr := &configReloader{args: args, logLevel: logLevel, router: router}
+	cr.config.Store(config)
+	return cr
+}
+
+// watch starts watching each file the running config was read from.
+func (cr *configReloader) watch() {
+	for _, file := range cr.config.Load().Files {
+		v := viper.New()
+		v.SetConfigFile(file)
+		v.OnConfigChange(func(event fsnotify.Event) { cr.reload() })
+		v.WatchConfig()
+	}
+}
+
+// maskedConfig returns the running config with secrets masked.
+func (cr *configReloader) maskedConfig() map[string]any {
+	return cr.config.Load().masked()
+}
+
+func (cr *configReloader) reload() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	config, restart, err := cr.load()
+	if err != nil {
+		slog.Error("Rejected config reload, keeping the running config", "error", err)
+		return err
+	}
+
+	settings, err := config.routerSettings()
+	if err != nil {
+		slog.Error("Rejected config reload, keeping the running config", "error", err)
+		return err
+	}
+	level, _ := util.ParseLogLevel(config.Log.Level)
+
+	cr.config.Store(config)
+	cr.logLevel.Set(level)
+	cr.router.Reconfigure(settings)
+
+	slog.Info("Reloaded config", "files", config.Files)
+	if len(restart) > 0 {
+		slog.Warn("Config changes need a restart to take effect", "keys", restart)
+	}
+	return nil
+}
+
+// load reads the config again, returning the config to run with: the reloadable values as read,
+// and every other value as it is running now. The keys of any other values which changed are
+// returned as needing a restart.
+func (cr *configReloader) load() (*Config, []string, error) {
+	loaded, _, err := loadConfig(cr.args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	running := flatten(cr.config.Load().settings)
+	reloaded := flatten(loaded.settings)
+
+	v := viper.New()
+	var restart []string
+	for key, value := range running {
+		if isReloadable(key) {
+			continue
+		}
+		v.Set(key, value)
+		if current, ok := reloaded[key]; !ok || !reflect.DeepEqual(current, value) {
+			restart = append(restart, key)
+		}
+	}
+	for key, value := range reloaded {
+		if isReloadable(key) {
+			v.Set(key, value)
+		} else if _, ok := running[key]; !ok {
+			restart = append(restart, key)
+		}
+	}
+	slices.Sort(restart)
+
+	config, err := decodeConfig(v, loaded.Files)
+	return config, restart, err
+}
+
+// flatten lists every value in nested settings by its dotted key.
+func flatten(settings map[string]any) map[string]any {
+	flat := map[string]any{}
+	var walk func(prefix string, settings map[string]any)
+	walk = func(prefix string, settings map[string]any) {
+		for key, value := range settings {
+			if nested, ok := value.(map[string]any); ok {
+				walk(prefix+key+".", nested)
+			} else {
+				flat[prefix+key] = value
+			}
+		}
+	}
+	walk("", settings)
+	return flat
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"amigo-tech-test/service"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReloader(t *testing.T, contents string) (*configReloader, string) {
+	file := writeConfigFile(t, t.TempDir(), "conf.json", contents)
+	args := []string{"--config", file}
+	config, _, err := loadConfig(args)
+	assert.Nil(t, err)
+
+	var logLevel slog.LevelVar
+	return newConfigReloader(args, config, &logLevel, &service.MessageServiceRouter{}), file
+}
+
+func rewriteConfigFile(t *testing.T, file, contents string) {
+	assert.Nil(t, os.WriteFile(file, []byte(contents), 0600))
+}
+
+func Test_ShouldApplyReloadableConfigValues(t *testing.T) {
+	reloader, file := newTestReloader(t, `{"db": {"host": "base", "username": "docker", "database": "amigo"}}`)
+
+	rewriteConfigFile(t, file, `{
+		"log": {"level": "debug"},
+		"paging": {"max_limit": 50},
+		"db": {"host": "elsewhere", "username": "docker", "database": "amigo", "search_timeout": "3s"}
+	}`)
+	err := reloader.reload()
+	assert.Nil(t, err)
+
+	config := reloader.config.Load()
+	assert.Equal(t, slog.LevelDebug, reloader.logLevel.Level(), "Log level was not changed")
+	assert.Equal(t, 50, config.Paging.MaxLimit, "Paging was not reloaded")
+	assert.Equal(t, 3*time.Second, config.DB.SearchTimeout, "Timeout was not reloaded")
+	assert.Equal(t, "base", config.DB.Host, "Value needing a restart should not change")
+	assert.Equal(t, "base", reloader.maskedConfig()["db"].(map[string]any)["host"], "Effective config does not show the running value")
+}
+
+func Test_ShouldKeepRunningConfigWhenReloadIsInvalid(t *testing.T) {
+	reloader, file := newTestReloader(t, `{"paging": {"max_limit": 30}, "db": {"username": "docker", "database": "amigo"}}`)
+	running := reloader.config.Load()
+
+	rewriteConfigFile(t, file, `{"paging": {"default_limit": 50, "max_limit": 40}, "db": {"username": "docker", "database": "amigo"}}`)
+	err := reloader.reload()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "paging.default_limit: must not exceed paging.max_limit (40), got 50")
+
+	assert.Same(t, running, reloader.config.Load(), "Running config should be kept")
+}
+
+func Test_ShouldMaskSecretsInEffectiveConfig(t *testing.T) {
+	reloader, _ := newTestReloader(t, `{"db": {"username": "docker", "password": "s3cret", "database": "amigo"}}`)
+
+	db := reloader.maskedConfig()["db"].(map[string]any)
+	assert.Equal(t, "********", db["password"], "Password was not masked")
+	assert.Equal(t, "docker", db["username"], "Other values should not be masked")
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"amigo-tech-test/service/model"
+	"amigo-tech-test/util"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminAuth controls how requests to /admin are authenticated. A request must present every
+// credential which is configured, and every admin request is refused when none is.
+type AdminAuth struct {
+	// Token is the bearer token admin requests must send in the Authorization header.
+	Token string `mapstructure:"token"`
+	// ClientCerts requires admin requests to present a verified TLS client certificate.
+	ClientCerts bool `mapstructure:"client_certs"`
+}
+
+// Configured reports whether any admin credential is required, and so whether the admin API can
+// be used at all.
+func (a AdminAuth) Configured() bool {
+	return a.Token != "" || a.ClientCerts
+}
+
+func (sr *MessageServiceRouter) authenticateAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sr.Admin.Configured() {
+			respondWithError(w, http.StatusForbidden, "The admin API is not enabled")
+			return
+		}
+		if sr.Admin.Token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(sr.Admin.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				respondWithError(w, http.StatusUnauthorized, "Invalid or missing bearer token")
+				return
+			}
+		}
+		if sr.Admin.ClientCerts && util.ClientSubject(r) == "" {
+			respondWithError(w, http.StatusForbidden, "A client certificate is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (sr *MessageServiceRouter) getBlockedNetworks(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Search)
+	defer cancel()
+
+	var networks []model.BlockedNetwork
+	err := sr.read(ctx, func(ctx context.Context) (err error) {
+		networks, err = model.GetBlockedNetworks(ctx, sr.db)
+		return err
+	})
+	if err != nil {
+		respondWithStoreError(w, ctx, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, networks)
+}
+
+func (sr *MessageServiceRouter) createBlockedNetwork(w http.ResponseWriter, r *http.Request) {
+	var b model.BlockedNetwork
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid blocked network payload")
+		return
+	}
+	defer r.Body.Close()
+
+	ipNet, err := parseNetwork(b.Network)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid network")
+		return
+	}
+	b.Network = ipNet.String()
+
+	if b.ExpiresAt != nil && !b.ExpiresAt.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "Expiry must be in the future")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Write)
+	defer cancel()
+
+	audit := sr.auditEntry(r, auditCreate, auditBlockedNetwork, 0)
+	if err := sr.write(ctx, func(ctx context.Context) error { return b.CreateBlockedNetwork(ctx, sr.db, audit) }); err != nil {
+		respondWithStoreError(w, ctx, err)
+		return
+	}
+	sr.refreshBlockList(context.WithoutCancel(r.Context()))
+
+	respondWithJSON(w, http.StatusCreated, map[string]int{"id": b.Id})
+}
+
+func (sr *MessageServiceRouter) deleteBlockedNetwork(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["Id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid blocked network ID")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Write)
+	defer cancel()
+
+	b := model.BlockedNetwork{Id: id}
+	audit := sr.auditEntry(r, auditDelete, auditBlockedNetwork, id)
+	if err := sr.write(ctx, func(ctx context.Context) error { return b.DeleteBlockedNetwork(ctx, sr.db, audit) }); err != nil {
+		respondWithStoreError(w, ctx, err)
+		return
+	}
+	sr.refreshBlockList(context.WithoutCancel(r.Context()))
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (sr *MessageServiceRouter) getRedactions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["Id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Read)
+	defer cancel()
+
+	var redactions []model.Redaction
+	err = sr.read(ctx, func(ctx context.Context) (err error) {
+		redactions, err = model.GetRedactions(ctx, sr.db, id)
+		return err
+	})
+	if err != nil {
+		respondWithStoreError(w, ctx, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, redactions)
+}
+
+// refreshBlockList reloads the block list, logging any error. Callers refreshing after a change pass a
+// context which outlives the request, so the in-memory list is not left stale when the client
+// disconnects.
+func (sr *MessageServiceRouter) refreshBlockList(ctx context.Context) {
+	if sr.blockList == nil {
+		return
+	}
+
+	ctx, cancel := withTimeout(ctx, sr.current().Timeouts.Read)
+	defer cancel()
+
+	if err := sr.blockList.refresh(ctx, sr.db); err != nil {
+		slog.ErrorContext(ctx, "Unable to refresh blocked networks", "error", err)
+	}
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"time"
+)
+
+var testAdmin = AdminAuth{Token: "admin-token"}
+
+// executeAdminRequest serves an admin request with testAdmin's bearer token.
+func executeAdminRequest(req *http.Request) *httptest.ResponseRecorder {
+	req.Header.Set("Authorization", "Bearer "+testAdmin.Token)
+	return executeRequest(req)
+}
+
+// withClientCertificate marks the request as made over TLS with a verified client certificate.
+func withClientCertificate(req *http.Request, commonName string) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
+
+func Test_ShouldRejectAdminRequestWithoutBearerToken(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: testAdmin}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("GET", "/admin/blocked-networks/", nil)
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Response status code not as expected")
+	assert.Equal(t, `Bearer realm="admin"`, response.Header().Get("WWW-Authenticate"), "Challenge not as expected")
+	assert.Equal(t, "{\"error\":\"Invalid or missing bearer token\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldRejectAdminRequestWithWrongBearerToken(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: testAdmin}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("GET", "/admin/blocked-networks/", nil)
+	req.Header.Set("Authorization", "Bearer not-the-token")
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Response status code not as expected")
+}
+
+func Test_ShouldRefuseAdminRequestWhenNoCredentialIsConfigured(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("GET", "/admin/blocked-networks/", nil)
+	response := executeAdminRequest(req)
+
+	assert.Equal(t, http.StatusForbidden, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"The admin API is not enabled\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldRequireClientCertificateForAdminRequest(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: AdminAuth{ClientCerts: true}}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("GET", "/admin/blocked-networks/", nil)
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusForbidden, response.Code, "Request without a client certificate was not refused")
+	assert.Equal(t, "{\"error\":\"A client certificate is required\"}", response.Body.String(), "Response body does not match expected value")
+
+	mock.ExpectQuery("SELECT id, network, reason, expires_at, date_created FROM blocked_networks ORDER BY id").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "network", "reason", "expires_at", "date_created"}))
+
+	req, _ = http.NewRequest("GET", "/admin/blocked-networks/", nil)
+	withClientCertificate(req, "ops-client")
+	response = executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Request with a client certificate was not served")
+}
+
+func Test_ShouldRequireEveryConfiguredAdminCredential(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: AdminAuth{Token: testAdmin.Token, ClientCerts: true}}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("GET", "/admin/blocked-networks/", nil)
+	response := executeAdminRequest(req)
+
+	assert.Equal(t, http.StatusForbidden, response.Code, "Request with only a bearer token was not refused")
+
+	req, _ = http.NewRequest("GET", "/admin/blocked-networks/", nil)
+	withClientCertificate(req, "ops-client")
+	response = executeRequest(req)
+
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Request with only a client certificate was not refused")
+}
+
+func Test_ShouldRejectAdminRequestFromBlockedNetworkInBlockAllMode(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	expectBlockedNetworks(mock, "192.168.0.0/16")
+	router = (&MessageServiceRouter{BlockMode: BlockAll, Admin: testAdmin}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("GET", "/admin/blocked-networks/", nil)
+	req.RemoteAddr = "192.168.1.20:5000"
+	response := executeAdminRequest(req)
+
+	assert.Equal(t, http.StatusForbidden, response.Code, "Admin read from blocked network was not rejected")
+	assert.Equal(t, "{\"error\":\"Requests from this address are blocked\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldCreateBlockedNetworkAndRefreshBlockList(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	expectBlockedNetworks(mock)
+	router = (&MessageServiceRouter{BlockMode: BlockWrites, Admin: testAdmin}).NewServiceRouter(db)
+
+	mock.ExpectQuery("INSERT INTO blocked_networks").
+		WithArgs("10.20.0.0/16", "spam", nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(3, time.Now()))
+	expectBlockedNetworks(mock, "10.20.0.0/16")
+
+	req, _ := http.NewRequest("POST", "/admin/blocked-networks/", bytes.NewBuffer([]byte("{\"network\":\"10.20.1.1/16\",\"reason\":\"spam\"}")))
+	response := executeAdminRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusCreated, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"id\":3}", response.Body.String(), "Response body does not match expected value")
+
+	req, _ = http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Test message value")))
+	req.RemoteAddr = "10.20.30.40:5000"
+	response = executeRequest(req)
+
+	assert.Equal(t, http.StatusForbidden, response.Code, "Newly blocked network was not rejected")
+}
+
+func Test_ShouldFailToCreateBlockedNetworkDueToInvalidNetwork(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: testAdmin}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("POST", "/admin/blocked-networks/", bytes.NewBuffer([]byte("{\"network\":\"not_a_network\"}")))
+	response := executeAdminRequest(req)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Invalid network\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldFailToCreateBlockedNetworkDueToExpiryInThePast(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: testAdmin}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("POST", "/admin/blocked-networks/", bytes.NewBuffer([]byte("{\"network\":\"10.20.0.0/16\",\"expires_at\":\"2017-06-25T14:22:12Z\"}")))
+	response := executeAdminRequest(req)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Expiry must be in the future\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldRetrieveBlockedNetworks(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: testAdmin}).NewServiceRouter(db)
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	columns := []string{"id", "network", "reason", "expires_at", "date_created"}
+	mock.ExpectQuery("SELECT id, network, reason, expires_at, date_created FROM blocked_networks ORDER BY id").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "10.20.0.0/16", "spam", nil, dateCreated))
+
+	req, _ := http.NewRequest("GET", "/admin/blocked-networks/", nil)
+	response := executeAdminRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "[{\"id\":1,\"network\":\"10.20.0.0/16\",\"reason\":\"spam\",\"expires_at\":null,\"date_created\":\"2017-06-25T14:22:12.296925Z\"}]", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldFailToDeleteBlockedNetworkDueToError(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: testAdmin}).NewServiceRouter(db)
+
+	mock.ExpectExec("DELETE FROM blocked_networks").
+		WithArgs(3).
+		WillReturnError(errors.New("Database connection closed"))
+
+	req, _ := http.NewRequest("DELETE", "/admin/blocked-networks/3", nil)
+	response := executeAdminRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "{\"error\":\"Database connection closed\"}", response.Body.String(), "Response body does not match expected value")
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"amigo-tech-test/service/model"
+	"amigo-tech-test/util"
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+
+	// Claiming or releasing queued messages may also move them to their dead-letter queue, which the
+	// model audits as "dead_letter"
+	auditClaim       = "claim"
+	auditAcknowledge = "acknowledge"
+	auditRelease     = "release"
+
+	auditMessage        = "message"
+	auditBlockedNetwork = "blocked_network"
+	auditWebhook        = "webhook"
+)
+
+// auditActor identifies who made a request for the audit log, as "anonymous" when they are not.
+func (sr *MessageServiceRouter) auditActor(r *http.Request) string {
+	if actor := sr.requestActor(r); actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
+
+// requestActor identifies who made a request, returning an empty string when they are not. A
+// verified client certificate takes precedence over the X-Actor header, which is only trusted from
+// the proxy networks that authenticate clients in front of the service, since any other client could
+// claim to be anyone.
+func (sr *MessageServiceRouter) requestActor(r *http.Request) string {
+	if subject := util.ClientSubject(r); subject != "" {
+		return subject
+	}
+	if actor := r.Header.Get("X-Actor"); actor != "" && sr.fromTrustedProxy(r) {
+		return actor
+	}
+	return ""
+}
+
+func (sr *MessageServiceRouter) fromTrustedProxy(r *http.Request) bool {
+	ip, err := getClientIp(r)
+	if err != nil {
+		return false
+	}
+	for _, network := range sr.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// auditEntry starts the audit log entry for a change, returning nil when auditing is disabled. The
+// model records the entry in the same transaction as the change, along with snapshots of the entity
+// before and after it, so a change is never kept without its entry.
+func (sr *MessageServiceRouter) auditEntry(r *http.Request, action, entity string, entityId int) *model.AuditEntry {
+	if !sr.AuditLog {
+		return nil
+	}
+
+	entry := &model.AuditEntry{
+		Action:    action,
+		Entity:    entity,
+		EntityId:  entityId,
+		Actor:     sr.auditActor(r),
+		RequestId: util.RequestId(r.Context()),
+	}
+	if ip, err := getClientIp(r); err == nil {
+		entry.ClientIp = ip.String()
+	}
+	return entry
+}
+
+func (sr *MessageServiceRouter) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	queryVals := r.URL.Query()
+	offset, limit := getPaging(queryVals, sr.current().Paging)
+
+	filter := model.AuditFilter{
+		Action:    getQueryParamOrDefault(queryVals, "action", ""),
+		Entity:    getQueryParamOrDefault(queryVals, "entity", ""),
+		Actor:     getQueryParamOrDefault(queryVals, "actor", ""),
+		RequestId: getQueryParamOrDefault(queryVals, "request_id", ""),
+	}
+
+	if entityId := getQueryParamOrDefault(queryVals, "entity_id", ""); entityId != "" {
+		id, err := strconv.Atoi(entityId)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid entity ID")
+			return
+		}
+		filter.EntityId = id
+	}
+
+	bounds := []struct {
+		param string
+		value **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}}
+
+	for _, bound := range bounds {
+		if value := getQueryParamOrDefault(queryVals, bound.param, ""); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid "+bound.param+" date, expected RFC 3339")
+				return
+			}
+			*bound.value = &t
+		}
+	}
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Search)
+	defer cancel()
+
+	var result *model.Page
+	err := sr.read(ctx, func(ctx context.Context) (err error) {
+		result, err = model.SearchAuditLog(ctx, sr.db, filter, offset, limit)
+		return err
+	})
+	if err != nil {
+		respondWithStoreError(w, ctx, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"testing"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var messageSnapshotColumns = []string{"id", "value", "ip_address", "date_created", "moderation_status", "moderation_reason", "key_id", "queue", "deliveries", "leased_until", "date_acknowledged"}
+
+func Test_ShouldRecordAuditEntryWhenDeletingMessage(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	router = (&MessageServiceRouter{AuditLog: true, TrustedProxies: []*net.IPNet{proxies}}).NewServiceRouter(db)
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, moderation_reason, key_id, queue, deliveries, leased_until, date_acknowledged FROM messages").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows(messageSnapshotColumns).
+		AddRow(123, "Test message value", "192.168.200.201", dateCreated, "approved", "", nil, nil, 0, nil, nil))
+	mock.ExpectQuery("DELETE FROM messages").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address", "owner", "moderation_status", "scheduled"}).AddRow("192.168.200.201", nil, "approved", false))
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT hash FROM audit_log").WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+	mock.ExpectQuery("INSERT INTO audit_log").
+		WithArgs("delete", "message", 123, "moderator", "10.0.0.1", "request-1",
+			`{"id":123,"value":"Test message value","ip_address":"192.168.200.201","date_created":"2017-06-25T14:22:12.296925Z","status":"approved","moderation_reason":"","key_id":null}`,
+			nil, "", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	req, _ := http.NewRequest("DELETE", "/messages/123", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("X-Actor", "moderator")
+	req.Header.Set("X-Request-ID", "request-1")
+	response := httptest.NewRecorder()
+	LogRequests(router).ServeHTTP(response, req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "{\"result\":\"success\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldRetrieveAuditLogWithFilters(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: testAdmin}).NewServiceRouter(db)
+
+	mock.ExpectQuery("SELECT COUNT\\(id\\) FROM audit_log WHERE \\(action = \\$1 AND entity_id = \\$2\\)").
+		WithArgs("delete", 123).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery("SELECT (.+) FROM audit_log").
+		WithArgs("delete", 123).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "action", "entity", "entity_id", "actor", "client_ip", "request_id", "before", "after", "prev_hash", "hash", "date_created"}))
+
+	req, _ := http.NewRequest("GET", "/admin/audit?action=delete&entity_id=123", nil)
+	response := executeAdminRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "{\"offset\":0,\"limit\":20,\"total_count\":0,\"results\":[]}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldFailToRetrieveAuditLogDueToInvalidDate(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: testAdmin}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("GET", "/admin/audit?from=yesterday", nil)
+	response := executeAdminRequest(req)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Invalid from date, expected RFC 3339\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldNotRecordMessageDeletionWhenAuditEntryFails(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{AuditLog: true}).NewServiceRouter(db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, moderation_reason, key_id, queue, deliveries, leased_until, date_acknowledged FROM messages").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows(messageSnapshotColumns))
+	mock.ExpectQuery("DELETE FROM messages").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address", "owner", "moderation_status", "scheduled"}).AddRow("192.168.200.201", nil, "approved", false))
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").WillReturnError(errors.New("permission denied for table audit_log"))
+	mock.ExpectRollback()
+
+	req, _ := http.NewRequest("DELETE", "/messages/123", nil)
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err, "Deletion should be rolled back along with its audit entry")
+
+	assert.Equal(t, http.StatusInternalServerError, response.Code, "Response status code not as expected")
+}
+
+func Test_ShouldPreferClientCertificateSubjectAsAuditActor(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	sr := &MessageServiceRouter{TrustedProxies: []*net.IPNet{proxies}}
+	req, _ := http.NewRequest("DELETE", "/messages/123", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("X-Actor", "moderator")
+
+	assert.Equal(t, "moderator", sr.auditActor(req), "Actor was not taken from the X-Actor header")
+
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "ops-client"}}}}}
+
+	assert.Equal(t, "CN=ops-client", sr.auditActor(req), "Actor was not taken from the client certificate")
+}
+
+func Test_ShouldIgnoreActorHeaderFromUntrustedNetworks(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	req, _ := http.NewRequest("DELETE", "/messages/123", nil)
+	req.RemoteAddr = "192.168.200.201:5000"
+	req.Header.Set("X-Actor", "moderator")
+
+	assert.Equal(t, "anonymous", (&MessageServiceRouter{}).auditActor(req), "X-Actor header should be ignored without trusted proxies")
+	assert.Equal(t, "anonymous", (&MessageServiceRouter{TrustedProxies: []*net.IPNet{proxies}}).auditActor(req), "X-Actor header should be ignored from outside the trusted proxies")
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"amigo-tech-test/service/model"
+	"context"
+	"database/sql"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// BlockWrites rejects requests which would modify data; reads are still permitted.
+	BlockWrites = "writes"
+	// BlockAll rejects every request from a blocked network.
+	BlockAll = "all"
+
+	defaultBlockListRefresh = 30 * time.Second
+)
+
+type blockedNetwork struct {
+	network   *net.IPNet
+	expiresAt *time.Time
+}
+
+// blockList is an in-memory copy of the active blocked_networks rows, so the
+// request pipeline does not need to query the database on every request.
+type blockList struct {
+	mu       sync.RWMutex
+	networks []blockedNetwork
+}
+
+func (bl *blockList) refresh(ctx context.Context, db *sql.DB) error {
+	rows, err := model.GetActiveBlockedNetworks(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	networks := make([]blockedNetwork, 0, len(rows))
+	for _, row := range rows {
+		ipNet, err := parseNetwork(row.Network)
+		if err != nil {
+			slog.Warn("Ignoring blocked network", "id", row.Id, "error", err)
+			continue
+		}
+		networks = append(networks, blockedNetwork{ipNet, row.ExpiresAt})
+	}
+
+	bl.mu.Lock()
+	bl.networks = networks
+	bl.mu.Unlock()
+	return nil
+}
+
+// refreshBlockListPeriodically reloads the block list every BlockListRefresh until the context is
+// cancelled, so networks blocked or unblocked on other instances take effect here too.
+func (sr *MessageServiceRouter) refreshBlockListPeriodically(ctx context.Context) {
+	interval := sr.BlockListRefresh
+	if interval <= 0 {
+		interval = defaultBlockListRefresh
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sr.refreshBlockList(ctx)
+	}
+}
+
+func (bl *blockList) contains(ip net.IP, now time.Time) bool {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	for _, n := range bl.networks {
+		if n.expiresAt != nil && !n.expiresAt.After(now) {
+			continue
+		}
+		if n.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetwork accepts either CIDR notation or a single address, which is
+// treated as a network containing only that address.
+func parseNetwork(value string) (*net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(value); err == nil {
+		return ipNet, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "CIDR address", Text: value}
+	}
+
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// blocked reports whether a request comes from a blocked network.
+func (sr *MessageServiceRouter) blocked(r *http.Request) bool {
+	ip, err := getClientIp(r)
+	return err == nil && sr.blockList.contains(ip, time.Now())
+}
+
+func (sr *MessageServiceRouter) rejectBlockedNetworks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sr.BlockMode == BlockAll || isWriteMethod(r.Method) {
+			if sr.blocked(r) {
+				respondWithError(w, http.StatusForbidden, "Requests from this address are blocked")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"bytes"
+	"time"
+)
+
+func expectBlockedNetworks(mock sqlmock.Sqlmock, networks ...string) {
+	rows := sqlmock.NewRows([]string{"id", "network", "reason", "expires_at", "date_created"})
+	for i, network := range networks {
+		rows.AddRow(i+1, network, "", nil, time.Now())
+	}
+	mock.ExpectQuery("SELECT (.+) FROM blocked_networks").WillReturnRows(rows)
+}
+
+func Test_ShouldRejectWriteFromBlockedNetwork(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	expectBlockedNetworks(mock, "192.168.0.0/16")
+	router = (&MessageServiceRouter{BlockMode: BlockWrites}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Test message value")))
+	req.RemoteAddr = "192.168.200.201:5000"
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusForbidden, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Requests from this address are blocked\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldAllowReadFromBlockedNetworkWhenOnlyBlockingWrites(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	expectBlockedNetworks(mock, "192.168.0.0/16")
+	router = (&MessageServiceRouter{BlockMode: BlockWrites}).NewServiceRouter(db)
+
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(11).
+		WillReturnRows(sqlmock.NewRows([]string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}).AddRow("Test message value", "192.168.200.201", time.Now(), "approved", nil, 1))
+
+	req, _ := http.NewRequest("GET", "/messages/11", nil)
+	req.RemoteAddr = "192.168.200.201:5000"
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Response status code not as expected")
+}
+
+func Test_ShouldRejectReadFromBlockedNetworkWhenBlockingAll(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	expectBlockedNetworks(mock, "192.168.200.201")
+	router = (&MessageServiceRouter{BlockMode: BlockAll}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("GET", "/messages/11", nil)
+	req.RemoteAddr = "192.168.200.201:5000"
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusForbidden, response.Code, "Response status code not as expected")
+}
+
+func Test_ShouldIgnoreExpiredBlockedNetworks(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	bl := &blockList{networks: []blockedNetwork{{ipNet, &expired}}}
+
+	assert.False(t, bl.contains(net.ParseIP("10.1.2.3"), time.Now()), "Expired network should not be blocked")
+	assert.True(t, bl.contains(net.ParseIP("10.1.2.3"), expired.Add(-time.Minute)), "Network should be blocked before it expires")
+}
+
+func Test_ShouldParseSingleAddressAsNetwork(t *testing.T) {
+	ipv4, err := parseNetwork("192.168.200.201")
+	assert.Nil(t, err)
+	assert.Equal(t, "192.168.200.201/32", ipv4.String(), "IPv4 address was not converted to a network")
+
+	ipv6, err := parseNetwork("::1")
+	assert.Nil(t, err)
+	assert.Equal(t, "::1/128", ipv6.String(), "IPv6 address was not converted to a network")
+
+	_, err = parseNetwork("not_a_network")
+	assert.NotNil(t, err)
+}
+
+func Test_ShouldRefreshBlockListPeriodically(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	expectBlockedNetworks(mock)
+	expectBlockedNetworks(mock, "192.168.0.0/16")
+	sr := &MessageServiceRouter{BlockMode: BlockWrites, BlockListRefresh: 10 * time.Millisecond}
+	router = sr.NewServiceRouter(db)
+	defer sr.Shutdown(context.Background())
+
+	assert.Eventually(t, func() bool {
+		return sr.blockList.contains(net.ParseIP("192.168.1.20"), time.Now())
+	}, time.Second, 10*time.Millisecond, "Network blocked by another instance was not picked up")
+}
@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"amigo-tech-test/service/model"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	EncodingJSON     = "json"
+	EncodingProtobuf = "protobuf"
+
+	KeyByMessage = "message"
+	KeyByIp      = "ip"
+	KeyByOwner   = "owner"
+)
+
+// Codec encodes message events for publishing, and picks the key which orders them. Brokers keep
+// events with the same key in order, by producing them to the same partition.
+type Codec struct {
+	// Encoding is "json", the default, or "protobuf" following message_event.proto.
+	Encoding string
+	// KeyBy is "message", the default, to key events by message ID, "ip" to key them by the
+	// message's IP address, or "owner" to key them by the message's owner, falling back to its IP
+	// address for messages without one.
+	KeyBy string
+}
+
+// event is a message event as it is published, along with the ID consumers use to discard any they
+// have already handled.
+type event struct {
+	EventId string `json:"event_id"`
+	model.OutboxPayload
+}
+
+// Encode returns the body and key to publish an event from the outbox with.
+func (c Codec) Encode(eventId string, payload []byte) ([]byte, string, error) {
+	e := event{EventId: eventId}
+	if err := json.Unmarshal(payload, &e.OutboxPayload); err != nil {
+		return nil, "", fmt.Errorf("Malformed event payload: %w", err)
+	}
+
+	key := strconv.Itoa(e.MessageId)
+	switch c.KeyBy {
+	case KeyByIp:
+		key = e.IpAddress
+	case KeyByOwner:
+		key = e.Owner
+		if key == "" {
+			key = e.IpAddress
+		}
+	}
+
+	if c.Encoding == EncodingProtobuf {
+		return encodeProtobuf(e), key, nil
+	}
+	body, err := json.Marshal(e)
+	return body, key, err
+}
+
+func (c Codec) contentType() string {
+	if c.Encoding == EncodingProtobuf {
+		return "application/x-protobuf"
+	}
+	return "application/json"
+}
+
+// encodeProtobuf encodes an event as a MessageEvent, following message_event.proto. Fields with
+// their default value are left out, as proto3 expects.
+func encodeProtobuf(e event) []byte {
+	var b []byte
+	b = appendString(b, 1, e.EventId)
+	b = appendString(b, 2, e.Event)
+	b = appendVarint(b, 3, uint64(e.MessageId))
+	b = appendString(b, 4, e.IpAddress)
+	b = appendString(b, 6, e.Owner)
+
+	if m := e.Message; m != nil {
+		var message []byte
+		message = appendVarint(message, 1, uint64(m.Id))
+		message = appendString(message, 2, m.Value)
+		message = appendString(message, 3, m.IpAddress)
+		if !m.DateCreated.IsZero() {
+			// google.protobuf.Timestamp
+			var timestamp []byte
+			timestamp = appendVarint(timestamp, 1, uint64(m.DateCreated.Unix()))
+			timestamp = appendVarint(timestamp, 2, uint64(m.DateCreated.Nanosecond()))
+			message = appendBytes(message, 4, timestamp)
+		}
+		message = appendString(message, 5, m.Status)
+		b = appendBytes(b, 5, message)
+	}
+	return b
+}
+
+func appendString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendVarint(b []byte, num protowire.Number, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, value)
+}
+
+func appendBytes(b []byte, num protowire.Number, value []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+// fillName replaces the placeholders in a subject or topic name.
+func fillName(name string, placeholders ...string) string {
+	return strings.NewReplacer(placeholders...).Replace(name)
+}
@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	createdPayload = `{"event":"created","message_id":11,"ip_address":"10.0.0.1","message":{"id":11,"value":"hello","ip_address":"10.0.0.1","date_created":"2017-06-25T14:22:12.296925Z","status":"approved"}}`
+	deletedPayload = `{"event":"deleted","message_id":11,"ip_address":"10.0.0.1"}`
+	eventId        = "a5e0c5f2-7f43-4d0c-8a4e-1b2f0c9d3e11"
+)
+
+// protoFields decodes the top level fields of a protobuf message, keeping the last value of each.
+func protoFields(t *testing.T, b []byte) map[protowire.Number][]byte {
+	fields := map[protowire.Number][]byte{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		assert.True(t, n > 0, "Malformed tag")
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		assert.True(t, n > 0, "Malformed field %d", num)
+		if typ == protowire.BytesType {
+			fields[num], _ = protowire.ConsumeBytes(b)
+		} else {
+			v, _ := protowire.ConsumeVarint(b)
+			fields[num] = protowire.AppendVarint(nil, v)
+		}
+		b = b[n:]
+	}
+	return fields
+}
+
+func Test_ShouldEncodeEventAsJsonWithItsId(t *testing.T) {
+	body, key, err := Codec{Encoding: EncodingJSON, KeyBy: KeyByMessage}.Encode(eventId, []byte(deletedPayload))
+
+	assert.Nil(t, err)
+	assert.Equal(t, `{"event_id":"a5e0c5f2-7f43-4d0c-8a4e-1b2f0c9d3e11","event":"deleted","message_id":11,"ip_address":"10.0.0.1"}`, string(body), "Body not as expected")
+	assert.Equal(t, "11", key, "Events should be keyed by message ID")
+}
+
+func Test_ShouldEncodeEventAsProtobuf(t *testing.T) {
+	body, key, err := Codec{Encoding: EncodingProtobuf, KeyBy: KeyByIp}.Encode(eventId, []byte(createdPayload))
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", key, "Events should be keyed by IP address")
+
+	event := protoFields(t, body)
+	assert.Equal(t, eventId, string(event[1]), "Event ID not as expected")
+	assert.Equal(t, "created", string(event[2]), "Event type not as expected")
+	assert.Equal(t, protowire.AppendVarint(nil, 11), event[3], "Message ID not as expected")
+	assert.Equal(t, "10.0.0.1", string(event[4]), "IP address not as expected")
+
+	message := protoFields(t, event[5])
+	assert.Equal(t, "hello", string(message[2]), "Message value not as expected")
+	assert.Equal(t, "approved", string(message[5]), "Message status not as expected")
+
+	timestamp := protoFields(t, message[4])
+	assert.Equal(t, protowire.AppendVarint(nil, 1498400532), timestamp[1], "Timestamp seconds not as expected")
+	assert.Equal(t, protowire.AppendVarint(nil, 296925000), timestamp[2], "Timestamp nanos not as expected")
+}
+
+func Test_ShouldKeyDeletedEventsByIpAddress(t *testing.T) {
+	_, key, err := Codec{Encoding: EncodingProtobuf, KeyBy: KeyByIp}.Encode(eventId, []byte(deletedPayload))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", key, "Deleted events should keep their message's IP address")
+}
+
+func Test_ShouldKeyEventsByOwnerFallingBackToIpAddress(t *testing.T) {
+	_, key, err := Codec{KeyBy: KeyByOwner}.Encode(eventId, []byte(`{"event":"deleted","message_id":11,"ip_address":"10.0.0.1","owner":"CN=orders"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "CN=orders", key, "Events should be keyed by owner")
+
+	_, key, err = Codec{KeyBy: KeyByOwner}.Encode(eventId, []byte(deletedPayload))
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", key, "Events for messages without an owner should be keyed by IP address")
+}
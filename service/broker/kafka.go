@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultKafkaTopic   = "messages"
+	defaultKafkaTimeout = 10 * time.Second
+
+	// kafkaResponseLimit is how much of the proxy's response is read.
+	kafkaResponseLimit = 64 << 10
+)
+
+// KafkaConfig configures producing to Kafka through the Confluent REST Proxy, which must be running
+// in front of the cluster, as Kafka's native protocol is not spoken.
+type KafkaConfig struct {
+	// RestProxyUrl is the Kafka REST Proxy events are produced through, e.g. http://localhost:8082.
+	RestProxyUrl string `mapstructure:"rest_proxy_url"`
+	// Topic is the topic events are produced to, with {event} replaced by the event type. Defaults
+	// to "messages".
+	Topic string `mapstructure:"topic"`
+	// Timeout bounds each request to the proxy, defaulting to 10 seconds.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// KafkaPublisher produces message events to Kafka through the REST Proxy's v2 API, keyed so that
+// events with the same key are kept in order on one partition. Events are produced as binary records,
+// so the key and value reach Kafka exactly as encoded.
+type KafkaPublisher struct {
+	client *http.Client
+	url    string
+	topic  string
+	codec  Codec
+}
+
+func NewKafkaPublisher(config KafkaConfig, codec Codec) *KafkaPublisher {
+	p := &KafkaPublisher{
+		client: &http.Client{Timeout: config.Timeout},
+		url:    strings.TrimSuffix(config.RestProxyUrl, "/"),
+		topic:  config.Topic,
+		codec:  codec,
+	}
+	if p.client.Timeout <= 0 {
+		p.client.Timeout = defaultKafkaTimeout
+	}
+	if p.topic == "" {
+		p.topic = defaultKafkaTopic
+	}
+	return p
+}
+
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+// kafkaRecord holds a binary record's key and value, which are base64 encoded as []byte.
+type kafkaRecord struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type kafkaResponse struct {
+	Offsets []struct {
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, eventId, event string, messageId int, payload []byte) error {
+	value, key, err := p.codec.Encode(eventId, payload)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(kafkaRecords{[]kafkaRecord{{Key: []byte(key), Value: value}}})
+	if err != nil {
+		return err
+	}
+
+	topic := url.PathEscape(fillName(p.topic, "{event}", event))
+	req, err := http.NewRequestWithContext(ctx, "POST", p.url+"/topics/"+topic, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.binary.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result kafkaResponse
+	json.NewDecoder(io.LimitReader(resp.Body, kafkaResponseLimit)).Decode(&result)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Kafka REST Proxy responded with %s: %s", resp.Status, result.Message)
+	}
+	for _, offset := range result.Offsets {
+		if offset.ErrorCode != nil {
+			return fmt.Errorf("Kafka REST Proxy failed to produce the event: %s", offset.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+// newKafkaStandIn stands in for a Kafka REST Proxy, recording the records produced to each topic
+// and responding with the given status and body.
+func newKafkaStandIn(t *testing.T, status int, response string) (*httptest.Server, map[string][]kafkaRecord) {
+	produced := map[string][]kafkaRecord{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/vnd.kafka.binary.v2+json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		var body kafkaRecords
+		json.NewDecoder(r.Body).Decode(&body)
+		produced[r.URL.Path] = append(produced[r.URL.Path], body.Records...)
+
+		w.Header().Set("Content-Type", "application/vnd.kafka.v2+json")
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return server, produced
+}
+
+func Test_ShouldProduceKeyedEventToKafka(t *testing.T) {
+	server, produced := newKafkaStandIn(t, http.StatusOK, `{"offsets":[{"partition":2,"offset":17,"error_code":null,"error":null}]}`)
+	publisher := NewKafkaPublisher(KafkaConfig{RestProxyUrl: server.URL + "/", Topic: "messages-{event}"}, Codec{KeyBy: KeyByIp})
+
+	err := publisher.Publish(context.Background(), eventId, "deleted", 11, []byte(deletedPayload))
+	assert.Nil(t, err)
+
+	records := produced["/topics/messages-deleted"]
+	assert.Len(t, records, 1, "The event should be produced to the topic for its type")
+	assert.Equal(t, "10.0.0.1", string(records[0].Key), "Key not as expected")
+	assert.Equal(t, `{"event_id":"a5e0c5f2-7f43-4d0c-8a4e-1b2f0c9d3e11","event":"deleted","message_id":11,"ip_address":"10.0.0.1"}`, string(records[0].Value), "Value not as expected")
+}
+
+func Test_ShouldFailWhenKafkaRejectsEvent(t *testing.T) {
+	server, _ := newKafkaStandIn(t, http.StatusNotFound, `{"error_code":40401,"message":"Topic messages not found."}`)
+	publisher := NewKafkaPublisher(KafkaConfig{RestProxyUrl: server.URL}, Codec{})
+
+	err := publisher.Publish(context.Background(), eventId, "created", 11, []byte(createdPayload))
+
+	assert.EqualError(t, err, "Kafka REST Proxy responded with 404 Not Found: Topic messages not found.")
+}
+
+func Test_ShouldFailWhenKafkaFailsToStoreEvent(t *testing.T) {
+	server, _ := newKafkaStandIn(t, http.StatusOK, `{"offsets":[{"partition":null,"offset":null,"error_code":50003,"error":"Leader not available"}]}`)
+	publisher := NewKafkaPublisher(KafkaConfig{RestProxyUrl: server.URL}, Codec{})
+
+	err := publisher.Publish(context.Background(), eventId, "created", 11, []byte(createdPayload))
+
+	assert.EqualError(t, err, "Kafka REST Proxy failed to produce the event: Leader not available")
+}
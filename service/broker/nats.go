@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	defaultNatsSubject = "messages.{event}"
+
+	// natsFlushTimeout bounds waiting for the server to receive an event, when the context has no
+	// deadline of its own.
+	natsFlushTimeout = 10 * time.Second
+)
+
+type NatsConfig struct {
+	// Url is the NATS server, or a comma separated list of the servers in a cluster.
+	Url string `mapstructure:"url"`
+	// Subject is the subject events are published on, with {event} replaced by the event type and
+	// {key} by the event's key. Defaults to "messages.{event}".
+	Subject string `mapstructure:"subject"`
+	// JetStream waits for the stream bound to the subject to store each event, which it deduplicates
+	// by event ID. Otherwise events are published with core NATS, which only waits for the server to
+	// receive them.
+	JetStream bool `mapstructure:"jetstream"`
+}
+
+// NatsPublisher publishes message events to NATS. Each event carries its ID in the Nats-Msg-Id header.
+type NatsPublisher struct {
+	conn    *nats.Conn
+	js      jetstream.JetStream
+	subject string
+	codec   Codec
+}
+
+// NewNatsPublisher connects to NATS, retrying in the background if no server is reachable yet.
+func NewNatsPublisher(config NatsConfig, codec Codec) (*NatsPublisher, error) {
+	conn, err := nats.Connect(config.Url,
+		nats.Name("amigo-tech-test"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		// Events published while disconnected fail, to be relayed again, rather than being buffered
+		// and lost if the connection is closed
+		nats.ReconnectBufSize(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("Lost connection to NATS", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			slog.Info("Reconnected to NATS", "server", conn.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &NatsPublisher{conn: conn, subject: config.Subject, codec: codec}
+	if p.subject == "" {
+		p.subject = defaultNatsSubject
+	}
+	if config.JetStream {
+		if p.js, err = jetstream.New(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *NatsPublisher) Publish(ctx context.Context, eventId, event string, messageId int, payload []byte) error {
+	body, key, err := p.codec.Encode(eventId, payload)
+	if err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(fillName(p.subject, "{event}", event, "{key}", subjectToken(key)))
+	msg.Data = body
+	msg.Header.Set(jetstream.MsgIDHeader, eventId)
+	msg.Header.Set("Content-Type", p.codec.contentType())
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, natsFlushTimeout)
+		defer cancel()
+	}
+
+	if p.js != nil {
+		_, err := p.js.PublishMsg(ctx, msg)
+		return err
+	}
+	if err := p.conn.PublishMsg(msg); err != nil {
+		return err
+	}
+	return p.conn.FlushWithContext(ctx)
+}
+
+// Close publishes anything still buffered and closes the connection.
+func (p *NatsPublisher) Close() error {
+	return p.conn.Drain()
+}
+
+// subjectToken makes a key safe to use as a single subject token, replacing the characters which
+// separate tokens or match them, such as the dots in an IPv4 address.
+func subjectToken(key string) string {
+	if key == "" {
+		return "_"
+	}
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(key)
+}
@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+)
+
+// newNatsServer starts a NATS server in-process on a random port, with JetStream storing streams
+// in a temporary directory when enabled.
+func newNatsServer(t *testing.T, jetStream bool) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: jetStream,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create NATS server: %v", err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server was not ready for connections")
+	}
+	t.Cleanup(func() {
+		s.Shutdown()
+		s.WaitForShutdown()
+	})
+	return s
+}
+
+func connectNats(t *testing.T, s *server.Server) *nats.Conn {
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+func newNatsPublisher(t *testing.T, config NatsConfig, codec Codec) *NatsPublisher {
+	publisher, err := NewNatsPublisher(config, codec)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { publisher.Close() })
+	return publisher
+}
+
+func Test_ShouldPublishEventToNats(t *testing.T) {
+	s := newNatsServer(t, false)
+	subscription, err := connectNats(t, s).SubscribeSync("messages.>")
+	assert.Nil(t, err)
+	publisher := newNatsPublisher(t, NatsConfig{Url: s.ClientURL(), Subject: "messages.{event}.{key}"}, Codec{KeyBy: KeyByIp})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = publisher.Publish(ctx, eventId, "deleted", 11, []byte(deletedPayload))
+	assert.Nil(t, err)
+
+	msg, err := subscription.NextMsgWithContext(ctx)
+	assert.Nil(t, err, "The event should be received once it is published")
+	assert.Equal(t, "messages.deleted.10_0_0_1", msg.Subject, "Subject not as expected")
+	assert.Equal(t, eventId, msg.Header.Get(nats.MsgIdHdr), "Event ID not as expected")
+	assert.Equal(t, "application/json", msg.Header.Get("Content-Type"), "Content type not as expected")
+	assert.Equal(t, `{"event_id":"a5e0c5f2-7f43-4d0c-8a4e-1b2f0c9d3e11","event":"deleted","message_id":11,"ip_address":"10.0.0.1"}`, string(msg.Data), "Body not as expected")
+}
+
+func Test_ShouldStoreEventOnceWithJetStream(t *testing.T) {
+	s := newNatsServer(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	js, err := jetstream.New(connectNats(t, s))
+	assert.Nil(t, err)
+	stream, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: "MESSAGES", Subjects: []string{"messages.>"}})
+	assert.Nil(t, err)
+	publisher := newNatsPublisher(t, NatsConfig{Url: s.ClientURL(), JetStream: true}, Codec{Encoding: EncodingProtobuf})
+
+	assert.Nil(t, publisher.Publish(ctx, eventId, "created", 11, []byte(createdPayload)))
+	assert.Nil(t, publisher.Publish(ctx, eventId, "created", 11, []byte(createdPayload)), "An event published again should be acknowledged")
+
+	info, err := stream.Info(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), info.State.Msgs, "An event published again should be discarded by its ID")
+
+	msg, err := stream.GetMsg(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "messages.created", msg.Subject, "Subject should default to the event type")
+	assert.Equal(t, eventId, msg.Header.Get(nats.MsgIdHdr), "Event ID not as expected")
+	assert.Equal(t, "application/x-protobuf", msg.Header.Get("Content-Type"), "Content type not as expected")
+}
+
+func Test_ShouldFailToPublishWithoutJetStreamAcknowledgement(t *testing.T) {
+	// No stream is bound to the subject, so nothing acknowledges the event
+	s := newNatsServer(t, true)
+	publisher := newNatsPublisher(t, NatsConfig{Url: s.ClientURL(), JetStream: true}, Codec{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := publisher.Publish(ctx, eventId, "created", 11, []byte(createdPayload))
+
+	assert.NotNil(t, err, "An event the stream has not acknowledged should not be treated as published")
+}
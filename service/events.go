@@ -0,0 +1,160 @@
+package service
+
+import (
+	"amigo-tech-test/service/model"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+const (
+	eventCreated = model.EventCreated
+	eventUpdated = model.EventUpdated
+	eventDeleted = model.EventDeleted
+)
+
+// messageEvent reports a message being created, updated or deleted. Events are sent between
+// instances without the message, which is loaded by each instance with subscribers to deliver it to.
+type messageEvent struct {
+	Type    string         `json:"type"`
+	Id      int            `json:"id"`
+	Message *model.Message `json:"-"`
+}
+
+// EventListener receives the message events sent by the trigger on the messages table, so that
+// subscribers on every instance see changes made through any of them, or by anything else writing
+// to the database.
+type EventListener interface {
+	// Listen delivers each event's JSON payload until the context is cancelled, re-establishing its
+	// connection if it is lost.
+	Listen(ctx context.Context, deliver func(payload []byte))
+}
+
+// eventBus fans message events out to the subscribers on this instance, such as streams and
+// sockets. A subscriber which falls more than its buffer behind is dropped, closing its channel,
+// rather than holding up the rest.
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan messageEvent]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: map[chan messageEvent]struct{}{}}
+}
+
+func (b *eventBus) subscribe(buffer int) chan messageEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := make(chan messageEvent, buffer)
+	b.subscribers[events] = struct{}{}
+	return events
+}
+
+func (b *eventBus) unsubscribe(events chan messageEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[events]; ok {
+		delete(b.subscribers, events)
+		close(events)
+	}
+}
+
+func (b *eventBus) idle() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers) == 0
+}
+
+func (b *eventBus) publish(event messageEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(b.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// publishEvent announces an event for a change requested by a client, even if the client has gone.
+func (sr *MessageServiceRouter) publishEvent(r *http.Request, eventType string, id int) {
+	sr.announceEvent(context.WithoutCancel(r.Context()), eventType, id)
+}
+
+// checkEventChannel reports when the messages table's triggers send events on a different channel
+// to the one listened on, as streams would then miss every change. Only listeners which name their
+// channel can be checked.
+func (sr *MessageServiceRouter) checkEventChannel(ctx context.Context) {
+	listener, ok := sr.EventListener.(interface{ Channel() string })
+	if !ok {
+		return
+	}
+
+	ctx, cancel := withTimeout(ctx, sr.current().Timeouts.Read)
+	defer cancel()
+
+	channels, err := model.GetEventChannels(ctx, sr.db)
+	if err != nil {
+		slog.Warn("Unable to check the channel message events are sent on", "error", err)
+		return
+	}
+	if !slices.Equal(channels, []string{listener.Channel()}) {
+		slog.Error("Messages table triggers do not send events on the channel listened on", "listening", listener.Channel(), "trigger_channels", channels)
+	}
+}
+
+// announceEvent wakes the outbox relay for a change made on this instance, and delivers its event
+// to this instance's subscribers when it is not listening for events from the database. Otherwise
+// the messages table's trigger notifies every instance, including this one, once the change is
+// committed. Webhooks are queued along with the change itself.
+func (sr *MessageServiceRouter) announceEvent(ctx context.Context, eventType string, id int) {
+	sr.wakeRelay()
+	if sr.EventListener != nil {
+		return
+	}
+	sr.deliverEvent(ctx, messageEvent{Type: eventType, Id: id})
+}
+
+// receiveEvent delivers an event notified by the database to the subscribers on this instance.
+func (sr *MessageServiceRouter) receiveEvent(ctx context.Context, payload []byte) {
+	var event messageEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		slog.Error("Ignoring malformed message event", "error", err)
+		return
+	}
+	sr.deliverEvent(ctx, event)
+}
+
+// deliverEvent loads the message an event is for and publishes it to the subscribers on this instance.
+// Events for messages which are not visible, such as those quarantined by moderation, are dropped.
+func (sr *MessageServiceRouter) deliverEvent(ctx context.Context, event messageEvent) {
+	if sr.events.idle() {
+		return
+	}
+
+	if event.Type != eventDeleted {
+		ctx, cancel := withTimeout(ctx, sr.current().Timeouts.Read)
+		defer cancel()
+
+		m := model.Message{Id: event.Id}
+		err := sr.read(ctx, func(ctx context.Context) error { return m.GetMessage(ctx, sr.db, sr.Storage) })
+		if err == sql.ErrNoRows {
+			return
+		} else if err != nil {
+			slog.ErrorContext(ctx, "Error loading message for event", "error", err, "type", event.Type, "message_id", event.Id)
+			return
+		}
+		event.Message = &m
+	}
+
+	sr.events.publish(event)
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"amigo-tech-test/service/model"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	healthOk      = "ok"
+	healthFailing = "failing"
+
+	healthCheckTimeout = 2 * time.Second
+)
+
+type healthCheck struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// Drain marks the service as shutting down, so that readiness checks fail while in-flight requests
+// are completed, and closes any message streams.
+func (sr *MessageServiceRouter) Drain() {
+	if !sr.draining.Swap(true) && sr.drained != nil {
+		close(sr.drained)
+	}
+}
+
+// getHealth reports the process is alive. It has no dependencies, so that a database outage does not
+// cause an orchestrator to restart the service.
+func (sr *MessageServiceRouter) getHealth(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, healthReport{Status: healthOk})
+}
+
+// getReadiness reports whether the service can handle requests, responding 503 if any check fails.
+func (sr *MessageServiceRouter) getReadiness(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Status: healthOk, Checks: map[string]healthCheck{}}
+
+	checks := map[string]func(ctx context.Context) error{
+		"database":   sr.db.PingContext,
+		"migrations": sr.checkSchemaVersion,
+		"draining":   sr.checkNotDraining,
+	}
+
+	for name, check := range checks {
+		report.Checks[name] = runHealthCheck(r.Context(), check)
+		if report.Checks[name].Status != healthOk {
+			report.Status = healthFailing
+		}
+	}
+
+	code := http.StatusOK
+	if report.Status != healthOk {
+		code = http.StatusServiceUnavailable
+	}
+	respondWithJSON(w, code, report)
+}
+
+func runHealthCheck(ctx context.Context, check func(ctx context.Context) error) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	result := healthCheck{Status: healthOk, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status, result.Error = healthFailing, err.Error()
+	}
+	return result
+}
+
+func (sr *MessageServiceRouter) checkSchemaVersion(ctx context.Context) error {
+	version, err := model.GetSchemaVersion(ctx, sr.db)
+	if err != nil {
+		return err
+	}
+	if version < model.SchemaVersion {
+		return fmt.Errorf("Schema version %d is behind the expected version %d", version, model.SchemaVersion)
+	}
+	return nil
+}
+
+func (sr *MessageServiceRouter) checkNotDraining(ctx context.Context) error {
+	if sr.draining.Load() {
+		return errors.New("Service is shutting down")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"testing"
+	"amigo-tech-test/service/model"
+	"encoding/json"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+)
+
+func expectReadinessChecks(mock sqlmock.Sqlmock, schemaVersion int) {
+	mock.ExpectPing()
+	mock.ExpectQuery("SELECT MAX\\(version\\) FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(schemaVersion))
+}
+
+func readinessReport(t *testing.T, body []byte) healthReport {
+	var report healthReport
+	assert.Nil(t, json.Unmarshal(body, &report))
+	return report
+}
+
+func Test_ShouldReportHealthy(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"status\":\"ok\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldReportReady(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+	expectReadinessChecks(mock, model.SchemaVersion)
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Response status code not as expected")
+	report := readinessReport(t, response.Body.Bytes())
+	assert.Equal(t, "ok", report.Status, "Overall status not as expected")
+	for _, name := range []string{"database", "migrations", "draining"} {
+		assert.Equal(t, "ok", report.Checks[name].Status, "Status of "+name+" check not as expected")
+	}
+}
+
+func Test_ShouldReportNotReadyWhenDatabaseUnreachable(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	mock.ExpectQuery("SELECT MAX\\(version\\) FROM schema_migrations").WillReturnError(errors.New("connection refused"))
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Response status code not as expected")
+	report := readinessReport(t, response.Body.Bytes())
+	assert.Equal(t, "failing", report.Status, "Overall status not as expected")
+	assert.Equal(t, healthCheck{Status: "failing", Error: "connection refused"}, withoutLatency(report.Checks["database"]), "Database check not as expected")
+	assert.Equal(t, "ok", report.Checks["draining"].Status, "Draining check not as expected")
+}
+
+func Test_ShouldReportNotReadyWhenSchemaIsBehind(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+	expectReadinessChecks(mock, model.SchemaVersion-1)
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Response status code not as expected")
+	report := readinessReport(t, response.Body.Bytes())
+	assert.Equal(t, "failing", report.Checks["migrations"].Status, "Migrations check not as expected")
+	assert.Equal(t, "ok", report.Checks["database"].Status, "Database check not as expected")
+}
+
+func Test_ShouldReportNotReadyWhileDraining(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	sr := &MessageServiceRouter{}
+	router = sr.NewServiceRouter(db)
+	expectReadinessChecks(mock, model.SchemaVersion)
+
+	sr.Drain()
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Response status code not as expected")
+	report := readinessReport(t, response.Body.Bytes())
+	assert.Equal(t, healthCheck{Status: "failing", Error: "Service is shutting down"}, withoutLatency(report.Checks["draining"]), "Draining check not as expected")
+}
+
+func withoutLatency(check healthCheck) healthCheck {
+	check.LatencyMs = 0
+	return check
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"net"
 	"fmt"
+	"log/slog"
 	"net/url"
+	"strconv"
 )
 
 func getQueryParamOrDefault(queryVals url.Values, key, defaultVal string) string{
@@ -15,6 +17,24 @@ func getQueryParamOrDefault(queryVals url.Values, key, defaultVal string) string
 	return defaultVal
 }
 
+// getPaging reads the offset and limit query params, limiting pages to the configured maximum.
+func getPaging(queryVals url.Values, paging Paging) (offset, limit int) {
+	defaultLimit, maxLimit := paging.limits()
+	limit, _ = strconv.Atoi(getQueryParamOrDefault(queryVals, "limit", strconv.Itoa(defaultLimit)))
+	offset, _ = strconv.Atoi(getQueryParamOrDefault(queryVals, "offset", "0"))
+
+	if limit < 1 {
+		limit = defaultLimit
+	} else if limit > maxLimit {
+		limit = maxLimit
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+	return offset, limit
+}
+
 func getClientIp(req *http.Request) (net.IP, error) {
 	ip, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
@@ -28,8 +48,17 @@ func getClientIp(req *http.Request) (net.IP, error) {
 	return userIP, nil
 }
 
+// respondWithError responds with the error message and request ID, logging server errors.
 func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, map[string]string{"error": message})
+	body := map[string]string{"error": message}
+	if id := responseRequestId(w); id != "" {
+		body["request_id"] = id
+	}
+
+	if code >= http.StatusInternalServerError {
+		slog.Error("Request failed", "status", code, "error", message, "request_id", responseRequestId(w))
+	}
+	respondWithJSON(w, code, body)
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"amigo-tech-test/util"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/felixge/httpsnoop"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	requestIdHeader = "X-Request-ID"
+
+	maxRequestIdLength = 128
+)
+
+type requestLogger struct {
+	next http.Handler
+}
+
+// LogRequests logs a line for every request handled. Each request is given an ID, taken from the
+// X-Request-ID header when the client provides a valid one, which is returned in the same header,
+// included in error responses and attached to every line logged while handling the request.
+func LogRequests(next http.Handler) http.Handler {
+	return &requestLogger{next}
+}
+
+func (l *requestLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(requestIdHeader)
+	if !validRequestId(id) {
+		id = newRequestId()
+	}
+	w.Header().Set(requestIdHeader, id)
+	r = r.WithContext(util.WithRequestId(r.Context(), id))
+
+	m := httpsnoop.CaptureMetrics(l.next, w, r)
+
+	level := slog.LevelInfo
+	if m.Code >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+
+	slog.Default().LogAttrs(r.Context(), level, "Request handled",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", m.Code),
+		slog.Int64("bytes", m.Written),
+		slog.Float64("duration_ms", float64(m.Duration.Microseconds())/1000),
+		slog.String("remote_addr", r.RemoteAddr),
+		slog.String("user_agent", r.UserAgent()))
+}
+
+// validRequestId accepts IDs of printable ASCII without spaces, so a client cannot forge log lines.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// responseRequestId returns the ID LogRequests assigned to the request a response is for, if any.
+func responseRequestId(w http.ResponseWriter) string {
+	return w.Header().Get(requestIdHeader)
+}
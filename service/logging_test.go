@@ -0,0 +1,102 @@
+package service
+
+import (
+	"testing"
+	"amigo-tech-test/util"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// captureLogs sends log lines to a buffer until the returned func is called.
+func captureLogs(t *testing.T) (*bytes.Buffer, func()) {
+	var logs bytes.Buffer
+	logger, err := util.NewLogger(&logs, slog.LevelDebug, "json")
+	assert.Nil(t, err)
+
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	return &logs, func() { slog.SetDefault(previous) }
+}
+
+func logLines(t *testing.T, logs *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var fields map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &fields))
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+func Test_ShouldPropagateRequestIdToResponseAndLogs(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+	logs, restore := captureLogs(t)
+	defer restore()
+
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(11).
+		WillReturnError(errors.New("connection reset"))
+
+	req, _ := http.NewRequest("GET", "/messages/11", nil)
+	req.Header.Set("X-Request-ID", "client-supplied-id")
+	response := httptest.NewRecorder()
+	LogRequests(router).ServeHTTP(response, req)
+
+	assert.Equal(t, "client-supplied-id", response.Header().Get("X-Request-ID"), "Request ID was not returned")
+	assert.Equal(t, "{\"error\":\"connection reset\",\"request_id\":\"client-supplied-id\"}", response.Body.String(), "Response body does not match expected value")
+
+	lines := logLines(t, logs)
+	assert.Equal(t, 2, len(lines), "Expected the error and the request to be logged")
+	assert.Equal(t, "Request failed", lines[0]["msg"])
+	assert.Equal(t, "connection reset", lines[0]["error"])
+	assert.Equal(t, "Request handled", lines[1]["msg"])
+	assert.Equal(t, "ERROR", lines[1]["level"])
+	assert.Equal(t, float64(500), lines[1]["status"])
+	for _, line := range lines {
+		assert.Equal(t, "client-supplied-id", line["request_id"], "Log line is missing the request ID")
+	}
+}
+
+func Test_ShouldGenerateRequestIdWhenNoneValidIsProvided(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+	_, restore := captureLogs(t)
+	defer restore()
+
+	for _, provided := range []string{"", "forged\nline", strings.Repeat("a", 129)} {
+		req, _ := http.NewRequest("GET", "/healthz", nil)
+		req.Header.Set("X-Request-ID", provided)
+		response := httptest.NewRecorder()
+		LogRequests(router).ServeHTTP(response, req)
+
+		id := response.Header().Get("X-Request-ID")
+		assert.Equal(t, 32, len(id), "Expected a generated request ID in place of %q", provided)
+	}
+}
+
+func Test_ShouldLogAtConfiguredLevelAndFormat(t *testing.T) {
+	var logs bytes.Buffer
+	logger, err := util.NewLogger(&logs, slog.LevelWarn, "text")
+	assert.Nil(t, err)
+
+	logger.Info("Not logged")
+	logger.Warn("Logged", "count", 1)
+
+	assert.Contains(t, logs.String(), "level=WARN msg=Logged count=1")
+	assert.NotContains(t, logs.String(), "Not logged")
+
+	_, err = util.ParseLogLevel("verbose")
+	assert.NotNil(t, err)
+	_, err = util.NewLogger(&logs, slog.LevelInfo, "xml")
+	assert.NotNil(t, err)
+}
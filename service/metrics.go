@@ -0,0 +1,141 @@
+package service
+
+import (
+	"amigo-tech-test/service/model"
+	"context"
+	"database/sql"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+)
+
+const metricsNamespace = "amigo"
+
+// metrics holds the collectors exposed on /metrics. Its methods do nothing on a nil receiver, so
+// handlers can record metrics without checking whether they are enabled.
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	messagesCreated *prometheus.CounterVec
+	messagesDeleted prometheus.Counter
+	searchDuration  prometheus.Histogram
+}
+
+// newMetrics registers the collectors, bounding the query made on each scrape by queryTimeout.
+func newMetrics(db *sql.DB, queryTimeout func() time.Duration) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests handled, by route template, method and status code.",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to handle HTTP requests, by route template, method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		messagesCreated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_created_total",
+			Help:      "Messages created, by moderation status.",
+		}, []string{"status"}),
+		messagesDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_deleted_total",
+			Help:      "Messages deleted.",
+		}),
+		searchDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "message_search_duration_seconds",
+			Help:      "Time taken to search messages, including failed searches.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.messagesCreated,
+		m.messagesDeleted,
+		m.searchDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages",
+			Help:      "Messages currently stored, including those hidden by moderation.",
+		}, func() float64 { return countMessages(db, queryTimeout()) }),
+		collectors.NewDBStatsCollector(db, metricsNamespace),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// countMessages is evaluated on each scrape, reporting NaN rather than a stale count on error.
+func countMessages(db *sql.DB, timeout time.Duration) float64 {
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	defer cancel()
+
+	count, err := model.CountMessages(ctx, db)
+	if err != nil {
+		slog.Error("Unable to count messages for metrics", "error", err)
+		return math.NaN()
+	}
+	return float64(count)
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrument records the count and duration of requests, labelled with the template of the matched
+// route rather than the raw path to keep the number of series bounded. Requests which match no
+// route, or none for their method, are labelled "unmatched".
+func (m *metrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		labels := prometheus.Labels{"route": route}
+		promhttp.InstrumentHandlerCounter(m.requests.MustCurryWith(labels),
+			promhttp.InstrumentHandlerDuration(m.requestDuration.MustCurryWith(labels), next)).
+			ServeHTTP(w, r)
+	})
+}
+
+// methodNotAllowed responds as mux does by default when a route matches but not for the method used.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+func (m *metrics) messageCreated(status string) {
+	if m == nil {
+		return
+	}
+	m.messagesCreated.WithLabelValues(status).Inc()
+}
+
+func (m *metrics) messageDeleted() {
+	if m == nil {
+		return
+	}
+	m.messagesDeleted.Inc()
+}
+
+func (m *metrics) observeSearch(start time.Time) {
+	if m == nil {
+		return
+	}
+	m.searchDuration.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"testing"
+	"bytes"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"time"
+)
+
+func Test_ShouldExposeRequestMetricsByRouteTemplate(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Metrics: true}).NewServiceRouter(db)
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	columns := []string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(11).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("Test message value", "192.168.200.201", dateCreated, "approved", nil, 1))
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(12).
+		WillReturnError(sqlmock.ErrCancelled)
+	mock.ExpectQuery("SELECT COUNT\\(id\\) FROM messages").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(42))
+
+	executeRequest(mustRequest("GET", "/messages/11"))
+	executeRequest(mustRequest("GET", "/messages/12"))
+	response := executeRequest(mustRequest("GET", "/metrics"))
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	body := response.Body.String()
+	assert.Contains(t, body, `amigo_http_requests_total{code="200",method="get",route="/messages/{Id:[0-9]+}"} 1`)
+	assert.Contains(t, body, `amigo_http_requests_total{code="500",method="get",route="/messages/{Id:[0-9]+}"} 1`)
+	assert.Contains(t, body, `amigo_http_request_duration_seconds_count{code="200",method="get",route="/messages/{Id:[0-9]+}"} 1`)
+	assert.Contains(t, body, "amigo_messages 42")
+	assert.Contains(t, body, `go_sql_open_connections{db_name="amigo"}`)
+}
+
+func Test_ShouldCountUnmatchedRequests(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Metrics: true}).NewServiceRouter(db)
+
+	mock.ExpectQuery("SELECT COUNT\\(id\\) FROM messages").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	notFound := executeRequest(mustRequest("GET", "/nowhere"))
+	notAllowed := executeRequest(mustRequest("PUT", "/healthz"))
+	response := executeRequest(mustRequest("GET", "/metrics"))
+
+	assert.Equal(t, http.StatusNotFound, notFound.Code, "Unknown path should still return 404")
+	assert.Equal(t, http.StatusMethodNotAllowed, notAllowed.Code, "Unknown method should still return 405")
+
+	body := response.Body.String()
+	assert.Contains(t, body, `amigo_http_requests_total{code="404",method="get",route="unmatched"} 1`)
+	assert.Contains(t, body, `amigo_http_requests_total{code="405",method="put",route="unmatched"} 1`)
+}
+
+func Test_ShouldCountCreatedMessagesByStatus(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Metrics: true}).NewServiceRouter(db)
+
+	mock.ExpectQuery("INSERT INTO messages").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(22))
+	mock.ExpectQuery("SELECT COUNT\\(id\\) FROM messages").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Test message value")))
+	executeRequest(req)
+	response := executeRequest(mustRequest("GET", "/metrics"))
+
+	assert.Contains(t, response.Body.String(), `amigo_messages_created_total{status="approved"} 1`)
+}
+
+func Test_ShouldNotExposeMetricsWhenDisabled(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+
+	response := executeRequest(mustRequest("GET", "/metrics"))
+
+	assert.Equal(t, http.StatusNotFound, response.Code, "Response status code not as expected")
+}
+
+func mustRequest(method, url string) *http.Request {
+	req, _ := http.NewRequest(method, url, nil)
+	return req
+}
@@ -0,0 +1,327 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	"time"
+)
+
+// AuditEntry records a single mutation. Each entry's hash covers its own contents and the hash of
+// the entry before it, so altering or removing any entry breaks the chain from that point on.
+type AuditEntry struct {
+	Id          int             `json:"id"`
+	Action      string          `json:"action"`
+	Entity      string          `json:"entity"`
+	EntityId    int             `json:"entity_id"`
+	Actor       string          `json:"actor"`
+	ClientIp    string          `json:"client_ip"`
+	RequestId   string          `json:"request_id"`
+	Before      json.RawMessage `json:"before"`
+	After       json.RawMessage `json:"after"`
+	PrevHash    string          `json:"prev_hash"`
+	Hash        string          `json:"hash"`
+	DateCreated time.Time       `json:"date_created"`
+}
+
+type AuditFilter struct {
+	Action    string
+	Entity    string
+	EntityId  int
+	Actor     string
+	RequestId string
+	From      *time.Time
+	To        *time.Time
+}
+
+// BrokenChainError identifies the first audit entry whose hash does not match its contents, or
+// which does not link to the entry before it.
+type BrokenChainError struct {
+	Id int
+}
+
+func (e *BrokenChainError) Error() string {
+	return fmt.Sprintf("Audit log chain is broken at entry %d", e.Id)
+}
+
+// auditLockId is the advisory lock serialising appends, so that each entry links to the latest one.
+const auditLockId = 0x6175646974
+
+var auditColumns = []string{"id", "action", "entity", "entity_id", "actor", "client_ip", "request_id", "before", "after", "prev_hash", "hash", "date_created"}
+
+// snapshotter loads the state of an entity for the audit log, returning nil if there is no such entity.
+type snapshotter func(ctx context.Context, runner sq.BaseRunner, id int) (json.RawMessage, error)
+
+// audited makes a change in a transaction along with its audit entry, so that neither is kept without
+// the other. The change runs on its own when the entry is nil, as it is when auditing is disabled.
+func audited(ctx context.Context, db *sql.DB, e *AuditEntry, change func(runner sq.BaseRunner) error) error {
+	if e == nil {
+		return change(db)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := change(tx); err != nil {
+		return err
+	}
+	if err := e.appendTo(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// snapshotBefore records the state of the entity ahead of the change, if the change is audited.
+func (e *AuditEntry) snapshotBefore(ctx context.Context, runner sq.BaseRunner, id int, snapshot snapshotter) (err error) {
+	if e != nil {
+		e.Before, err = snapshot(ctx, runner, id)
+	}
+	return err
+}
+
+// snapshotAfter records the state of the entity once it has been changed, if the change is audited,
+// along with its ID, which is only known after a create.
+func (e *AuditEntry) snapshotAfter(ctx context.Context, runner sq.BaseRunner, id int, snapshot snapshotter) (err error) {
+	if e != nil {
+		e.EntityId = id
+		e.After, err = snapshot(ctx, runner, id)
+	}
+	return err
+}
+
+// copyFor returns a copy of the entry for another entity changed by the same request, such as each
+// of the messages claimed from a queue at once, or nil if the change is not audited.
+func (e *AuditEntry) copyFor(entityId int) *AuditEntry {
+	if e == nil {
+		return nil
+	}
+	c := *e
+	c.EntityId, c.Before, c.After = entityId, nil, nil
+	return &c
+}
+
+// appendTo appends the entry to the end of the chain within the transaction making the change it
+// describes. Appends are serialised until the transaction ends, so the entry links to the latest one.
+func (e *AuditEntry) appendTo(ctx context.Context, tx *sql.Tx) error {
+	if e == nil {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", auditLockId); err != nil {
+		return err
+	}
+
+	err := sq.Select("hash").
+		From("audit_log").
+		OrderBy("id DESC").
+		Limit(1).
+		RunWith(tx).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&e.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	// Postgres stores timestamps to the microsecond, so truncate before hashing
+	e.DateCreated = time.Now().UTC().Truncate(time.Microsecond)
+	e.Hash = e.computeHash()
+
+	return sq.Insert("audit_log").
+		Columns(auditColumns[1:]...).
+		Values(e.Action, e.Entity, e.EntityId, e.Actor, e.ClientIp, e.RequestId, nullableJSON(e.Before), nullableJSON(e.After), e.PrevHash, e.Hash, e.DateCreated).
+		Suffix("RETURNING \"id\"").
+		RunWith(tx).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&e.Id)
+}
+
+func (e *AuditEntry) computeHash() string {
+	contents, _ := json.Marshal(struct {
+		Action      string          `json:"action"`
+		Entity      string          `json:"entity"`
+		EntityId    int             `json:"entity_id"`
+		Actor       string          `json:"actor"`
+		ClientIp    string          `json:"client_ip"`
+		RequestId   string          `json:"request_id"`
+		Before      json.RawMessage `json:"before"`
+		After       json.RawMessage `json:"after"`
+		DateCreated string          `json:"date_created"`
+	}{e.Action, e.Entity, e.EntityId, e.Actor, e.ClientIp, e.RequestId, e.Before, e.After, e.DateCreated.UTC().Format(time.RFC3339Nano)})
+
+	hash := sha256.New()
+	hash.Write([]byte(e.PrevHash))
+	hash.Write([]byte("\n"))
+	hash.Write(contents)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func nullableJSON(value json.RawMessage) interface{} {
+	if value == nil {
+		return nil
+	}
+	return string(value)
+}
+
+// SearchAuditLog retrieves a page of audit entries matching the filter, newest first.
+func SearchAuditLog(ctx context.Context, db *sql.DB, filter AuditFilter, offset, limit int) (*Page, error) {
+	conditions := sq.And{}
+	if filter.Action != "" {
+		conditions = append(conditions, sq.Eq{"action": filter.Action})
+	}
+	if filter.Entity != "" {
+		conditions = append(conditions, sq.Eq{"entity": filter.Entity})
+	}
+	if filter.EntityId != 0 {
+		conditions = append(conditions, sq.Eq{"entity_id": filter.EntityId})
+	}
+	if filter.Actor != "" {
+		conditions = append(conditions, sq.Eq{"actor": filter.Actor})
+	}
+	if filter.RequestId != "" {
+		conditions = append(conditions, sq.Eq{"request_id": filter.RequestId})
+	}
+	if filter.From != nil {
+		conditions = append(conditions, sq.GtOrEq{"date_created": *filter.From})
+	}
+	if filter.To != nil {
+		conditions = append(conditions, sq.Lt{"date_created": *filter.To})
+	}
+
+	var totalCount int
+	err := sq.Select("COUNT(id)").
+		From("audit_log").
+		Where(conditions).
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&totalCount)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := queryAuditEntries(ctx, sq.Select(auditColumns...).
+		From("audit_log").
+		Where(conditions).
+		OrderBy("id DESC").
+		Limit(uint64(limit)).
+		Offset(uint64(offset)).
+		RunWith(db))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Page{offset, limit, totalCount, entries}, nil
+}
+
+// VerifyAuditLog walks the whole chain in batches, returning the number of entries checked and a
+// BrokenChainError at the first entry which fails verification.
+func VerifyAuditLog(ctx context.Context, db *sql.DB, batchSize int) (int, error) {
+	checked, lastId, prevHash := 0, 0, ""
+
+	for {
+		entries, err := queryAuditEntries(ctx, sq.Select(auditColumns...).
+			From("audit_log").
+			Where(sq.Gt{"id": lastId}).
+			OrderBy("id").
+			Limit(uint64(batchSize)).
+			RunWith(db))
+		if err != nil || len(entries) == 0 {
+			return checked, err
+		}
+
+		for _, e := range entries {
+			if e.PrevHash != prevHash || e.computeHash() != e.Hash {
+				return checked, &BrokenChainError{e.Id}
+			}
+			checked, lastId, prevHash = checked+1, e.Id, e.Hash
+		}
+	}
+}
+
+func queryAuditEntries(ctx context.Context, query sq.SelectBuilder) ([]AuditEntry, error) {
+	rows, err := query.PlaceholderFormat(sq.Dollar).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+
+	for rows.Next() {
+		var e AuditEntry
+		var before, after []byte
+		if err := rows.Scan(&e.Id, &e.Action, &e.Entity, &e.EntityId, &e.Actor, &e.ClientIp, &e.RequestId, &before, &after, &e.PrevHash, &e.Hash, &e.DateCreated); err != nil {
+			return nil, err
+		}
+		if before != nil {
+			e.Before = json.RawMessage(before)
+		}
+		if after != nil {
+			e.After = json.RawMessage(after)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// storedMessage is a message as it is held in the database, with its value still encrypted when
+// encryption is enabled, so that audit snapshots do not hold decrypted values. Queued messages also
+// record their place in the queue, but never their lease ID, which would let readers of the log
+// acknowledge them.
+type storedMessage struct {
+	Id               int        `json:"id"`
+	Value            string     `json:"value"`
+	IpAddress        string     `json:"ip_address"`
+	DateCreated      time.Time  `json:"date_created"`
+	Status           string     `json:"status"`
+	ModerationReason string     `json:"moderation_reason"`
+	KeyId            *string    `json:"key_id"`
+	Queue            *string    `json:"queue,omitempty"`
+	Deliveries       int        `json:"deliveries,omitempty"`
+	LeasedUntil      *time.Time `json:"leased_until,omitempty"`
+	DateAcknowledged *time.Time `json:"date_acknowledged,omitempty"`
+}
+
+// messageSnapshot returns the stored form of a message for the audit log, or nil if there is no such
+// message.
+func messageSnapshot(ctx context.Context, runner sq.BaseRunner, id int) (json.RawMessage, error) {
+	var m storedMessage
+	err := sq.Select("id", "value", "ip_address", "date_created", "moderation_status", "moderation_reason", "key_id",
+		"queue", "deliveries", "leased_until", "date_acknowledged").
+		From("messages").
+		Where(sq.Eq{"id": id}).
+		RunWith(runner).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&m.Id, &m.Value, &m.IpAddress, &m.DateCreated, &m.Status, &m.ModerationReason, &m.KeyId,
+			&m.Queue, &m.Deliveries, &m.LeasedUntil, &m.DateAcknowledged)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// blockedNetworkSnapshot returns a blocked network for the audit log, or nil if there is no such entry.
+func blockedNetworkSnapshot(ctx context.Context, runner sq.BaseRunner, id int) (json.RawMessage, error) {
+	b := BlockedNetwork{Id: id}
+	err := b.getBlockedNetwork(ctx, runner)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return json.Marshal(b)
+}
@@ -0,0 +1,203 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"encoding/json"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"time"
+)
+
+func auditRows(entries ...AuditEntry) *sqlmock.Rows {
+	rows := sqlmock.NewRows(auditColumns)
+	for _, e := range entries {
+		var before, after []byte
+		if e.Before != nil {
+			before = e.Before
+		}
+		if e.After != nil {
+			after = e.After
+		}
+		rows.AddRow(e.Id, e.Action, e.Entity, e.EntityId, e.Actor, e.ClientIp, e.RequestId, before, after, e.PrevHash, e.Hash, e.DateCreated)
+	}
+	return rows
+}
+
+func chainedEntries() []AuditEntry {
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+	first := AuditEntry{Id: 1, Action: "create", Entity: "message", EntityId: 22, Actor: "anonymous", ClientIp: "192.168.200.201", After: json.RawMessage(`{"id":22,"value":"Test message value"}`), DateCreated: dateCreated}
+	first.Hash = first.computeHash()
+	second := AuditEntry{Id: 2, Action: "delete", Entity: "message", EntityId: 22, Actor: "moderator", RequestId: "abc", Before: first.After, PrevHash: first.Hash, DateCreated: dateCreated.Add(time.Minute)}
+	second.Hash = second.computeHash()
+	return []AuditEntry{first, second}
+}
+
+func Test_ShouldAppendAuditEntryToChainWithinChange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT network, reason, expires_at, date_created FROM blocked_networks").
+		WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"network", "reason", "expires_at", "date_created"}).AddRow("10.20.0.0/16", "spam", nil, dateCreated))
+	mock.ExpectExec("DELETE FROM blocked_networks").WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1").
+		WillReturnRows(sqlmock.NewRows([]string{"hash"}).AddRow("previous"))
+	mock.ExpectQuery("INSERT INTO audit_log").
+		WithArgs("delete", "blocked_network", 4, "anonymous", "192.168.200.201", "",
+			`{"id":4,"network":"10.20.0.0/16","reason":"spam","expires_at":null,"date_created":"2017-06-25T14:22:12.296925Z"}`,
+			nil, "previous", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectCommit()
+
+	entry := AuditEntry{Action: "delete", Entity: "blocked_network", EntityId: 4, Actor: "anonymous", ClientIp: "192.168.200.201"}
+	network := BlockedNetwork{Id: 4}
+
+	err = network.DeleteBlockedNetwork(context.Background(), db, &entry)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 7, entry.Id, "Audit entry Id was not mapped as expected")
+	assert.Equal(t, "previous", entry.PrevHash, "Audit entry was not linked to the previous entry")
+	assert.Equal(t, entry.computeHash(), entry.Hash, "Audit entry hash was not set")
+}
+
+func Test_ShouldStartChainWhenAuditLogIsEmpty(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO blocked_networks").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(4, dateCreated))
+	mock.ExpectQuery("SELECT network, reason, expires_at, date_created FROM blocked_networks").
+		WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"network", "reason", "expires_at", "date_created"}).AddRow("10.20.0.0/16", "spam", nil, dateCreated))
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT hash FROM audit_log").WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+	mock.ExpectQuery("INSERT INTO audit_log").
+		WithArgs("create", "blocked_network", 4, "", "", "", nil,
+			`{"id":4,"network":"10.20.0.0/16","reason":"spam","expires_at":null,"date_created":"2017-06-25T14:22:12.296925Z"}`,
+			"", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	entry := AuditEntry{Action: "create", Entity: "blocked_network"}
+	network := BlockedNetwork{Network: "10.20.0.0/16", Reason: "spam"}
+
+	err = network.CreateBlockedNetwork(context.Background(), db, &entry)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 4, entry.EntityId, "Audit entry was not given the created entity's Id")
+	assert.Equal(t, "", entry.PrevHash, "First audit entry should not link to a previous entry")
+}
+
+func Test_ShouldRollBackChangeWhenAuditEntryCannotBeRecorded(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM webhooks").WithArgs(3).WillReturnRows(sqlmock.NewRows(webhookColumns))
+	mock.ExpectExec("DELETE FROM webhooks").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").WillReturnError(errors.New("permission denied for table audit_log"))
+	mock.ExpectRollback()
+
+	webhook := Webhook{Id: 3}
+
+	err = webhook.DeleteWebhook(context.Background(), db, &AuditEntry{Action: "delete", Entity: "webhook", EntityId: 3})
+	assert.EqualError(t, err, "permission denied for table audit_log", "Audit failure was not returned")
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err, "Change should be rolled back along with its audit entry")
+}
+
+func Test_ShouldVerifyIntactAuditLog(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	entries := chainedEntries()
+
+	mock.ExpectQuery("SELECT (.+) FROM audit_log WHERE id > \\$1 ORDER BY id LIMIT 1").
+		WithArgs(0).
+		WillReturnRows(auditRows(entries[0]))
+	mock.ExpectQuery("SELECT (.+) FROM audit_log WHERE id > \\$1 ORDER BY id LIMIT 1").
+		WithArgs(1).
+		WillReturnRows(auditRows(entries[1]))
+	mock.ExpectQuery("SELECT (.+) FROM audit_log WHERE id > \\$1 ORDER BY id LIMIT 1").
+		WithArgs(2).
+		WillReturnRows(auditRows())
+
+	checked, err := VerifyAuditLog(context.Background(), db, 1)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, checked, "Expected both entries to be checked")
+}
+
+func Test_ShouldDetectAlteredAuditEntry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	entries := chainedEntries()
+	entries[1].Actor = "someone else"
+
+	mock.ExpectQuery("SELECT (.+) FROM audit_log").WillReturnRows(auditRows(entries...))
+
+	checked, err := VerifyAuditLog(context.Background(), db, 10)
+
+	assert.Equal(t, &BrokenChainError{2}, err, "Altered entry was not detected")
+	assert.Equal(t, 1, checked, "Expected only the first entry to pass verification")
+}
+
+func Test_ShouldDetectRemovedAuditEntry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	entries := chainedEntries()
+
+	mock.ExpectQuery("SELECT (.+) FROM audit_log").WillReturnRows(auditRows(entries[1]))
+
+	_, err = VerifyAuditLog(context.Background(), db, 10)
+
+	assert.Equal(t, &BrokenChainError{2}, err, "Removed entry was not detected")
+}
+
+func Test_ShouldSearchAuditLogWithFilters(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	entries := chainedEntries()
+	from := entries[0].DateCreated
+
+	mock.ExpectQuery("SELECT COUNT\\(id\\) FROM audit_log WHERE \\(entity = \\$1 AND entity_id = \\$2 AND date_created >= \\$3\\)").
+		WithArgs("message", 22, from).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery("SELECT (.+) FROM audit_log WHERE (.+) ORDER BY id DESC LIMIT 10 OFFSET 0").
+		WithArgs("message", 22, from).
+		WillReturnRows(auditRows(entries[1], entries[0]))
+
+	page, err := SearchAuditLog(context.Background(), db, AuditFilter{Entity: "message", EntityId: 22, From: &from}, 0, 10)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, page.TotalCount, "Total count was not set correctly")
+	results := page.Results.([]AuditEntry)
+	assert.Equal(t, json.RawMessage(`{"id":22,"value":"Test message value"}`), results[0].Before, "Before snapshot was not mapped as expected")
+	assert.Nil(t, results[0].After, "After snapshot should be empty for a delete")
+}
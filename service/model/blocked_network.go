@@ -0,0 +1,105 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	sq "github.com/Masterminds/squirrel"
+	"time"
+)
+
+type BlockedNetwork struct {
+	Id          int        `json:"id"`
+	Network     string     `json:"network"`
+	Reason      string     `json:"reason"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	DateCreated time.Time  `json:"date_created"`
+}
+
+func (b *BlockedNetwork) GetBlockedNetwork(ctx context.Context, db *sql.DB) error {
+	return b.getBlockedNetwork(ctx, db)
+}
+
+func (b *BlockedNetwork) getBlockedNetwork(ctx context.Context, runner sq.BaseRunner) error {
+	return sq.Select("network", "reason", "expires_at", "date_created").
+		From("blocked_networks").
+		Where(sq.Eq{"id": &b.Id}).
+		RunWith(runner).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&b.Network, &b.Reason, &b.ExpiresAt, &b.DateCreated)
+}
+
+// CreateBlockedNetwork adds the entry, recording the audit entry in the same transaction when it is
+// not nil.
+func (b *BlockedNetwork) CreateBlockedNetwork(ctx context.Context, db *sql.DB, audit *AuditEntry) error {
+	return audited(ctx, db, audit, func(runner sq.BaseRunner) error {
+		err := sq.Insert("blocked_networks").
+			Columns("network", "reason", "expires_at").
+			Values(b.Network, b.Reason, b.ExpiresAt).
+			Suffix("RETURNING \"id\", \"date_created\"").
+			RunWith(runner).
+			PlaceholderFormat(sq.Dollar).
+			QueryRowContext(ctx).
+			Scan(&b.Id, &b.DateCreated)
+		if err != nil {
+			return err
+		}
+		return audit.snapshotAfter(ctx, runner, b.Id, blockedNetworkSnapshot)
+	})
+}
+
+// DeleteBlockedNetwork removes the entry, recording the audit entry in the same transaction when it
+// is not nil.
+func (b *BlockedNetwork) DeleteBlockedNetwork(ctx context.Context, db *sql.DB, audit *AuditEntry) error {
+	return audited(ctx, db, audit, func(runner sq.BaseRunner) error {
+		if err := audit.snapshotBefore(ctx, runner, b.Id, blockedNetworkSnapshot); err != nil {
+			return err
+		}
+
+		_, err := sq.Delete("blocked_networks").
+			Where(sq.Eq{"id": &b.Id}).
+			RunWith(runner).
+			PlaceholderFormat(sq.Dollar).
+			ExecContext(ctx)
+
+		return err
+	})
+}
+
+// GetBlockedNetworks returns every entry, including those that have expired.
+func GetBlockedNetworks(ctx context.Context, db *sql.DB) ([]BlockedNetwork, error) {
+	return queryBlockedNetworks(ctx, sq.Select("id", "network", "reason", "expires_at", "date_created").
+		From("blocked_networks").
+		OrderBy("id").
+		RunWith(db))
+}
+
+// GetActiveBlockedNetworks returns only the entries which have not yet expired.
+func GetActiveBlockedNetworks(ctx context.Context, db *sql.DB) ([]BlockedNetwork, error) {
+	return queryBlockedNetworks(ctx, sq.Select("id", "network", "reason", "expires_at", "date_created").
+		From("blocked_networks").
+		Where("expires_at IS NULL OR expires_at > NOW()").
+		OrderBy("id").
+		RunWith(db))
+}
+
+func queryBlockedNetworks(ctx context.Context, query sq.SelectBuilder) ([]BlockedNetwork, error) {
+	rows, err := query.PlaceholderFormat(sq.Dollar).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	networks := []BlockedNetwork{}
+
+	for rows.Next() {
+		var b BlockedNetwork
+		if err := rows.Scan(&b.Id, &b.Network, &b.Reason, &b.ExpiresAt, &b.DateCreated); err != nil {
+			return nil, err
+		}
+		networks = append(networks, b)
+	}
+
+	return networks, rows.Err()
+}
@@ -0,0 +1,72 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"time"
+)
+
+func Test_ShouldCreateNewBlockedNetwork(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, err := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+	expiresAt := dateCreated.Add(time.Hour)
+
+	mock.ExpectQuery("INSERT INTO blocked_networks").
+		WithArgs("10.20.0.0/16", "spam", &expiresAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(4, dateCreated))
+
+	network := BlockedNetwork{Network: "10.20.0.0/16", Reason: "spam", ExpiresAt: &expiresAt}
+
+	err = network.CreateBlockedNetwork(context.Background(), db, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 4, network.Id, "Blocked network Id was not mapped as expected")
+	assert.Equal(t, dateCreated, network.DateCreated, "Blocked network date created was not mapped as expected")
+}
+
+func Test_ShouldDeleteBlockedNetwork(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM blocked_networks").WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+	network := BlockedNetwork{Id: 4}
+
+	err = network.DeleteBlockedNetwork(context.Background(), db, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldRetrieveActiveBlockedNetworks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, err := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+	expiresAt := dateCreated.Add(time.Hour)
+
+	columns := []string{"id", "network", "reason", "expires_at", "date_created"}
+	mock.ExpectQuery("SELECT id, network, reason, expires_at, date_created FROM blocked_networks WHERE expires_at IS NULL OR expires_at > NOW()").
+		WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(1, "10.20.0.0/16", "spam", nil, dateCreated).
+		AddRow(2, "192.168.200.201/32", "", expiresAt, dateCreated))
+
+	networks, err := GetActiveBlockedNetworks(context.Background(), db)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, len(networks), "Expected two blocked networks to be returned")
+	assert.Equal(t, "10.20.0.0/16", networks[0].Network, "First network was not as expected")
+	assert.Nil(t, networks[0].ExpiresAt, "First network should not expire")
+	assert.Equal(t, expiresAt, *networks[1].ExpiresAt, "Second network expiry was not as expected")
+}
@@ -0,0 +1,346 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+)
+
+// ValueCipher encrypts message values at rest. Each encrypted row records the ID of the key its value
+// was encrypted with, along with blind index tokens used to filter by message content. Values only
+// open with the additional data they were sealed with.
+type ValueCipher interface {
+	ActiveKeyId() string
+	Seal(plaintext, additionalData []byte) ([]byte, error)
+	Open(ciphertext, additionalData []byte) ([]byte, error)
+	IndexTokens(value string) []string
+}
+
+// sealedColumn is a column holding encrypted values. Each value is sealed with its table, column and
+// row ID as additional data, so that a value copied to another row or column does not decrypt.
+type sealedColumn struct {
+	table  string
+	column string
+}
+
+var (
+	messageValue      = sealedColumn{"messages", "value"}
+	redactionOriginal = sealedColumn{"message_redactions", "original"}
+	webhookSecret     = sealedColumn{"webhooks", "secret"}
+	deliveryPayload   = sealedColumn{"webhook_deliveries", "payload"}
+	outboxPayload     = sealedColumn{"outbox", "payload"}
+)
+
+// row returns the additional data for the column's value in the row with the given ID.
+func (c sealedColumn) row(id int64) []byte {
+	return []byte(fmt.Sprintf("%s.%s:%d", c.table, c.column, id))
+}
+
+// nextId reserves the ID of a row about to be inserted, so that its value can be sealed for it.
+func (c sealedColumn) nextId(ctx context.Context, runner sq.BaseRunner) (int64, error) {
+	var id int64
+	err := sq.Select().
+		Column("nextval(pg_get_serial_sequence(?, 'id'))", c.table).
+		RunWith(runner).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&id)
+	return id, err
+}
+
+var (
+	ErrFilterTooShort     = errors.New("Message filter must be at least 3 characters when messages are encrypted")
+	ErrFilterTooBroad     = errors.New("Message filter matches too many messages when messages are encrypted, try a longer filter")
+	errEncryptionDisabled = errors.New("Message is encrypted but encryption is not configured")
+)
+
+func (s Storage) sealValue(value string, additionalData []byte) (string, error) {
+	sealed, err := s.Cipher.Seal([]byte(value), additionalData)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openValue returns the plain text of a stored value, which is only encrypted when it has a key ID.
+func (s Storage) openValue(value string, keyId sql.NullString, additionalData []byte) (string, error) {
+	if !keyId.Valid {
+		return value, nil
+	}
+	if s.Cipher == nil {
+		return "", errEncryptionDisabled
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := s.Cipher.Open(sealed, additionalData)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// RotateKeys re-encrypts every message which is not encrypted with the cipher's active key, including
+// any stored in plain text before encryption was enabled, returning the number of messages updated.
+// Messages are updated in batches, each within its own transaction.
+func RotateKeys(ctx context.Context, db *sql.DB, cipher ValueCipher, batchSize int) (int, error) {
+	if cipher == nil {
+		return 0, errEncryptionDisabled
+	}
+	return rotate(ctx, db, Storage{Cipher: cipher}, batchSize, rotateBatch)
+}
+
+// RotateRedactionKeys re-encrypts the original of every redaction which is not encrypted with the
+// cipher's active key, returning the number of redactions updated. Masked redactions have no original
+// and are left alone. Redactions are updated in batches, each within its own transaction.
+func RotateRedactionKeys(ctx context.Context, db *sql.DB, cipher ValueCipher, batchSize int) (int, error) {
+	if cipher == nil {
+		return 0, errEncryptionDisabled
+	}
+	return rotate(ctx, db, Storage{Cipher: cipher}, batchSize, rotateRedactionBatch)
+}
+
+// RotateWebhookKeys re-encrypts every webhook secret and delivery payload which is not encrypted with
+// the cipher's active key, including any stored in plain text before encryption was enabled, returning
+// the number of values updated. Values are updated in batches, each within its own transaction.
+func RotateWebhookKeys(ctx context.Context, db *sql.DB, cipher ValueCipher, batchSize int) (int, error) {
+	if cipher == nil {
+		return 0, errEncryptionDisabled
+	}
+	storage := Storage{Cipher: cipher}
+	secrets, err := rotate(ctx, db, storage, batchSize, rotateColumnBatch(webhookSecret, nil))
+	if err != nil {
+		return secrets, err
+	}
+	payloads, err := rotate(ctx, db, storage, batchSize, rotateColumnBatch(deliveryPayload, nil))
+	return secrets + payloads, err
+}
+
+// RotateOutboxKeys re-encrypts the payload of every outbox event which is not encrypted with the
+// cipher's active key, returning the number of events updated. Parked events could not be decrypted
+// and are left alone. Events are updated in batches, each within its own transaction.
+func RotateOutboxKeys(ctx context.Context, db *sql.DB, cipher ValueCipher, batchSize int) (int, error) {
+	if cipher == nil {
+		return 0, errEncryptionDisabled
+	}
+	return rotate(ctx, db, Storage{Cipher: cipher}, batchSize, rotateColumnBatch(outboxPayload, sq.Expr("date_parked IS NULL")))
+}
+
+func rotate(ctx context.Context, db *sql.DB, storage Storage, batchSize int, batch func(context.Context, *sql.DB, Storage, int) (int, error)) (int, error) {
+	total := 0
+	for {
+		rotated, err := batch(ctx, db, storage, batchSize)
+		total += rotated
+		if err != nil || rotated == 0 {
+			return total, err
+		}
+	}
+}
+
+func rotateBatch(ctx context.Context, db *sql.DB, storage Storage, batchSize int) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := sq.Select("id", "value", "key_id").
+		From("messages").
+		Where("key_id IS NULL OR key_id <> ?", storage.Cipher.ActiveKeyId()).
+		OrderBy("id").
+		Limit(uint64(batchSize)).
+		Suffix("FOR UPDATE SKIP LOCKED").
+		RunWith(tx).
+		PlaceholderFormat(sq.Dollar).
+		QueryContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	messages := []Message{}
+	for rows.Next() {
+		var m Message
+		var keyId sql.NullString
+		if err := rows.Scan(&m.Id, &m.Value, &keyId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if m.Value, err = storage.openValue(m.Value, keyId, messageValue.row(int64(m.Id))); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, m := range messages {
+		sealed, err := storage.sealValue(m.Value, messageValue.row(int64(m.Id)))
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = sq.Update("messages").
+			Set("value", sealed).
+			Set("key_id", storage.Cipher.ActiveKeyId()).
+			Set("value_tokens", pq.Array(storage.Cipher.IndexTokens(m.Value))).
+			Where(sq.Eq{"id": m.Id}).
+			RunWith(tx).
+			PlaceholderFormat(sq.Dollar).
+			ExecContext(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(messages), tx.Commit()
+}
+
+// rotateColumnBatch returns a function re-encrypting a batch of the column's values, in the rows
+// matching the condition when it is not nil.
+func rotateColumnBatch(column sealedColumn, condition sq.Sqlizer) func(context.Context, *sql.DB, Storage, int) (int, error) {
+	return func(ctx context.Context, db *sql.DB, storage Storage, batchSize int) (int, error) {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+
+		query := sq.Select("id", column.column, "key_id").
+			From(column.table).
+			Where("(key_id IS NULL OR key_id <> ?)", storage.Cipher.ActiveKeyId())
+		if condition != nil {
+			query = query.Where(condition)
+		}
+		rows, err := query.
+			OrderBy("id").
+			Limit(uint64(batchSize)).
+			Suffix("FOR UPDATE SKIP LOCKED").
+			RunWith(tx).
+			PlaceholderFormat(sq.Dollar).
+			QueryContext(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		type sealedRow struct {
+			id    int64
+			value string
+		}
+
+		values := []sealedRow{}
+		for rows.Next() {
+			var r sealedRow
+			var keyId sql.NullString
+			if err := rows.Scan(&r.id, &r.value, &keyId); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			if r.value, err = storage.openValue(r.value, keyId, column.row(r.id)); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			values = append(values, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+
+		for _, r := range values {
+			sealed, err := storage.sealValue(r.value, column.row(r.id))
+			if err != nil {
+				return 0, err
+			}
+
+			_, err = sq.Update(column.table).
+				Set(column.column, sealed).
+				Set("key_id", storage.Cipher.ActiveKeyId()).
+				Where(sq.Eq{"id": r.id}).
+				RunWith(tx).
+				PlaceholderFormat(sq.Dollar).
+				ExecContext(ctx)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		return len(values), tx.Commit()
+	}
+}
+
+// rotateRedactionBatch re-encrypts a batch of redaction originals. Originals stored before their key
+// was recorded have no key ID, and are re-encrypted so that it is.
+func rotateRedactionBatch(ctx context.Context, db *sql.DB, storage Storage, batchSize int) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := sq.Select("id", "original").
+		From("message_redactions").
+		Where("original IS NOT NULL AND (key_id IS NULL OR key_id <> ?)", storage.Cipher.ActiveKeyId()).
+		OrderBy("id").
+		Limit(uint64(batchSize)).
+		Suffix("FOR UPDATE SKIP LOCKED").
+		RunWith(tx).
+		PlaceholderFormat(sq.Dollar).
+		QueryContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	type sealedRedaction struct {
+		id       int
+		original []byte
+	}
+
+	redactions := []sealedRedaction{}
+	for rows.Next() {
+		var r sealedRedaction
+		if err := rows.Scan(&r.id, &r.original); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		redactions = append(redactions, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, r := range redactions {
+		additionalData := redactionOriginal.row(int64(r.id))
+		original, err := storage.Cipher.Open(r.original, additionalData)
+		if err != nil {
+			return 0, err
+		}
+		sealed, err := storage.Cipher.Seal(original, additionalData)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = sq.Update("message_redactions").
+			Set("original", sealed).
+			Set("key_id", storage.Cipher.ActiveKeyId()).
+			Where(sq.Eq{"id": r.id}).
+			RunWith(tx).
+			PlaceholderFormat(sq.Dollar).
+			ExecContext(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(redactions), tx.Commit()
+}
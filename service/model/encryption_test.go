@@ -0,0 +1,424 @@
+package model
+
+import (
+	"testing"
+	"context"
+	"amigo-tech-test/util"
+	"database/sql/driver"
+	"encoding/base64"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"time"
+)
+
+func newTestKeyring(t *testing.T, active string) *util.Keyring {
+	keys := map[string][]byte{"old": make([]byte, 32), "new": make([]byte, 32)}
+	keys["new"][0] = 1
+	keyring, err := util.NewKeyring(active, keys, make([]byte, 32))
+	assert.Nil(t, err)
+	return keyring
+}
+
+func sealTestValue(t *testing.T, keyring *util.Keyring, value string, additionalData []byte) string {
+	sealed, err := keyring.Seal([]byte(value), additionalData)
+	assert.Nil(t, err)
+	return base64.StdEncoding.EncodeToString(sealed)
+}
+
+// sealedValue matches an argument which decrypts to the expected value with the expected additional
+// data.
+type sealedValue struct {
+	keyring        *util.Keyring
+	value          string
+	additionalData []byte
+}
+
+func (s sealedValue) Match(v driver.Value) bool {
+	encoded, ok := v.(string)
+	if !ok {
+		return false
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	plaintext, err := s.keyring.Open(sealed, s.additionalData)
+	return err == nil && string(plaintext) == s.value
+}
+
+// expectNextId expects the ID of a row to be reserved before its value is encrypted.
+func expectNextId(mock sqlmock.Sqlmock, table string, id int64) {
+	mock.ExpectQuery("SELECT nextval\\(pg_get_serial_sequence\\(\\$1, 'id'\\)\\)").
+		WithArgs(table).
+		WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(id))
+}
+
+func Test_ShouldEncryptMessageValueWhenCreatingMessage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	keyring := newTestKeyring(t, "new")
+	storage := Storage{Cipher: keyring}
+
+	tokens, _ := pq.Array(keyring.IndexTokens("Test message value")).Value()
+	expectNextId(mock, "messages", 22)
+	mock.ExpectQuery("INSERT INTO messages \\(value,ip_address,moderation_status,moderation_reason,id,key_id,value_tokens\\)").
+		WithArgs(sealedValue{keyring, "Test message value", messageValue.row(22)}, "192.168.200.201", "approved", "", 22, "new", tokens).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(22))
+
+	message := Message{Value: "Test message value", IpAddress: "192.168.200.201"}
+
+	err = message.CreateMessage(context.Background(), db, storage, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldDecryptMessageValueWhenRetrievingMessage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	keyring := newTestKeyring(t, "new")
+	storage := Storage{Cipher: keyring}
+
+	columns := []string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(sealTestValue(t, keyring, "Test message value", messageValue.row(123)), "192.168.200.201", time.Now(), "approved", "new", 1))
+
+	message := Message{Id: 123}
+
+	err = message.GetMessage(context.Background(), db, storage)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "Test message value", message.Value, "Message value was not decrypted as expected")
+}
+
+func Test_ShouldFailToRetrieveEncryptedMessageWithoutEncryptionConfigured(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	columns := []string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("c2VhbGVk", "192.168.200.201", time.Now(), "approved", "new", 1))
+
+	message := Message{Id: 123}
+
+	err = message.GetMessage(context.Background(), db, Storage{})
+	assert.Equal(t, errEncryptionDisabled, err)
+}
+
+func Test_ShouldSearchEncryptedMessagesUsingBlindIndex(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	keyring := newTestKeyring(t, "new")
+	storage := Storage{Cipher: keyring}
+
+	tokens, _ := pq.Array(keyring.IndexTokens("message")).Value()
+	columns := []string{"id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages WHERE (.+) AND TEXT\\(ip_address\\) LIKE \\$1 AND value_tokens @> \\$2 ORDER BY id").
+		WithArgs("192.168%", tokens).
+		WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(1, sealTestValue(t, keyring, "Test message 1", messageValue.row(1)), "192.168.200.201", time.Now(), "approved", "new", 1).
+		AddRow(2, sealTestValue(t, keyring, "A sage mess", messageValue.row(2)), "192.168.200.201", time.Now(), "approved", "old", 1).
+		AddRow(3, sealTestValue(t, keyring, "Test message 3", messageValue.row(3)), "192.168.200.201", time.Now(), "approved", "new", 1).
+		AddRow(4, sealTestValue(t, keyring, "Test message 4", messageValue.row(4)), "192.168.200.201", time.Now(), "approved", "new", 1))
+
+	page, err := Search(context.Background(), db, storage, 1, 1, "message", "192.168")
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 3, page.TotalCount, "Rows without the exact substring should not be counted")
+	messages := page.Results.([]Message)
+	assert.Equal(t, 1, len(messages), "Expected one message to be returned")
+	assert.Equal(t, 3, messages[0].Id, "Page was not taken from the matching messages")
+	assert.Equal(t, "Test message 3", messages[0].Value, "Message value was not decrypted as expected")
+}
+
+func Test_ShouldFailToSearchEncryptedMessagesWithShortFilter(t *testing.T) {
+	db, _, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	storage := Storage{Cipher: newTestKeyring(t, "new")}
+
+	_, err = Search(context.Background(), db, storage, 0, 10, "ab", "")
+	assert.Equal(t, ErrFilterTooShort, err)
+}
+
+func Test_ShouldRotateKeysInBatches(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	keyring := newTestKeyring(t, "new")
+
+	tokens, _ := pq.Array(keyring.IndexTokens("plain text")).Value()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, value, key_id FROM messages WHERE key_id IS NULL OR key_id <> \\$1 ORDER BY id LIMIT 2 FOR UPDATE SKIP LOCKED").
+		WithArgs("new").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "value", "key_id"}).
+		AddRow(1, "plain text", nil).
+		AddRow(2, sealTestValue(t, keyring, "old secret", messageValue.row(2)), "old"))
+	mock.ExpectExec("UPDATE messages SET value = \\$1, key_id = \\$2, value_tokens = \\$3 WHERE id = \\$4").
+		WithArgs(sealedValue{keyring, "plain text", messageValue.row(1)}, "new", tokens, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE messages").
+		WithArgs(sealedValue{keyring, "old secret", messageValue.row(2)}, "new", sqlmock.AnyArg(), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, value, key_id FROM messages").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "value", "key_id"}))
+	mock.ExpectCommit()
+
+	rotated, err := RotateKeys(context.Background(), db, keyring, 2)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, rotated, "Expected two messages to be rotated")
+}
+
+// candidateRows returns n stored messages with consecutive IDs and delivery sequence numbers starting
+// at first, each holding value in plain text.
+func candidateRows(first, n int, value string) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"})
+	for id := first; id < first+n; id++ {
+		rows.AddRow(id, value, "192.168.200.201", time.Now(), "approved", nil, id)
+	}
+	return rows
+}
+
+func Test_ShouldSearchEncryptedMessagesInBatches(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	storage := Storage{Cipher: newTestKeyring(t, "new")}
+
+	mock.ExpectQuery("SELECT (.+) FROM messages WHERE (.+) AND value_tokens @> \\$1 ORDER BY id LIMIT 500").
+		WillReturnRows(candidateRows(1, encryptedBatchSize, "Test message"))
+	mock.ExpectQuery("SELECT (.+) FROM messages WHERE (.+) AND value_tokens @> \\$1 AND id > \\$2 ORDER BY id LIMIT 500").
+		WithArgs(sqlmock.AnyArg(), encryptedBatchSize).
+		WillReturnRows(candidateRows(encryptedBatchSize+1, 2, "Test message"))
+
+	page, err := Search(context.Background(), db, storage, 500, 10, "message", "")
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 502, page.TotalCount, "Matches from every batch should be counted")
+	messages := page.Results.([]Message)
+	assert.Equal(t, 2, len(messages), "Expected the page to be taken from the second batch")
+	assert.Equal(t, 501, messages[0].Id, "Page was not taken from the matching messages")
+}
+
+func Test_ShouldRejectEncryptedFilterMatchingTooManyCandidates(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	storage := Storage{Cipher: newTestKeyring(t, "new")}
+
+	for first := 1; first < maxEncryptedCandidates; first += encryptedBatchSize {
+		mock.ExpectQuery("SELECT (.+) FROM messages").
+			WillReturnRows(candidateRows(first, encryptedBatchSize, "Test message"))
+	}
+
+	_, err = MessagesAfter(context.Background(), db, storage, 0, maxEncryptedCandidates+1, "message", "")
+	assert.Equal(t, ErrFilterTooBroad, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err, "No more than the maximum number of candidates should be read")
+}
+
+func Test_ShouldStopReadingEncryptedCandidatesOnceLimitIsReached(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	storage := Storage{Cipher: newTestKeyring(t, "new")}
+
+	mock.ExpectQuery("SELECT (.+) FROM messages WHERE (.+) AND delivery_seq > \\$1 AND value_tokens @> \\$2 ORDER BY delivery_seq LIMIT 500").
+		WithArgs(int64(10), sqlmock.AnyArg()).
+		WillReturnRows(candidateRows(11, encryptedBatchSize, "Test message"))
+
+	messages, err := MessagesAfter(context.Background(), db, storage, 10, 3, "message", "")
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 3, len(messages), "Expected the limit to be applied to the matches")
+	assert.Equal(t, 13, messages[2].Id, "Messages should be returned in the order they were delivered")
+}
+
+func Test_ShouldEncryptRedactionOriginalsForTheirRow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	keyring := newTestKeyring(t, "new")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO messages").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(22))
+	expectNextId(mock, "message_redactions", 5)
+	mock.ExpectQuery("INSERT INTO message_redactions \\(message_id,kind,id,original,key_id\\)").
+		WithArgs(22, "email", 5, sealedOriginal{keyring, "jo@example.com", redactionOriginal.row(5)}, "new").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(5, time.Now()))
+	mock.ExpectCommit()
+
+	message := Message{Value: "Contact [redacted email]", Redactions: []Redaction{{Kind: "email", Original: "jo@example.com"}}}
+
+	err = message.CreateMessage(context.Background(), db, Storage{Originals: keyring}, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldRotateRedactionOriginals(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	keyring := newTestKeyring(t, "new")
+	original, err := newTestKeyring(t, "old").Seal([]byte("jo@example.com"), redactionOriginal.row(4))
+	assert.Nil(t, err)
+
+	// Only originals encrypted with the new key can be opened once the old key is dropped
+	newKey := make([]byte, 32)
+	newKey[0] = 1
+	newOnly, err := util.NewKeyring("new", map[string][]byte{"new": newKey}, make([]byte, 32))
+	assert.Nil(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, original FROM message_redactions WHERE original IS NOT NULL AND \\(key_id IS NULL OR key_id <> \\$1\\) ORDER BY id LIMIT 10 FOR UPDATE SKIP LOCKED").
+		WithArgs("new").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "original"}).AddRow(4, original))
+	mock.ExpectExec("UPDATE message_redactions SET original = \\$1, key_id = \\$2 WHERE id = \\$3").
+		WithArgs(sealedOriginal{newOnly, "jo@example.com", redactionOriginal.row(4)}, "new", 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, original FROM message_redactions").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "original"}))
+	mock.ExpectCommit()
+
+	rotated, err := RotateRedactionKeys(context.Background(), db, keyring, 10)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, rotated, "Expected one redaction to be rotated")
+}
+
+// sealedOriginal matches a redaction original which decrypts to the expected value with the expected
+// additional data.
+type sealedOriginal struct {
+	keyring        *util.Keyring
+	value          string
+	additionalData []byte
+}
+
+func (s sealedOriginal) Match(v driver.Value) bool {
+	sealed, ok := v.([]byte)
+	if !ok {
+		return false
+	}
+	plaintext, err := s.keyring.Open(sealed, s.additionalData)
+	return err == nil && string(plaintext) == s.value
+}
+
+func Test_ShouldNotDecryptValueCopiedFromAnotherRow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	keyring := newTestKeyring(t, "new")
+
+	columns := []string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(sealTestValue(t, keyring, "Someone else's message", messageValue.row(124)), "192.168.200.201", time.Now(), "approved", "new", 1))
+
+	message := Message{Id: 123}
+
+	err = message.GetMessage(context.Background(), db, Storage{Cipher: keyring})
+	assert.NotNil(t, err, "A value sealed for another row should not decrypt")
+}
+
+func Test_ShouldRotateWebhookSecretsAndDeliveries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	keyring := newTestKeyring(t, "new")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, secret, key_id FROM webhooks WHERE \\(key_id IS NULL OR key_id <> \\$1\\) ORDER BY id LIMIT 10 FOR UPDATE SKIP LOCKED").
+		WithArgs("new").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "secret", "key_id"}).AddRow(3, "shh", nil))
+	mock.ExpectExec("UPDATE webhooks SET secret = \\$1, key_id = \\$2 WHERE id = \\$3").
+		WithArgs(sealedValue{keyring, "shh", webhookSecret.row(3)}, "new", 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, secret, key_id FROM webhooks").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "secret", "key_id"}))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, payload, key_id FROM webhook_deliveries WHERE \\(key_id IS NULL OR key_id <> \\$1\\) ORDER BY id LIMIT 10 FOR UPDATE SKIP LOCKED").
+		WithArgs("new").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "key_id"}).AddRow(7, sealTestValue(t, newTestKeyring(t, "old"), `{"event":"deleted"}`, deliveryPayload.row(7)), "old"))
+	mock.ExpectExec("UPDATE webhook_deliveries SET payload = \\$1, key_id = \\$2 WHERE id = \\$3").
+		WithArgs(sealedValue{keyring, `{"event":"deleted"}`, deliveryPayload.row(7)}, "new", 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, payload, key_id FROM webhook_deliveries").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "key_id"}))
+	mock.ExpectCommit()
+
+	rotated, err := RotateWebhookKeys(context.Background(), db, keyring, 10)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, rotated, "Expected a secret and a delivery to be rotated")
+}
+
+func Test_ShouldRotateOutboxEventsWhichAreNotParked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	keyring := newTestKeyring(t, "new")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, payload, key_id FROM outbox WHERE \\(key_id IS NULL OR key_id <> \\$1\\) AND date_parked IS NULL ORDER BY id LIMIT 10 FOR UPDATE SKIP LOCKED").
+		WithArgs("new").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "key_id"}).AddRow(5, `{"event":"deleted"}`, nil))
+	mock.ExpectExec("UPDATE outbox SET payload = \\$1, key_id = \\$2 WHERE id = \\$3").
+		WithArgs(sealedValue{keyring, `{"event":"deleted"}`, outboxPayload.row(5)}, "new", 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, payload, key_id FROM outbox").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "key_id"}))
+	mock.ExpectCommit()
+
+	rotated, err := RotateOutboxKeys(context.Background(), db, keyring, 10)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, rotated, "Expected one event to be rotated")
+}
@@ -1,9 +1,13 @@
 package model
 
 import (
+	"amigo-tech-test/service/moderation"
+	"context"
 	"database/sql"
 	sq "github.com/Masterminds/squirrel"
 	"fmt"
+	"github.com/lib/pq"
+	"strings"
 	"time"
 )
 
@@ -11,45 +15,340 @@ type Message struct {
 	Id    int	 `json:"id"`
 	Value string `json:"value"`
 	IpAddress string `json:"ip_address"`
-	DateCreated time.Time `json:"date_created""`
+	DateCreated time.Time `json:"date_created"`
+	Status string `json:"status"`
+	ModerationReason string `json:"moderation_reason,omitempty"`
+	Queue string `json:"queue,omitempty"`
+	DeliverAt *time.Time `json:"deliver_at,omitempty"`
+	Owner string `json:"-"`
+	DeliverySeq int64 `json:"-"`
+	Redactions []Redaction `json:"-"`
 }
 
-func (m *Message) GetMessage(db *sql.DB) error {
-	return sq.Select("value", "ip_address", "date_created").
+const (
+	// encryptedBatchSize is how many candidates are read at a time when filtering encrypted messages.
+	encryptedBatchSize = 500
+	// maxEncryptedCandidates is how many candidates one filter of encrypted messages may decrypt.
+	maxEncryptedCandidates = 10000
+)
+
+// deliverySeq numbers messages in the order they become visible, so that streams can resume after
+// the last message they were sent even when it was held back by moderation or scheduled delivery.
+const deliverySeq = "nextval('messages_delivery_seq')"
+
+// Flagged messages remain visible while they wait for a moderator; quarantined and rejected ones do not.
+// Scheduled messages are hidden until they are due, whether or not the scheduler has delivered them
+// yet. Delivered messages are the ready ones whose created event has been recorded, which for a
+// scheduled message happens when the scheduler delivers it. Ready messages in a queue are only seen
+// by the consumers claiming them, so are never visible to readers.
+var (
+	readyMessages = fmt.Sprintf("moderation_status IN ('%s', '%s') AND (NOT scheduled OR deliver_at <= NOW() AT TIME ZONE 'UTC')", moderation.StatusApproved, moderation.StatusFlagged)
+	deliveredMessages = fmt.Sprintf("moderation_status IN ('%s', '%s') AND NOT scheduled", moderation.StatusApproved, moderation.StatusFlagged)
+	visibleMessages = readyMessages + " AND queue IS NULL"
+	awaitingModeration = fmt.Sprintf("moderation_status IN ('%s', '%s')", moderation.StatusFlagged, moderation.StatusQuarantined)
+)
+
+func (m *Message) GetMessage(ctx context.Context, db *sql.DB, storage Storage) error {
+	return m.getMessage(ctx, db, storage, visibleMessages)
+}
+
+// getMessage loads the message if it matches the condition, such as being visible.
+func (m *Message) getMessage(ctx context.Context, runner sq.BaseRunner, storage Storage, condition string) error {
+	var keyId sql.NullString
+	err := sq.Select("value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq").
 		From("messages").
 		Where(sq.Eq{"id": &m.Id}).
-		RunWith(db).
+		Where(condition).
+		RunWith(runner).
 		PlaceholderFormat(sq.Dollar).
-		QueryRow().
-		Scan(&m.Value, &m.IpAddress, &m.DateCreated)
+		QueryRowContext(ctx).
+		Scan(&m.Value, &m.IpAddress, &m.DateCreated, &m.Status, &keyId, &m.DeliverySeq)
+	if err != nil {
+		return err
+	}
+
+	m.Value, err = storage.openValue(m.Value, keyId, messageValue.row(int64(m.Id)))
+	return err
+}
+
+// DeleteMessage deletes the message, reporting whether it was visible, and so whether its deletion
+// is an event. The event is recorded for the outbox and webhooks, and the audit entry when it is not
+// nil, within the same transaction.
+func (m *Message) DeleteMessage(ctx context.Context, db *sql.DB, storage Storage, audit *AuditEntry) (bool, error) {
+	if !storage.recordsEvents() && audit == nil {
+		visible, err := m.deleteMessage(ctx, db)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return visible, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	if err := audit.snapshotBefore(ctx, tx, m.Id, messageSnapshot); err != nil {
+		return false, err
+	}
+
+	visible, err := m.deleteMessage(ctx, tx)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if storage.recordsEvents() && visible {
+		if err := recordEvent(ctx, tx, storage, EventDeleted, m); err != nil {
+			return false, err
+		}
+	}
+	if err := audit.appendTo(ctx, tx); err != nil {
+		return false, err
+	}
+	return visible, tx.Commit()
 }
 
-func (m *Message) DeleteMessage(db *sql.DB) error {
-	_, err:= sq.Delete("messages").
+// deleteMessage deletes the message, returning sql.ErrNoRows if there is no such message. Messages
+// waiting for moderation were never visible, and scheduled ones not yet delivered have had no created
+// event, so their deletion is not an event.
+// Messages in a queue are left to their consumers, and are only removed by being acknowledged.
+func (m *Message) deleteMessage(ctx context.Context, runner sq.BaseRunner) (bool, error) {
+	// The IP address and owner are kept with the event, so that it can be published in order with the
+	// others for the same address or owner
+	var owner sql.NullString
+	var scheduled bool
+	err := sq.Delete("messages").
 		Where(sq.Eq{"id": &m.Id}).
-		RunWith(db).
+		Where("queue IS NULL").
+		Suffix("RETURNING ip_address, owner, moderation_status, scheduled").
+		RunWith(runner).
 		PlaceholderFormat(sq.Dollar).
-		Exec()
+		QueryRowContext(ctx).
+		Scan(&m.IpAddress, &owner, &m.Status, &scheduled)
+	m.Owner = owner.String
+	return m.visible() && !scheduled, err
+}
 
-	return err
+// CreateMessage inserts the message along with any redactions applied to it, within a single
+// transaction when there are redactions, an event or an audit entry to record.
+func (m *Message) CreateMessage(ctx context.Context, db *sql.DB, storage Storage, audit *AuditEntry) error {
+	if m.Status == "" {
+		m.Status = moderation.StatusApproved
+	}
+
+	if len(m.Redactions) == 0 && !storage.recordsEvents() && audit == nil {
+		return m.insertMessage(ctx, db, storage)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := m.insertMessage(ctx, tx, storage); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for i := range m.Redactions {
+		m.Redactions[i].MessageId = m.Id
+		if err := m.Redactions[i].createRedaction(ctx, tx, storage); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// Scheduled messages are recorded as created once they are delivered
+	if storage.recordsEvents() && m.visible() && m.DeliverAt == nil {
+		if err := recordEvent(ctx, tx, storage, EventCreated, m); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := audit.snapshotAfter(ctx, tx, m.Id, messageSnapshot); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := audit.appendTo(ctx, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (m *Message) CreateMessage(db *sql.DB) error {
+func (m *Message) insertMessage(ctx context.Context, runner sq.BaseRunner, storage Storage) error {
+	columns := []string{"value", "ip_address", "moderation_status", "moderation_reason"}
+	values := []interface{}{m.Value, m.IpAddress, m.Status, m.ModerationReason}
+
+	if storage.Cipher != nil {
+		id, err := messageValue.nextId(ctx, runner)
+		if err != nil {
+			return err
+		}
+		sealed, err := storage.sealValue(m.Value, messageValue.row(id))
+		if err != nil {
+			return err
+		}
+		values[0] = sealed
+		columns = append(columns, "id", "key_id", "value_tokens")
+		values = append(values, id, storage.Cipher.ActiveKeyId(), pq.Array(storage.Cipher.IndexTokens(m.Value)))
+	}
+
+	if m.Queue != "" {
+		columns = append(columns, "queue")
+		values = append(values, m.Queue)
+	}
+
+	if m.Owner != "" {
+		columns = append(columns, "owner")
+		values = append(values, m.Owner)
+	}
+
+	if m.DeliverAt != nil {
+		columns = append(columns, "deliver_at", "scheduled")
+		values = append(values, *m.DeliverAt, true)
+	}
+
+	// The creation date is only needed for the event recorded
+	returning, dest := "RETURNING \"id\"", []interface{}{&m.Id}
+	if storage.recordsEvents() {
+		returning, dest = "RETURNING \"id\", \"date_created\"", append(dest, &m.DateCreated)
+	}
+
 	return sq.Insert("messages").
-		Columns("value", "ip_address").
-		Values(m.Value, m.IpAddress).
-		Suffix("RETURNING \"id\"").
-		RunWith(db).
+		Columns(columns...).
+		Values(values...).
+		Suffix(returning).
+		RunWith(runner).
 		PlaceholderFormat(sq.Dollar).
-		QueryRow().
-		Scan(&m.Id)
+		QueryRowContext(ctx).
+		Scan(dest...)
 }
 
-func Search(db *sql.DB, offset, limit int, message, ipAddress string) (*Page, error) {
-	pageQuery := sq.Select("id", "value", "ip_address", "date_created").From("messages").RunWith(db)
-	countQuery := sq.Select("COUNT(id)").From("messages").RunWith(db)
+// UpdateModerationStatus records a moderator's decision on a flagged or quarantined message,
+// returning sql.ErrNoRows if the message is not awaiting moderation. It also returns the event the
+// decision is seen as, which is empty when it is not seen at all. The event is recorded for the
+// outbox and webhooks, and the audit entry when it is not nil, in the same transaction.
+func (m *Message) UpdateModerationStatus(ctx context.Context, db *sql.DB, storage Storage, status string, audit *AuditEntry) (string, error) {
+	if !storage.recordsEvents() && audit == nil {
+		previous, err := m.updateModerationStatus(ctx, db, status)
+		if err != nil {
+			return "", err
+		}
+		return moderationEvent(previous, status), nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	defer tx.Rollback()
 
-	if message != "" {
+	if err := audit.snapshotBefore(ctx, tx, m.Id, messageSnapshot); err != nil {
+		return "", err
+	}
+
+	previous, err := m.updateModerationStatus(ctx, tx, status)
+	if err != nil {
+		return "", err
+	}
+
+	event := moderationEvent(previous, status)
+	if storage.recordsEvents() && event != "" {
+		if err := m.recordModerationEvent(ctx, tx, storage, event); err != nil {
+			return "", err
+		}
+	}
+
+	if err := audit.snapshotAfter(ctx, tx, m.Id, messageSnapshot); err != nil {
+		return "", err
+	}
+	if err := audit.appendTo(ctx, tx); err != nil {
+		return "", err
+	}
+	return event, tx.Commit()
+}
+
+// moderationEvent returns the event a moderator's decision is seen as, or an empty string if it is
+// not seen at all. Quarantined messages were never visible, so approving one creates it and
+// rejecting one is not an event, while rejecting a flagged message deletes it.
+func moderationEvent(previous, status string) string {
+	switch {
+	case previous == moderation.StatusQuarantined && status == moderation.StatusApproved:
+		return EventCreated
+	case previous == moderation.StatusQuarantined:
+		return ""
+	case status == moderation.StatusRejected:
+		return EventDeleted
+	}
+	return EventUpdated
+}
+
+// recordModerationEvent records the event a moderator's decision is seen as.
+func (m *Message) recordModerationEvent(ctx context.Context, tx *sql.Tx, storage Storage, event string) error {
+	if event == EventDeleted {
+		return recordEvent(ctx, tx, storage, EventDeleted, m)
+	}
+
+	// Messages still scheduled for delivery are recorded as created once they are delivered
+	updated := Message{Id: m.Id, Owner: m.Owner}
+	if err := updated.getMessage(ctx, tx, storage, deliveredMessages); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return recordEvent(ctx, tx, storage, event, &updated)
+}
+
+// updateModerationStatus records the decision, returning the status the message had before it. The
+// message's IP address and owner are loaded for the event the decision is seen as. Approving a
+// quarantined message delivers it, so it is given the next delivery sequence number.
+func (m *Message) updateModerationStatus(ctx context.Context, runner sq.BaseRunner, status string) (string, error) {
+	awaiting := sq.Select("id", "moderation_status").
+		From("messages").
+		Where(sq.Eq{"id": &m.Id}).
+		Where(awaitingModeration).
+		Suffix("FOR UPDATE")
+
+	update := sq.Update("messages").Set("moderation_status", status)
+	if status == moderation.StatusApproved {
+		update = update.Set("delivery_seq", sq.Expr(fmt.Sprintf("CASE WHEN previous.moderation_status = ? THEN %s ELSE messages.delivery_seq END", deliverySeq), moderation.StatusQuarantined))
+	}
+
+	var previous string
+	var owner sql.NullString
+	err := update.
+		FromSelect(awaiting, "previous").
+		Where("messages.id = previous.id").
+		Suffix("RETURNING previous.moderation_status, messages.ip_address, messages.owner").
+		RunWith(runner).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&previous, &m.IpAddress, &owner)
+	if err != nil {
+		return "", err
+	}
+
+	m.Status = status
+	m.Owner = owner.String
+	return previous, nil
+}
+
+// Search retrieves a page of visible messages, optionally filtered by content and IP address. When
+// messages are encrypted the content filter is matched using blind index tokens, and the decrypted
+// candidates are checked for the exact substring before the page is taken.
+func Search(ctx context.Context, db *sql.DB, storage Storage, offset, limit int, message, ipAddress string) (*Page, error) {
+	pageQuery := sq.Select("id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq").From("messages").Where(visibleMessages).RunWith(db)
+	countQuery := sq.Select("COUNT(id)").From("messages").Where(visibleMessages).RunWith(db)
+
+	if message != "" && storage.Cipher == nil {
 		addWhereCondition("value LIKE ?", fmt.Sprint("%", message, "%"), &pageQuery, &countQuery)
 	}
 
@@ -57,14 +356,18 @@ func Search(db *sql.DB, offset, limit int, message, ipAddress string) (*Page, er
 		addWhereCondition("TEXT(ip_address) LIKE ?", fmt.Sprint(ipAddress, "%"), &pageQuery, &countQuery)
 	}
 
+	if message != "" && storage.Cipher != nil {
+		return searchEncrypted(ctx, storage, pageQuery, offset, limit, message)
+	}
+
 	var totalCount int
-	countQuery.PlaceholderFormat(sq.Dollar).QueryRow().Scan(&totalCount)
+	countQuery.PlaceholderFormat(sq.Dollar).QueryRowContext(ctx).Scan(&totalCount)
 
 	rows, err :=  pageQuery.
 		PlaceholderFormat(sq.Dollar).
 		Limit(uint64(limit)).
 		Offset(uint64(offset)).
-		Query()
+		QueryContext(ctx)
 
 	if err != nil {
 		return nil, err
@@ -76,7 +379,219 @@ func Search(db *sql.DB, offset, limit int, message, ipAddress string) (*Page, er
 
 	for rows.Next() {
 		var m Message
-		if err := rows.Scan(&m.Id, &m.Value, &m.IpAddress, &m.DateCreated); err != nil {
+		var keyId sql.NullString
+		if err := rows.Scan(&m.Id, &m.Value, &m.IpAddress, &m.DateCreated, &m.Status, &keyId, &m.DeliverySeq); err != nil {
+			return nil, err
+		}
+		if m.Value, err = storage.openValue(m.Value, keyId, messageValue.row(int64(m.Id))); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return &Page{offset, limit, totalCount, messages}, nil
+}
+
+func searchEncrypted(ctx context.Context, storage Storage, query sq.SelectBuilder, offset, limit int, message string) (*Page, error) {
+	messages := []Message{}
+	matched := 0
+
+	err := scanEncrypted(ctx, storage, query, byId, message, func(m Message) bool {
+		if matched >= offset && matched < offset+limit {
+			messages = append(messages, m)
+		}
+		matched++
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Page{offset, limit, matched, messages}, nil
+}
+
+// messageCursor is a column messages are read in the order of, in batches which each start after the
+// last message of the one before.
+type messageCursor struct {
+	column string
+	of     func(m *Message) int64
+}
+
+var (
+	byId       = messageCursor{"id", func(m *Message) int64 { return int64(m.Id) }}
+	byDelivery = messageCursor{"delivery_seq", func(m *Message) int64 { return m.DeliverySeq }}
+)
+
+// scanEncrypted passes each candidate matching the query whose decrypted value contains the message
+// to match, in the order of the cursor, until match returns false. Candidates are found using blind
+// index tokens and read in batches, and ErrFilterTooBroad is returned rather than read more than
+// maxEncryptedCandidates of them.
+func scanEncrypted(ctx context.Context, storage Storage, query sq.SelectBuilder, cursor messageCursor, message string, match func(Message) bool) error {
+	tokens := storage.Cipher.IndexTokens(message)
+	if len(tokens) == 0 {
+		return ErrFilterTooShort
+	}
+
+	query = query.
+		Where("value_tokens @> ?", pq.Array(tokens)).
+		OrderBy(cursor.column).
+		Limit(encryptedBatchSize).
+		PlaceholderFormat(sq.Dollar)
+
+	var last int64
+	for scanned := 0; scanned < maxEncryptedCandidates; scanned += encryptedBatchSize {
+		batch := query
+		if last > 0 {
+			batch = batch.Where(sq.Gt{cursor.column: last})
+		}
+		rows, err := batch.QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		candidates := 0
+		for rows.Next() {
+			var m Message
+			var keyId sql.NullString
+			if err := rows.Scan(&m.Id, &m.Value, &m.IpAddress, &m.DateCreated, &m.Status, &keyId, &m.DeliverySeq); err != nil {
+				rows.Close()
+				return err
+			}
+			if m.Value, err = storage.openValue(m.Value, keyId, messageValue.row(int64(m.Id))); err != nil {
+				rows.Close()
+				return err
+			}
+			candidates++
+			last = cursor.of(&m)
+			if strings.Contains(m.Value, message) && !match(m) {
+				rows.Close()
+				return nil
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if candidates < encryptedBatchSize {
+			return nil
+		}
+	}
+	return ErrFilterTooBroad
+}
+
+// MessagesAfter retrieves up to limit visible messages delivered after the given delivery sequence
+// number, in the order they were delivered, filtered in the same way as Search. Scheduled messages
+// which are due are left until the scheduler delivers them, as that gives them their sequence number.
+func MessagesAfter(ctx context.Context, db *sql.DB, storage Storage, afterSeq int64, limit int, message, ipAddress string) ([]Message, error) {
+	query := sq.Select("id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq").
+		From("messages").
+		Where(deliveredMessages + " AND queue IS NULL").
+		Where(sq.Gt{"delivery_seq": afterSeq}).
+		RunWith(db)
+
+	if message != "" && storage.Cipher == nil {
+		query = query.Where("value LIKE ?", fmt.Sprint("%", message, "%"))
+	}
+	if ipAddress != "" {
+		query = query.Where("TEXT(ip_address) LIKE ?", fmt.Sprint(ipAddress, "%"))
+	}
+
+	messages := []Message{}
+
+	// Encrypted candidates are checked for the exact substring once decrypted, so the limit is
+	// applied to the matches rather than in the query
+	if message != "" && storage.Cipher != nil {
+		err := scanEncrypted(ctx, storage, query, byDelivery, message, func(m Message) bool {
+			messages = append(messages, m)
+			return len(messages) < limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		return messages, nil
+	}
+
+	rows, err := query.OrderBy("delivery_seq").Limit(uint64(limit)).PlaceholderFormat(sq.Dollar).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var m Message
+		var keyId sql.NullString
+		if err := rows.Scan(&m.Id, &m.Value, &m.IpAddress, &m.DateCreated, &m.Status, &keyId, &m.DeliverySeq); err != nil {
+			return nil, err
+		}
+		if m.Value, err = storage.openValue(m.Value, keyId, messageValue.row(int64(m.Id))); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+// DeliverySeqOf returns the delivery sequence number of the message with the given ID, or of the
+// latest message before it if it has been deleted, so that a stream which last saw that message can
+// resume after it. Zero is returned if there are no such messages.
+func DeliverySeqOf(ctx context.Context, db *sql.DB, id int) (int64, error) {
+	var seq int64
+	err := sq.Select("delivery_seq").
+		From("messages").
+		Where(sq.LtOrEq{"id": id}).
+		OrderBy("id DESC").
+		Limit(1).
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// SearchModerationQueue retrieves a page of the messages awaiting moderation, oldest first.
+func SearchModerationQueue(ctx context.Context, db *sql.DB, storage Storage, offset, limit int) (*Page, error) {
+	var totalCount int
+	err := sq.Select("COUNT(id)").
+		From("messages").
+		Where(awaitingModeration).
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&totalCount)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sq.Select("id", "value", "ip_address", "date_created", "moderation_status", "moderation_reason", "key_id").
+		From("messages").
+		Where(awaitingModeration).
+		OrderBy("id").
+		Limit(uint64(limit)).
+		Offset(uint64(offset)).
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	messages := []Message{}
+
+	for rows.Next() {
+		var m Message
+		var keyId sql.NullString
+		if err := rows.Scan(&m.Id, &m.Value, &m.IpAddress, &m.DateCreated, &m.Status, &m.ModerationReason, &keyId); err != nil {
+			return nil, err
+		}
+		if m.Value, err = storage.openValue(m.Value, keyId, messageValue.row(int64(m.Id))); err != nil {
 			return nil, err
 		}
 		messages = append(messages, m)
@@ -85,6 +600,19 @@ func Search(db *sql.DB, offset, limit int, message, ipAddress string) (*Page, er
 	return &Page{offset, limit, totalCount, messages}, nil
 }
 
+// CountMessages returns the number of stored messages, including those hidden by moderation.
+func CountMessages(ctx context.Context, db *sql.DB) (int, error) {
+	var count int
+	err := sq.Select("COUNT(id)").
+		From("messages").
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&count)
+
+	return count, err
+}
+
 func addWhereCondition(predicate, value string, queries ...*sq.SelectBuilder) {
 	for _, query := range queries {
 		where := query.Where(predicate, value)
@@ -2,6 +2,9 @@ package model
 
 import (
 	"testing"
+	"context"
+	"database/sql"
+	"errors"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
 	"time"
@@ -13,14 +16,14 @@ func Test_ShouldRetrieveMessage(t *testing.T) {
 	defer db.Close()
 	expectedDateCreated, err := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
 
-	columns := []string{"value", "ip_address", "date_created"}
-	mock.ExpectQuery("SELECT value, ip_address, date_created FROM messages").
+	columns := []string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
 		WithArgs(123).
-		WillReturnRows(sqlmock.NewRows(columns).AddRow("Test message value", "192.168.200.201", expectedDateCreated))
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("Test message value", "192.168.200.201", expectedDateCreated, "approved", nil, 1))
 
 	message := Message{Id: 123}
 
-	err = message.GetMessage(db)
+	err = message.GetMessage(context.Background(), db, Storage{})
 	assert.Nil(t, err)
 
 	err = mock.ExpectationsWereMet()
@@ -31,6 +34,25 @@ func Test_ShouldRetrieveMessage(t *testing.T) {
 	assert.Equal(t,"2017-06-25 14:22:12.296925 +0000 UTC", message.DateCreated.String(), "Message date created was not mapped as expected")
 }
 
+func Test_ShouldNotRetrieveQueuedMessage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages WHERE id = \\$1 AND moderation_status IN \\('approved', 'flagged'\\) "+
+		"AND \\(NOT scheduled OR deliver_at <= NOW\\(\\) AT TIME ZONE 'UTC'\\) AND queue IS NULL").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}))
+
+	message := Message{Id: 123}
+
+	err = message.GetMessage(context.Background(), db, Storage{})
+	assert.Equal(t, sql.ErrNoRows, err, "Messages in a queue should only be seen by their consumers")
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
 func Test_ShouldCreateNewMessage(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.Nil(t, err)
@@ -38,12 +60,12 @@ func Test_ShouldCreateNewMessage(t *testing.T) {
 
 	columns := []string{"id"}
 	mock.ExpectQuery("INSERT INTO messages").
-		WithArgs("Test message value", "192.168.200.201").
+		WithArgs("Test message value", "192.168.200.201", "approved", "").
 		WillReturnRows(sqlmock.NewRows(columns).AddRow(22))
 
 	message := Message{Value: "Test message value", IpAddress: "192.168.200.201"}
 
-	err = message.CreateMessage(db)
+	err = message.CreateMessage(context.Background(), db, Storage{}, nil)
 	assert.Nil(t, err)
 
 	err = mock.ExpectationsWereMet()
@@ -57,11 +79,14 @@ func Test_ShouldDeleteMessage(t *testing.T) {
 	assert.Nil(t, err)
 	defer db.Close()
 
-	mock.ExpectExec("DELETE FROM messages").WithArgs(123).WillReturnResult(sqlmock.NewResult(0,1))
+	mock.ExpectQuery("DELETE FROM messages WHERE id = \\$1 AND queue IS NULL RETURNING ip_address, owner, moderation_status, scheduled").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address", "owner", "moderation_status", "scheduled"}).AddRow("127.0.0.1", nil, "approved", false))
 	message := Message{Id: 123}
 
-	err = message.DeleteMessage(db)
+	visible, err := message.DeleteMessage(context.Background(), db, Storage{}, nil)
 	assert.Nil(t, err)
+	assert.True(t, visible, "Approved message should have been visible")
 
 	err = mock.ExpectationsWereMet()
 	assert.Nil(t, err)
@@ -77,13 +102,13 @@ func Test_ShouldSearchForMessagesWithoutCriteriaAndMapResultsCorrectly(t *testin
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).
 		AddRow(100))
 
-	columns := []string{"id", "value", "ip_address", "date_created"}
-	mock.ExpectQuery("SELECT id, value, ip_address, date_created FROM messages").
+	columns := []string{"id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
 		WillReturnRows(sqlmock.NewRows(columns).
-		AddRow(1, "Test message value 1", "192.168.200.201", expectedDateCreated).
-		AddRow(2, "Test message value 2", "127.0.0.1", expectedDateCreated))
+		AddRow(1, "Test message value 1", "192.168.200.201", expectedDateCreated, "approved", nil, 1).
+		AddRow(2, "Test message value 2", "127.0.0.1", expectedDateCreated, "approved", nil, 1))
 
-	page, error := Search(db, 0, 10, "", "")
+	page, error := Search(context.Background(), db, Storage{}, 0, 10, "", "")
 
 	assert.Nil(t, error)
 	err = mock.ExpectationsWereMet()
@@ -118,13 +143,13 @@ func Test_ShouldSearchForMessagesWithMessageValueCriteria(t *testing.T) {
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).
 		AddRow(100))
 
-	columns := []string{"id", "value", "ip_address", "date_created"}
-	mock.ExpectQuery("SELECT id, value, ip_address, date_created FROM messages").
+	columns := []string{"id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
 		WithArgs("%Test message value%").
 		WillReturnRows(sqlmock.NewRows(columns).
-		AddRow(1, "Test message value", "192.168.200.201", expectedDateCreated))
+		AddRow(1, "Test message value", "192.168.200.201", expectedDateCreated, "approved", nil, 1))
 
-	page, error := Search(db, 0, 10, "Test message value", "")
+	page, error := Search(context.Background(), db, Storage{}, 0, 10, "Test message value", "")
 
 	assert.Nil(t, error)
 	err = mock.ExpectationsWereMet()
@@ -147,13 +172,13 @@ func Test_ShouldSearchForMessagesWithIpAddressCriteria(t *testing.T) {
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).
 		AddRow(100))
 
-	columns := []string{"id", "value", "ip_address", "date_created"}
-	mock.ExpectQuery("SELECT id, value, ip_address, date_created FROM messages").
+	columns := []string{"id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
 		WithArgs("192.168%").
 		WillReturnRows(sqlmock.NewRows(columns).
-		AddRow(1, "Test message value", "192.168.200.201", expectedDateCreated))
+		AddRow(1, "Test message value", "192.168.200.201", expectedDateCreated, "approved", nil, 1))
 
-	page, error := Search(db, 0, 10, "", "192.168")
+	page, error := Search(context.Background(), db, Storage{}, 0, 10, "", "192.168")
 
 	assert.Nil(t, error)
 	err = mock.ExpectationsWereMet()
@@ -176,13 +201,13 @@ func Test_ShouldSearchForMessagesWithMessageValueAndIpAddressCriteria(t *testing
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).
 		AddRow(100))
 
-	columns := []string{"id", "value", "ip_address", "date_created"}
-	mock.ExpectQuery("SELECT id, value, ip_address, date_created FROM messages").
+	columns := []string{"id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
 		WithArgs("%Test message value%", "192.168%").
 		WillReturnRows(sqlmock.NewRows(columns).
-		AddRow(1, "Test message value", "192.168.200.201", expectedDateCreated))
+		AddRow(1, "Test message value", "192.168.200.201", expectedDateCreated, "approved", nil, 1))
 
-	page, error := Search(db, 0, 10, "Test message value", "192.168")
+	page, error := Search(context.Background(), db, Storage{}, 0, 10, "Test message value", "192.168")
 
 	assert.Nil(t, error)
 	err = mock.ExpectationsWereMet()
@@ -192,4 +217,194 @@ func Test_ShouldSearchForMessagesWithMessageValueAndIpAddressCriteria(t *testing
 	assert.Equal(t, 10, page.Limit, "Page limit was not set correctly")
 	assert.Equal(t, 100, page.TotalCount, "Total count was not set correctly")
 	assert.Equal(t, 1, len(page.Results.([]Message)), "Expected one message to be returned")
-}
\ No newline at end of file
+}
+
+func Test_ShouldRetrieveMessagesDeliveredAfterSequenceWithCriteria(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	columns := []string{"id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages "+
+		"WHERE moderation_status IN \\('approved', 'flagged'\\) AND NOT scheduled AND queue IS NULL AND delivery_seq > \\$1 AND value LIKE \\$2 AND TEXT\\(ip_address\\) LIKE \\$3 ORDER BY delivery_seq LIMIT 50").
+		WithArgs(int64(10), "%Test%", "192.168.%").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(4, "Test message value", "192.168.200.201", time.Now(), "approved", nil, 11).
+			AddRow(12, "Another test message", "192.168.200.202", time.Now(), "flagged", nil, 12))
+
+	messages, err := MessagesAfter(context.Background(), db, Storage{}, 10, 50, "Test", "192.168.")
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Len(t, messages, 2, "Messages were not mapped as expected")
+	assert.Equal(t, 4, messages[0].Id, "Messages should be returned in the order they were delivered")
+	assert.Equal(t, int64(11), messages[0].DeliverySeq, "Delivery sequence number was not mapped as expected")
+	assert.Equal(t, "flagged", messages[1].Status, "Message status was not mapped as expected")
+}
+
+func Test_ShouldUpdateModerationStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("UPDATE messages SET moderation_status = \\$1, delivery_seq = CASE WHEN previous.moderation_status = \\$2 THEN nextval\\('messages_delivery_seq'\\) ELSE messages.delivery_seq END FROM \\(SELECT id, moderation_status FROM messages WHERE id = \\$3 AND moderation_status IN \\('flagged', 'quarantined'\\) FOR UPDATE\\) AS previous WHERE messages.id = previous.id RETURNING previous.moderation_status, messages.ip_address, messages.owner").
+		WithArgs("approved", "quarantined", 123).
+		WillReturnRows(sqlmock.NewRows([]string{"moderation_status", "ip_address", "owner"}).AddRow("flagged", "127.0.0.1", nil))
+	message := Message{Id: 123}
+
+	event, err := message.UpdateModerationStatus(context.Background(), db, Storage{}, "approved", nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "approved", message.Status, "Message status was not updated")
+	assert.Equal(t, EventUpdated, event, "Approving a flagged message should update it")
+}
+
+func Test_ShouldSeeModerationDecisionsAsEvents(t *testing.T) {
+	for _, test := range []struct {
+		previous, status, event string
+	}{
+		{"flagged", "approved", EventUpdated},
+		{"flagged", "rejected", EventDeleted},
+		{"quarantined", "approved", EventCreated},
+		{"quarantined", "rejected", ""},
+	} {
+		assert.Equal(t, test.event, moderationEvent(test.previous, test.status), "Event for %s message being %s not as expected", test.previous, test.status)
+	}
+}
+
+func Test_ShouldRecordApprovalOfQuarantinedMessageAsCreated(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE messages SET moderation_status").
+		WithArgs("approved", "quarantined", 123).
+		WillReturnRows(sqlmock.NewRows([]string{"moderation_status", "ip_address", "owner"}).AddRow("quarantined", "127.0.0.1", nil))
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages WHERE id = \\$1 AND moderation_status IN \\('approved', 'flagged'\\) AND NOT scheduled").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}).AddRow("hello", "127.0.0.1", time.Now(), "approved", nil, 1))
+	mock.ExpectExec("INSERT INTO outbox").
+		WithArgs("created", 123, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	message := Message{Id: 123}
+
+	event, err := message.UpdateModerationStatus(context.Background(), db, Storage{Outbox: true}, "approved", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, EventCreated, event, "Approving a quarantined message should create it")
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldFailToUpdateModerationStatusOfMessageNotAwaitingModeration(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("UPDATE messages").
+		WithArgs("rejected", 123).
+		WillReturnRows(sqlmock.NewRows([]string{"moderation_status", "ip_address", "owner"}))
+	message := Message{Id: 123}
+
+	_, err = message.UpdateModerationStatus(context.Background(), db, Storage{}, "rejected", nil)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldSearchModerationQueue(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	expectedDateCreated, err := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectQuery("SELECT COUNT\\(id\\) FROM messages WHERE moderation_status IN \\('flagged', 'quarantined'\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	columns := []string{"id", "value", "ip_address", "date_created", "moderation_status", "moderation_reason", "key_id"}
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, moderation_reason, key_id FROM messages").
+		WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(1, "Test message value", "192.168.200.201", expectedDateCreated, "flagged", "Contains 4 links (maximum 3)", nil))
+
+	page, err := SearchModerationQueue(context.Background(), db, Storage{}, 0, 10)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, page.TotalCount, "Total count was not set correctly")
+	messages := page.Results.([]Message)
+	assert.Equal(t, "flagged", messages[0].Status, "Message status was not as expected")
+	assert.Equal(t, "Contains 4 links (maximum 3)", messages[0].ModerationReason, "Moderation reason was not as expected")
+}
+
+func Test_ShouldCreateNewMessageWithRedactionsInTransaction(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO messages").
+		WithArgs("Contact [redacted email]", "192.168.200.201", "approved", "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(22))
+	mock.ExpectQuery("INSERT INTO message_redactions \\(message_id,kind\\)").
+		WithArgs(22, "email").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
+
+	message := Message{Value: "Contact [redacted email]", IpAddress: "192.168.200.201", Redactions: []Redaction{{Kind: "email"}}}
+
+	err = message.CreateMessage(context.Background(), db, Storage{}, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 22, message.Redactions[0].MessageId, "Redaction was not linked to the message")
+}
+
+func Test_ShouldRollBackMessageWhenRedactionsCannotBeStored(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO messages").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(22))
+	mock.ExpectQuery("INSERT INTO message_redactions").
+		WillReturnError(errors.New("Database connection closed"))
+	mock.ExpectRollback()
+
+	message := Message{Value: "Contact [redacted email]", Redactions: []Redaction{{Kind: "email"}}}
+
+	err = message.CreateMessage(context.Background(), db, Storage{}, nil)
+	assert.NotNil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldCountAllMessages(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT COUNT\\(id\\) FROM messages$").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(42))
+
+	count, err := CountMessages(context.Background(), db)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 42, count, "Message count was not mapped as expected")
+}
@@ -0,0 +1,231 @@
+package model
+
+import (
+	"amigo-tech-test/service/moderation"
+	"context"
+	"database/sql"
+	"encoding/json"
+	sq "github.com/Masterminds/squirrel"
+	"time"
+)
+
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+)
+
+// outboxRelayLock is the advisory lock held by the instance relaying the outbox, so that events are
+// only ever published in order by one instance at a time.
+const outboxRelayLock = 0x6f7574626f78
+
+// OutboxEvent is a message event waiting in the outbox to be published. EventId is unique to the
+// event, so that consumers can discard any they are sent more than once.
+type OutboxEvent struct {
+	Id          int64
+	EventId     string
+	Event       string
+	MessageId   int
+	Payload     json.RawMessage
+	DateCreated time.Time
+}
+
+// OutboxPayload is the payload of each event in the outbox. Deleted events have no message, but
+// keep its IP address and owner so that events can be ordered by either.
+type OutboxPayload struct {
+	Event     string   `json:"event"`
+	MessageId int      `json:"message_id"`
+	IpAddress string   `json:"ip_address"`
+	Owner     string   `json:"owner,omitempty"`
+	Message   *Message `json:"message,omitempty"`
+}
+
+// recordEvent queues an event for a message to webhooks and adds it to the outbox, as the storage
+// requires. The payload holds the message as it was changed, without its moderation reason, and is
+// encrypted along with message values.
+func recordEvent(ctx context.Context, runner sq.BaseRunner, storage Storage, event string, m *Message) error {
+	if storage.Webhooks {
+		if err := queueWebhooks(ctx, runner, storage, event, m); err != nil {
+			return err
+		}
+	}
+	if !storage.Outbox {
+		return nil
+	}
+
+	p := OutboxPayload{Event: event, MessageId: m.Id, IpAddress: m.IpAddress, Owner: m.Owner}
+	if event != EventDeleted {
+		message := *m
+		message.ModerationReason = ""
+		p.Message = &message
+	}
+
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	columns := []string{"event", "message_id", "payload"}
+	values := []interface{}{event, m.Id, string(payload)}
+
+	if storage.Cipher != nil {
+		id, err := outboxPayload.nextId(ctx, runner)
+		if err != nil {
+			return err
+		}
+		sealed, err := storage.sealValue(string(payload), outboxPayload.row(id))
+		if err != nil {
+			return err
+		}
+		values[2] = sealed
+		columns = append(columns, "id", "key_id")
+		values = append(values, id, storage.Cipher.ActiveKeyId())
+	}
+
+	_, err = sq.Insert("outbox").
+		Columns(columns...).
+		Values(values...).
+		RunWith(runner).
+		PlaceholderFormat(sq.Dollar).
+		ExecContext(ctx)
+	return err
+}
+
+// visible reports whether a message is shown to readers, and so whether its creation is an event.
+func (m *Message) visible() bool {
+	return m.Status == moderation.StatusApproved || m.Status == moderation.StatusFlagged
+}
+
+// RelayOutbox passes up to limit unsent events to publish, oldest first, and marks those published as
+// sent, returning how many were sent and how many were parked. It stops at the first event which
+// fails to publish, returning its error, so that none is published out of order. Events are held
+// back while any transaction which started before theirs is still in progress, as it may yet commit
+// an earlier event. Events which cannot be decrypted, such as those encrypted with a key since
+// removed from the keyring, are parked with the reason rather than holding up the rest, and are
+// never published. Events are published at least once: any published by a relay which fails to mark
+// them sent are published again. Only one instance relays at a time, and the others return without
+// publishing anything.
+func RelayOutbox(ctx context.Context, db *sql.DB, storage Storage, limit int, publish func(ctx context.Context, event OutboxEvent) error) (int, int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer tx.Rollback()
+
+	var locked bool
+	err = sq.Select().
+		Column("pg_try_advisory_xact_lock(?)", outboxRelayLock).
+		RunWith(tx).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&locked)
+	if err != nil || !locked {
+		return 0, 0, err
+	}
+
+	events, parked, err := unsentEvents(ctx, tx, storage, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, p := range parked {
+		_, err := sq.Update("outbox").
+			Set("date_parked", sq.Expr("NOW()")).
+			Set("park_reason", p.reason).
+			Where(sq.Eq{"id": p.id}).
+			RunWith(tx).
+			PlaceholderFormat(sq.Dollar).
+			ExecContext(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var sent []int64
+	var publishErr error
+	for _, event := range events {
+		if publishErr = publish(ctx, event); publishErr != nil {
+			break
+		}
+		sent = append(sent, event.Id)
+	}
+
+	if len(sent) > 0 {
+		_, err := sq.Update("outbox").
+			Set("date_sent", sq.Expr("NOW()")).
+			Where(sq.Eq{"id": sent}).
+			RunWith(tx).
+			PlaceholderFormat(sq.Dollar).
+			ExecContext(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return len(sent), len(parked), publishErr
+}
+
+// parkedEvent is an unsent event which cannot be relayed, and why.
+type parkedEvent struct {
+	id     int64
+	reason string
+}
+
+// unsentEvents loads up to limit events waiting to be relayed, setting aside those whose payloads
+// cannot be decrypted to be parked.
+func unsentEvents(ctx context.Context, tx *sql.Tx, storage Storage, limit int) ([]OutboxEvent, []parkedEvent, error) {
+	rows, err := sq.Select("id", "event_id", "event", "message_id", "payload", "key_id", "date_created").
+		From("outbox").
+		Where("date_sent IS NULL AND date_parked IS NULL").
+		// IDs are taken from the sequence in the order events are recorded, not committed, so an event
+		// is only relayed once every transaction older than its own has finished
+		Where("txid < pg_snapshot_xmin(pg_current_snapshot())").
+		OrderBy("id").
+		Limit(uint64(limit)).
+		RunWith(tx).
+		PlaceholderFormat(sq.Dollar).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+
+	events := []OutboxEvent{}
+	var parked []parkedEvent
+
+	for rows.Next() {
+		var e OutboxEvent
+		var payload string
+		var keyId sql.NullString
+		if err := rows.Scan(&e.Id, &e.EventId, &e.Event, &e.MessageId, &payload, &keyId, &e.DateCreated); err != nil {
+			return nil, nil, err
+		}
+		if payload, err = storage.openValue(payload, keyId, outboxPayload.row(e.Id)); err != nil {
+			parked = append(parked, parkedEvent{id: e.Id, reason: err.Error()})
+			continue
+		}
+		e.Payload = json.RawMessage(payload)
+		events = append(events, e)
+	}
+
+	return events, parked, rows.Err()
+}
+
+// PruneOutbox deletes events sent longer ago than the retention period, returning how many were
+// deleted. Parked events are never sent, so are kept until they are dealt with by hand.
+func PruneOutbox(ctx context.Context, db *sql.DB, retention time.Duration) (int64, error) {
+	result, err := sq.Delete("outbox").
+		Where("date_sent < NOW() - make_interval(secs => ?)", retention.Seconds()).
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
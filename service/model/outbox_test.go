@@ -0,0 +1,242 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"time"
+)
+
+func Test_ShouldRecordCreatedMessageInOutbox(t *testing.T) {
+	storage := Storage{Outbox: true}
+
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, err := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO messages (.+) RETURNING \"id\", \"date_created\"").
+		WithArgs("hello", "127.0.0.1", "approved", "").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(11, dateCreated))
+	mock.ExpectExec("INSERT INTO outbox \\(event,message_id,payload\\) VALUES \\(\\$1,\\$2,\\$3\\)").
+		WithArgs("created", 11, `{"event":"created","message_id":11,"ip_address":"127.0.0.1","message":{"id":11,"value":"hello","ip_address":"127.0.0.1","date_created":"2017-06-25T14:22:12.296925Z","status":"approved"}}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	message := Message{Value: "hello", IpAddress: "127.0.0.1"}
+
+	err = message.CreateMessage(context.Background(), db, storage, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldRecordDeletionInOutbox(t *testing.T) {
+	storage := Storage{Outbox: true}
+
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("DELETE FROM messages WHERE id = \\$1 AND queue IS NULL RETURNING ip_address, owner, moderation_status, scheduled").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address", "owner", "moderation_status", "scheduled"}).AddRow("127.0.0.1", nil, "approved", false))
+	mock.ExpectExec("INSERT INTO outbox").
+		WithArgs("deleted", 123, `{"event":"deleted","message_id":123,"ip_address":"127.0.0.1"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	message := Message{Id: 123}
+
+	_, err = message.DeleteMessage(context.Background(), db, storage, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldKeepOwnerOfDeletedMessageInOutbox(t *testing.T) {
+	storage := Storage{Outbox: true}
+
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("DELETE FROM messages WHERE id = \\$1 AND queue IS NULL RETURNING ip_address, owner, moderation_status, scheduled").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address", "owner", "moderation_status", "scheduled"}).AddRow("127.0.0.1", "CN=orders", "approved", false))
+	mock.ExpectExec("INSERT INTO outbox").
+		WithArgs("deleted", 123, `{"event":"deleted","message_id":123,"ip_address":"127.0.0.1","owner":"CN=orders"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	message := Message{Id: 123}
+
+	_, err = message.DeleteMessage(context.Background(), db, storage, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldNotRecordDeletionOfMessagesNeverVisible(t *testing.T) {
+	storage := Storage{Outbox: true}
+
+	for _, tc := range []struct {
+		status    string
+		scheduled bool
+	}{
+		{"quarantined", false},
+		{"rejected", false},
+		{"approved", true},
+	} {
+		db, mock, err := sqlmock.New()
+		assert.Nil(t, err)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("DELETE FROM messages WHERE id = \\$1 AND queue IS NULL RETURNING ip_address, owner, moderation_status, scheduled").
+			WithArgs(123).
+			WillReturnRows(sqlmock.NewRows([]string{"ip_address", "owner", "moderation_status", "scheduled"}).AddRow("127.0.0.1", nil, tc.status, tc.scheduled))
+		mock.ExpectCommit()
+
+		message := Message{Id: 123}
+
+		visible, err := message.DeleteMessage(context.Background(), db, storage, nil)
+		assert.Nil(t, err)
+		assert.False(t, visible, "Message %s (scheduled %t) should not have been visible", tc.status, tc.scheduled)
+
+		err = mock.ExpectationsWereMet()
+		assert.Nil(t, err, "No event should be recorded for a message %s (scheduled %t)", tc.status, tc.scheduled)
+		db.Close()
+	}
+}
+
+func Test_ShouldRelayOutboxEventsInOrderUntilOneFails(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, err := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock\\(\\$1\\)").
+		WithArgs(outboxRelayLock).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("SELECT id, event_id, event, message_id, payload, key_id, date_created FROM outbox WHERE date_sent IS NULL AND date_parked IS NULL AND txid < pg_snapshot_xmin\\(pg_current_snapshot\\(\\)\\) ORDER BY id LIMIT 10").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_id", "event", "message_id", "payload", "key_id", "date_created"}).
+			AddRow(1, "a5e0c5f2-7f43-4d0c-8a4e-1b2f0c9d3e11", "created", 11, `{"event":"created"}`, nil, dateCreated).
+			AddRow(2, "0c1d2e3f-4a5b-4c6d-8e7f-9a0b1c2d3e4f", "deleted", 11, `{"event":"deleted"}`, nil, dateCreated).
+			AddRow(3, "9f8e7d6c-5b4a-4392-8170-6f5e4d3c2b1a", "created", 12, `{"event":"created"}`, nil, dateCreated))
+	mock.ExpectExec("UPDATE outbox SET date_sent = NOW\\(\\) WHERE id IN \\(\\$1\\)").
+		WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	var published []string
+	unavailable := errors.New("broker unavailable")
+	sent, parked, err := RelayOutbox(context.Background(), db, Storage{}, 10, func(ctx context.Context, event OutboxEvent) error {
+		if event.Id == 2 {
+			return unavailable
+		}
+		published = append(published, event.EventId)
+		return nil
+	})
+
+	assert.Equal(t, unavailable, err, "The publishing error should be returned")
+	assert.Equal(t, 1, sent, "Only the events before the failure should be sent")
+	assert.Equal(t, 0, parked, "No events should be parked")
+	assert.Equal(t, []string{"a5e0c5f2-7f43-4d0c-8a4e-1b2f0c9d3e11"}, published, "No event should be published after the failure")
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldNotRelayOutboxWhileAnotherInstanceIs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock\\(\\$1\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+	mock.ExpectRollback()
+
+	sent, _, err := RelayOutbox(context.Background(), db, Storage{}, 10, func(ctx context.Context, event OutboxEvent) error {
+		t.Errorf("Event %s should not be published", event.EventId)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, sent, "No events should be sent")
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldEncryptOutboxPayloads(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	keyring := newTestKeyring(t, "new")
+	storage := Storage{Cipher: keyring, Outbox: true}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("DELETE FROM messages WHERE id = \\$1 AND queue IS NULL RETURNING ip_address, owner, moderation_status, scheduled").
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address", "owner", "moderation_status", "scheduled"}).AddRow("127.0.0.1", nil, "approved", false))
+	expectNextId(mock, "outbox", 9)
+	mock.ExpectExec("INSERT INTO outbox \\(event,message_id,payload,id,key_id\\)").
+		WithArgs("deleted", 123, sealedValue{keyring, `{"event":"deleted","message_id":123,"ip_address":"127.0.0.1"}`, outboxPayload.row(9)}, 9, "new").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	message := Message{Id: 123}
+
+	_, err = message.DeleteMessage(context.Background(), db, storage, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldParkOutboxEventsWhichCannotBeDecrypted(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, err := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+	keyring := newTestKeyring(t, "new")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock\\(\\$1\\)").
+		WithArgs(outboxRelayLock).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("SELECT id, event_id, event, message_id, payload, key_id, date_created FROM outbox WHERE date_sent IS NULL AND date_parked IS NULL").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_id", "event", "message_id", "payload", "key_id", "date_created"}).
+			AddRow(1, "a5e0c5f2-7f43-4d0c-8a4e-1b2f0c9d3e11", "deleted", 11, sealTestValue(t, keyring, `{"event":"deleted"}`, outboxPayload.row(9)), "new", dateCreated).
+			AddRow(2, "0c1d2e3f-4a5b-4c6d-8e7f-9a0b1c2d3e4f", "deleted", 12, sealTestValue(t, keyring, `{"event":"deleted"}`, outboxPayload.row(2)), "new", dateCreated))
+	mock.ExpectExec("UPDATE outbox SET date_parked = NOW\\(\\), park_reason = \\$1 WHERE id = \\$2").
+		WithArgs(sqlmock.AnyArg(), int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE outbox SET date_sent = NOW\\(\\) WHERE id IN \\(\\$1\\)").
+		WithArgs(int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	var published []int64
+	sent, parked, err := RelayOutbox(context.Background(), db, Storage{Cipher: keyring}, 10, func(ctx context.Context, event OutboxEvent) error {
+		published = append(published, event.Id)
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, sent, "The event which could be decrypted should be sent")
+	assert.Equal(t, 1, parked, "The event which could not be decrypted should be parked")
+	assert.Equal(t, []int64{2}, published, "Only the event which could be decrypted should be published")
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
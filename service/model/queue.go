@@ -0,0 +1,299 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	sq "github.com/Masterminds/squirrel"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	EventClaimed      = "claimed"
+	EventAcknowledged = "acknowledged"
+	EventReleased     = "released"
+	EventDeadLettered = "dead_lettered"
+)
+
+// auditDeadLetter is the audit action for a message moved to its dead-letter queue, which happens
+// as a consequence of claiming or releasing messages rather than being requested.
+const auditDeadLetter = "dead_letter"
+
+// queuedColumns are returned by each change to queued messages, for the events they record.
+const queuedColumns = "id, value, ip_address, date_created, moderation_status, queue, key_id, owner"
+
+// QueuePolicy controls how many times a queued message is delivered before it is moved to its
+// queue's dead-letter queue, which is named by appending DeadLetterSuffix to the queue's name.
+// Messages in a dead-letter queue are delivered again without limit.
+type QueuePolicy struct {
+	MaxDeliveries    int
+	DeadLetterSuffix string
+}
+
+// exhausted matches queued messages which have been delivered as many times as allowed, and are not
+// already in a dead-letter queue. Postgres' right() counts characters rather than bytes.
+func (p QueuePolicy) exhausted() sq.Sqlizer {
+	return sq.Expr("deliveries >= ? AND right(queue, ?) <> ?", p.MaxDeliveries, utf8.RuneCountInString(p.DeadLetterSuffix), p.DeadLetterSuffix)
+}
+
+// ClaimedMessage is a message leased from a queue. The lease ID must be given to acknowledge the
+// message or release it, and is only valid until the lease expires.
+type ClaimedMessage struct {
+	Message
+	LeaseId     string    `json:"lease_id"`
+	LeasedUntil time.Time `json:"leased_until"`
+	Deliveries  int       `json:"deliveries"`
+}
+
+// unclaimed matches the ready messages in a queue which are waiting to be delivered, either for the
+// first time or again once their lease has expired.
+func unclaimed(queue string) sq.And {
+	return sq.And{
+		sq.Eq{"queue": queue},
+		sq.Expr("date_acknowledged IS NULL"),
+		sq.Expr("(leased_until IS NULL OR leased_until <= NOW())"),
+		sq.Expr(readyMessages),
+	}
+}
+
+// changeQueue makes a change to queued messages on its own when there are no events or audit entries
+// to record, and otherwise within a transaction, which it passes to the change to record them in.
+func changeQueue(ctx context.Context, db *sql.DB, storage Storage, audit *AuditEntry, change func(runner sq.BaseRunner, tx *sql.Tx) error) error {
+	if !storage.recordsEvents() && audit == nil {
+		return change(db, nil)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := change(tx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordQueueChange records the event for a change to a queued message and its audit entry, when the
+// change is made in a transaction.
+func recordQueueChange(ctx context.Context, tx *sql.Tx, storage Storage, event string, m *Message, audit *AuditEntry) error {
+	if tx == nil {
+		return nil
+	}
+	if storage.recordsEvents() {
+		if err := recordEvent(ctx, tx, storage, event, m); err != nil {
+			return err
+		}
+	}
+	if err := audit.snapshotAfter(ctx, tx, m.Id, messageSnapshot); err != nil {
+		return err
+	}
+	return audit.appendTo(ctx, tx)
+}
+
+// scanQueued reads a message returned as queuedColumns, followed by any other columns requested.
+func scanQueued(row interface{ Scan(...interface{}) error }, storage Storage, m *Message, dest ...interface{}) error {
+	var keyId, owner sql.NullString
+	err := row.Scan(append([]interface{}{&m.Id, &m.Value, &m.IpAddress, &m.DateCreated, &m.Status, &m.Queue, &keyId, &owner}, dest...)...)
+	if err != nil {
+		return err
+	}
+	m.Owner = owner.String
+	m.Value, err = storage.openValue(m.Value, keyId, messageValue.row(int64(m.Id)))
+	return err
+}
+
+// ClaimMessages leases up to limit of the oldest unclaimed messages in the queue for the visibility
+// timeout, counting a delivery of each. Messages claimed by other requests are skipped. Messages whose
+// lease expired after their last allowed delivery are first moved to the dead-letter queue. Each
+// message claimed or moved records its own event, and its own copy of the audit entry when it is not
+// nil, within the same transaction.
+func ClaimMessages(ctx context.Context, db *sql.DB, storage Storage, queue string, limit int, visibility time.Duration, policy QueuePolicy, audit *AuditEntry) ([]ClaimedMessage, error) {
+	var claimed []ClaimedMessage
+	err := changeQueue(ctx, db, storage, audit, func(runner sq.BaseRunner, tx *sql.Tx) error {
+		if err := deadLetterExhausted(ctx, runner, tx, storage, queue, policy, audit); err != nil {
+			return err
+		}
+
+		var err error
+		claimed, err = claimMessages(ctx, runner, storage, queue, limit, visibility, policy)
+		if err != nil {
+			return err
+		}
+
+		for i := range claimed {
+			if err := recordQueueChange(ctx, tx, storage, EventClaimed, &claimed[i].Message, audit.copyFor(claimed[i].Id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return claimed, err
+}
+
+// deadLetterExhausted moves the unclaimed messages in the queue which have been delivered as many
+// times as allowed to its dead-letter queue.
+func deadLetterExhausted(ctx context.Context, runner sq.BaseRunner, tx *sql.Tx, storage Storage, queue string, policy QueuePolicy, audit *AuditEntry) error {
+	exhausted := sq.Select("id").
+		From("messages").
+		Where(unclaimed(queue)).
+		Where(policy.exhausted()).
+		Suffix("FOR UPDATE SKIP LOCKED")
+
+	rows, err := sq.Update("messages").
+		Set("queue", sq.Expr("queue || ?", policy.DeadLetterSuffix)).
+		Set("deliveries", 0).
+		Set("lease_id", nil).
+		Set("leased_until", nil).
+		Where(sq.Expr("id IN (?)", exhausted)).
+		Suffix("RETURNING " + queuedColumns).
+		RunWith(runner).
+		PlaceholderFormat(sq.Dollar).
+		QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	moved := []Message{}
+	for rows.Next() {
+		var m Message
+		if err := scanQueued(rows, storage, &m); err != nil {
+			rows.Close()
+			return err
+		}
+		moved = append(moved, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sort.Slice(moved, func(i, j int) bool { return moved[i].Id < moved[j].Id })
+	for i := range moved {
+		entry := audit.copyFor(moved[i].Id)
+		if entry != nil {
+			entry.Action = auditDeadLetter
+		}
+		if err := recordQueueChange(ctx, tx, storage, EventDeadLettered, &moved[i], entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimMessages leases the oldest unclaimed messages in the queue which have deliveries left.
+func claimMessages(ctx context.Context, runner sq.BaseRunner, storage Storage, queue string, limit int, visibility time.Duration, policy QueuePolicy) ([]ClaimedMessage, error) {
+	oldest := sq.Select("id").
+		From("messages").
+		Where(unclaimed(queue)).
+		Where(sq.Expr("NOT (?)", policy.exhausted())).
+		OrderBy("id").
+		Limit(uint64(limit)).
+		Suffix("FOR UPDATE SKIP LOCKED")
+
+	rows, err := sq.Update("messages").
+		Set("lease_id", sq.Expr("gen_random_uuid()")).
+		Set("leased_until", sq.Expr("NOW() + make_interval(secs => ?)", visibility.Seconds())).
+		Set("deliveries", sq.Expr("deliveries + 1")).
+		Where(sq.Expr("id IN (?)", oldest)).
+		Suffix("RETURNING " + queuedColumns + ", lease_id, leased_until, deliveries").
+		RunWith(runner).
+		PlaceholderFormat(sq.Dollar).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	claimed := []ClaimedMessage{}
+
+	for rows.Next() {
+		var c ClaimedMessage
+		if err := scanQueued(rows, storage, &c.Message, &c.LeaseId, &c.LeasedUntil, &c.Deliveries); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i].Id < claimed[j].Id })
+	return claimed, nil
+}
+
+// leased matches the message while it is leased with the given lease ID.
+func leased(id int, leaseId string) sq.And {
+	return sq.And{
+		sq.Eq{"id": id},
+		sq.Expr("lease_id::text = ?", leaseId),
+		sq.Expr("leased_until > NOW()"),
+		sq.Expr("date_acknowledged IS NULL"),
+	}
+}
+
+// AcknowledgeMessage removes a claimed message from its queue once it has been processed, returning
+// sql.ErrNoRows if the message is not leased with the lease ID. The event is recorded, along with the
+// audit entry when it is not nil, in the same transaction.
+func AcknowledgeMessage(ctx context.Context, db *sql.DB, storage Storage, id int, leaseId string, audit *AuditEntry) error {
+	return changeQueue(ctx, db, storage, audit, func(runner sq.BaseRunner, tx *sql.Tx) error {
+		if err := audit.snapshotBefore(ctx, runner, id, messageSnapshot); err != nil {
+			return err
+		}
+
+		var m Message
+		row := sq.Update("messages").
+			Set("date_acknowledged", sq.Expr("NOW()")).
+			Set("lease_id", nil).
+			Set("leased_until", nil).
+			Where(leased(id, leaseId)).
+			Suffix("RETURNING " + queuedColumns).
+			RunWith(runner).
+			PlaceholderFormat(sq.Dollar).
+			QueryRowContext(ctx)
+		if err := scanQueued(row, storage, &m); err != nil {
+			return err
+		}
+		return recordQueueChange(ctx, tx, storage, EventAcknowledged, &m, audit)
+	})
+}
+
+// ReleaseMessage ends a claimed message's lease so that it can be claimed again straight away, or
+// moves it to the dead-letter queue after its last allowed delivery. It returns the queue the message
+// is now in, or sql.ErrNoRows if the message is not leased with the lease ID. The event is recorded,
+// along with the audit entry when it is not nil, in the same transaction.
+func ReleaseMessage(ctx context.Context, db *sql.DB, storage Storage, id int, leaseId string, policy QueuePolicy, audit *AuditEntry) (string, error) {
+	var m Message
+	err := changeQueue(ctx, db, storage, audit, func(runner sq.BaseRunner, tx *sql.Tx) error {
+		if err := audit.snapshotBefore(ctx, runner, id, messageSnapshot); err != nil {
+			return err
+		}
+
+		var deliveries int
+		row := sq.Update("messages").
+			Set("queue", sq.Case().When(policy.exhausted(), sq.Expr("queue || ?", policy.DeadLetterSuffix)).Else("queue")).
+			Set("deliveries", sq.Case().When(policy.exhausted(), "0").Else("deliveries")).
+			Set("lease_id", nil).
+			Set("leased_until", nil).
+			Where(leased(id, leaseId)).
+			Suffix("RETURNING " + queuedColumns + ", deliveries").
+			RunWith(runner).
+			PlaceholderFormat(sq.Dollar).
+			QueryRowContext(ctx)
+		if err := scanQueued(row, storage, &m, &deliveries); err != nil {
+			return err
+		}
+
+		// A released message has been claimed at least once, so has no deliveries only once it has
+		// been moved to the dead-letter queue
+		event := EventReleased
+		if deliveries == 0 {
+			event = EventDeadLettered
+		}
+		return recordQueueChange(ctx, tx, storage, event, &m, audit)
+	})
+	return m.Queue, err
+}
@@ -0,0 +1,235 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"time"
+)
+
+var testQueuePolicy = QueuePolicy{MaxDeliveries: 5, DeadLetterSuffix: ".dead-letter"}
+
+var queuedColumnNames = []string{"id", "value", "ip_address", "date_created", "moderation_status", "queue", "key_id", "owner"}
+
+func Test_ShouldClaimOldestMessagesAfterDeadLetteringExhaustedOnes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+	leasedUntil := dateCreated.Add(30 * time.Second)
+
+	mock.ExpectQuery("UPDATE messages SET queue = queue \\|\\| \\$1, deliveries = \\$2, lease_id = \\$3, leased_until = \\$4 "+
+		"WHERE id IN \\(SELECT id FROM messages WHERE \\(queue = \\$5 AND date_acknowledged IS NULL AND \\(leased_until IS NULL OR leased_until <= NOW\\(\\)\\) .*\\) "+
+		"AND deliveries >= \\$6 AND right\\(queue, \\$7\\) <> \\$8 FOR UPDATE SKIP LOCKED\\) RETURNING id, value, ip_address, date_created, moderation_status, queue, key_id, owner").
+		WithArgs(".dead-letter", 0, nil, nil, "orders", 5, 12, ".dead-letter").
+		WillReturnRows(sqlmock.NewRows(queuedColumnNames).AddRow(3, "stuck", "10.0.0.1", dateCreated, "approved", "orders.dead-letter", nil, nil))
+	mock.ExpectQuery("UPDATE messages SET lease_id = gen_random_uuid\\(\\), leased_until = NOW\\(\\) \\+ make_interval\\(secs => \\$1\\), deliveries = deliveries \\+ 1 "+
+		"WHERE id IN \\(SELECT id FROM messages WHERE \\(queue = \\$2 .*\\) AND NOT \\(deliveries >= \\$3 AND right\\(queue, \\$4\\) <> \\$5\\) "+
+		"ORDER BY id LIMIT 2 FOR UPDATE SKIP LOCKED\\) RETURNING id, value, ip_address, date_created, moderation_status, queue, key_id, owner, lease_id, leased_until, deliveries").
+		WithArgs(float64(30), "orders", 5, 12, ".dead-letter").
+		WillReturnRows(sqlmock.NewRows(append(queuedColumnNames, "lease_id", "leased_until", "deliveries")).
+		AddRow(9, "second", "10.0.0.1", dateCreated, "approved", "orders", nil, nil, "b3f1", leasedUntil, 2).
+		AddRow(7, "first", "10.0.0.1", dateCreated, "approved", "orders", nil, nil, "a2e0", leasedUntil, 1))
+
+	claimed, err := ClaimMessages(context.Background(), db, Storage{}, "orders", 2, 30*time.Second, testQueuePolicy, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, len(claimed), "Expected two messages to be claimed")
+	assert.Equal(t, 7, claimed[0].Id, "Claimed messages should be returned oldest first")
+	assert.Equal(t, "first", claimed[0].Value, "Message value was not mapped as expected")
+	assert.Equal(t, "a2e0", claimed[0].LeaseId, "Lease ID was not mapped as expected")
+	assert.Equal(t, leasedUntil, claimed[0].LeasedUntil, "Lease expiry was not mapped as expected")
+	assert.Equal(t, 1, claimed[0].Deliveries, "Deliveries were not mapped as expected")
+}
+
+func Test_ShouldRecordEventsForClaimedAndDeadLetteredMessagesInTransaction(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE messages SET queue = queue \\|\\| \\$1").
+		WillReturnRows(sqlmock.NewRows(queuedColumnNames).AddRow(3, "stuck", "10.0.0.1", dateCreated, "approved", "orders.dead-letter", nil, nil))
+	mock.ExpectExec("INSERT INTO outbox").
+		WithArgs(EventDeadLettered, 3, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("UPDATE messages SET lease_id = gen_random_uuid\\(\\)").
+		WillReturnRows(sqlmock.NewRows(append(queuedColumnNames, "lease_id", "leased_until", "deliveries")).
+		AddRow(7, "first", "10.0.0.1", dateCreated, "approved", "orders", nil, "CN=orders", "a2e0", dateCreated, 1))
+	mock.ExpectExec("INSERT INTO outbox").
+		WithArgs(EventClaimed, 7, `{"event":"claimed","message_id":7,"ip_address":"10.0.0.1","owner":"CN=orders","message":{"id":7,"value":"first","ip_address":"10.0.0.1","date_created":"2017-06-25T14:22:12.296925Z","status":"approved","queue":"orders"}}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	claimed, err := ClaimMessages(context.Background(), db, Storage{Outbox: true}, "orders", 2, 30*time.Second, testQueuePolicy, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(claimed), "Expected one message to be claimed")
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldAuditEachClaimedMessage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+	snapshotColumns := []string{"id", "value", "ip_address", "date_created", "moderation_status", "moderation_reason", "key_id", "queue", "deliveries", "leased_until", "date_acknowledged"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE messages SET queue = queue \\|\\| \\$1").
+		WillReturnRows(sqlmock.NewRows(queuedColumnNames))
+	mock.ExpectQuery("UPDATE messages SET lease_id = gen_random_uuid\\(\\)").
+		WillReturnRows(sqlmock.NewRows(append(queuedColumnNames, "lease_id", "leased_until", "deliveries")).
+		AddRow(7, "first", "10.0.0.1", dateCreated, "approved", "orders", nil, nil, "a2e0", dateCreated, 1))
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, moderation_reason, key_id, queue, deliveries, leased_until, date_acknowledged FROM messages").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(snapshotColumns).AddRow(7, "first", "10.0.0.1", dateCreated, "approved", "", nil, "orders", 1, dateCreated, nil))
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT hash FROM audit_log").WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+	mock.ExpectQuery("INSERT INTO audit_log").
+		WithArgs("claim", "message", 7, "consumer", "10.0.0.1", "request-1", nil,
+			`{"id":7,"value":"first","ip_address":"10.0.0.1","date_created":"2017-06-25T14:22:12.296925Z","status":"approved","moderation_reason":"","key_id":null,"queue":"orders","deliveries":1,"leased_until":"2017-06-25T14:22:12.296925Z"}`,
+			"", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	audit := &AuditEntry{Action: "claim", Entity: "message", Actor: "consumer", ClientIp: "10.0.0.1", RequestId: "request-1"}
+	_, err = ClaimMessages(context.Background(), db, Storage{}, "orders", 2, 30*time.Second, testQueuePolicy, audit)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldAcknowledgeLeasedMessage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectQuery("UPDATE messages SET date_acknowledged = NOW\\(\\), lease_id = \\$1, leased_until = \\$2 "+
+		"WHERE \\(id = \\$3 AND lease_id::text = \\$4 AND leased_until > NOW\\(\\) AND date_acknowledged IS NULL\\) RETURNING id, value, ip_address, date_created, moderation_status, queue, key_id, owner").
+		WithArgs(nil, nil, 7, "a2e0").
+		WillReturnRows(sqlmock.NewRows(queuedColumnNames).AddRow(7, "first", "10.0.0.1", dateCreated, "approved", "orders", nil, nil))
+
+	err = AcknowledgeMessage(context.Background(), db, Storage{}, 7, "a2e0", nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldRecordAcknowledgementInOutbox(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE messages SET date_acknowledged = NOW\\(\\)").
+		WithArgs(nil, nil, 7, "a2e0").
+		WillReturnRows(sqlmock.NewRows(queuedColumnNames).AddRow(7, "first", "10.0.0.1", dateCreated, "approved", "orders", nil, nil))
+	mock.ExpectExec("INSERT INTO outbox").
+		WithArgs(EventAcknowledged, 7, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = AcknowledgeMessage(context.Background(), db, Storage{Outbox: true}, 7, "a2e0", nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldFailToAcknowledgeMessageWithExpiredLease(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("UPDATE messages").
+		WithArgs(nil, nil, 7, "a2e0").
+		WillReturnRows(sqlmock.NewRows(queuedColumnNames))
+
+	err = AcknowledgeMessage(context.Background(), db, Storage{}, 7, "a2e0", nil)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldReleaseMessageToDeadLetterQueueAfterLastDelivery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE messages SET "+
+		"queue = CASE WHEN deliveries >= \\$1 AND right\\(queue, \\$2\\) <> \\$3 THEN queue \\|\\| \\$4 ELSE queue END, "+
+		"deliveries = CASE WHEN deliveries >= \\$5 AND right\\(queue, \\$6\\) <> \\$7 THEN 0 ELSE deliveries END, "+
+		"lease_id = \\$8, leased_until = \\$9 WHERE \\(id = \\$10 AND lease_id::text = \\$11 .*\\) RETURNING id, value, ip_address, date_created, moderation_status, queue, key_id, owner, deliveries").
+		WithArgs(5, 12, ".dead-letter", ".dead-letter", 5, 12, ".dead-letter", nil, nil, 7, "a2e0").
+		WillReturnRows(sqlmock.NewRows(append(queuedColumnNames, "deliveries")).AddRow(7, "first", "10.0.0.1", dateCreated, "approved", "orders.dead-letter", nil, nil, 0))
+	mock.ExpectExec("INSERT INTO outbox").
+		WithArgs(EventDeadLettered, 7, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	queue, err := ReleaseMessage(context.Background(), db, Storage{Outbox: true}, 7, "a2e0", testQueuePolicy, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "orders.dead-letter", queue, "Queue was not mapped as expected")
+}
+
+func Test_ShouldCountDeadLetterSuffixInCharacters(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectQuery("UPDATE messages SET queue = CASE WHEN deliveries >= \\$1 AND right\\(queue, \\$2\\) <> \\$3").
+		WithArgs(5, 7, ".échoué", ".échoué", 5, 7, ".échoué", nil, nil, 7, "a2e0").
+		WillReturnRows(sqlmock.NewRows(append(queuedColumnNames, "deliveries")).AddRow(7, "first", "10.0.0.1", dateCreated, "approved", "orders.échoué", nil, nil, 0))
+
+	policy := QueuePolicy{MaxDeliveries: 5, DeadLetterSuffix: ".échoué"}
+	queue, err := ReleaseMessage(context.Background(), db, Storage{}, 7, "a2e0", policy, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "orders.échoué", queue, "Queue was not mapped as expected")
+}
+
+func Test_ShouldRecordReleaseOfMessageWithDeliveriesLeft(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE messages SET queue = CASE").
+		WillReturnRows(sqlmock.NewRows(append(queuedColumnNames, "deliveries")).AddRow(7, "first", "10.0.0.1", dateCreated, "approved", "orders", nil, nil, 2))
+	mock.ExpectExec("INSERT INTO outbox").
+		WithArgs(EventReleased, 7, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	queue, err := ReleaseMessage(context.Background(), db, Storage{Outbox: true}, 7, "a2e0", testQueuePolicy, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "orders", queue, "Queue was not mapped as expected")
+}
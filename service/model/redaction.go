@@ -0,0 +1,80 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	sq "github.com/Masterminds/squirrel"
+	"time"
+)
+
+// Redaction records a piece of personal information removed from a message before it was stored.
+type Redaction struct {
+	Id          int       `json:"id"`
+	MessageId   int       `json:"message_id"`
+	Kind        string    `json:"kind"`
+	// Original is the value which was redacted, or empty when only masked. It is encrypted as it is
+	// stored, and never loaded again.
+	Original    string    `json:"-"`
+	Encrypted   bool      `json:"encrypted"`
+	DateCreated time.Time `json:"date_created"`
+}
+
+func (r *Redaction) createRedaction(ctx context.Context, runner sq.BaseRunner, storage Storage) error {
+	columns := []string{"message_id", "kind"}
+	values := []interface{}{r.MessageId, r.Kind}
+
+	// Masked redactions have no original, which is left NULL
+	if r.Original != "" {
+		if storage.Originals == nil {
+			return errEncryptionDisabled
+		}
+
+		id, err := redactionOriginal.nextId(ctx, runner)
+		if err != nil {
+			return err
+		}
+		original, err := storage.Originals.Seal([]byte(r.Original), redactionOriginal.row(id))
+		if err != nil {
+			return err
+		}
+		columns = append(columns, "id", "original", "key_id")
+		values = append(values, id, original, storage.Originals.ActiveKeyId())
+	}
+
+	return sq.Insert("message_redactions").
+		Columns(columns...).
+		Values(values...).
+		Suffix("RETURNING \"id\", \"date_created\"").
+		RunWith(runner).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&r.Id, &r.DateCreated)
+}
+
+// GetRedactions lists the redactions applied to a message. Encrypted originals are not loaded.
+func GetRedactions(ctx context.Context, db *sql.DB, messageId int) ([]Redaction, error) {
+	rows, err := sq.Select("id", "message_id", "kind", "original IS NOT NULL", "date_created").
+		From("message_redactions").
+		Where(sq.Eq{"message_id": messageId}).
+		OrderBy("id").
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	redactions := []Redaction{}
+
+	for rows.Next() {
+		var r Redaction
+		if err := rows.Scan(&r.Id, &r.MessageId, &r.Kind, &r.Encrypted, &r.DateCreated); err != nil {
+			return nil, err
+		}
+		redactions = append(redactions, r)
+	}
+
+	return redactions, rows.Err()
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	sq "github.com/Masterminds/squirrel"
+	"sort"
+)
+
+// DeliverScheduledMessages makes up to limit scheduled messages which are due visible, returning
+// them in the order they were due. Each is given the next delivery sequence number, so that streams
+// resuming after an earlier message are sent it. Messages being delivered by other instances are
+// skipped. When events are recorded, each visible message's created event is recorded within the
+// same transaction.
+func DeliverScheduledMessages(ctx context.Context, db *sql.DB, storage Storage, limit int) ([]Message, error) {
+	var runner sq.BaseRunner = db
+	var tx *sql.Tx
+	if storage.recordsEvents() {
+		var err error
+		if tx, err = db.BeginTx(ctx, nil); err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		runner = tx
+	}
+
+	due := sq.Select("id").
+		From("messages").
+		// Delivery times are stored in UTC without a time zone
+		Where("scheduled AND deliver_at <= NOW() AT TIME ZONE 'UTC'").
+		OrderBy("deliver_at", "id").
+		Limit(uint64(limit)).
+		Suffix("FOR UPDATE SKIP LOCKED")
+
+	rows, err := sq.Update("messages").
+		Set("scheduled", false).
+		Set("delivery_seq", sq.Expr(deliverySeq)).
+		Where(sq.Expr("id IN (?)", due)).
+		Suffix("RETURNING id, value, ip_address, date_created, moderation_status, queue, deliver_at, key_id, owner").
+		RunWith(runner).
+		PlaceholderFormat(sq.Dollar).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []Message{}
+
+	for rows.Next() {
+		var m Message
+		var queue, keyId, owner sql.NullString
+		if err := rows.Scan(&m.Id, &m.Value, &m.IpAddress, &m.DateCreated, &m.Status, &queue, &m.DeliverAt, &keyId, &owner); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if m.Value, err = storage.openValue(m.Value, keyId, messageValue.row(int64(m.Id))); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		m.Queue = queue.String
+		m.Owner = owner.String
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		if !messages[i].DeliverAt.Equal(*messages[j].DeliverAt) {
+			return messages[i].DeliverAt.Before(*messages[j].DeliverAt)
+		}
+		return messages[i].Id < messages[j].Id
+	})
+
+	if !storage.recordsEvents() {
+		return messages, nil
+	}
+
+	for i := range messages {
+		if messages[i].visible() {
+			if err := recordEvent(ctx, tx, storage, EventCreated, &messages[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return messages, tx.Commit()
+}
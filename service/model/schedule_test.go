@@ -0,0 +1,89 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"time"
+)
+
+var scheduledColumns = []string{"id", "value", "ip_address", "date_created", "moderation_status", "queue", "deliver_at", "key_id", "owner"}
+
+func Test_ShouldCreateScheduledMessageWithoutRecordingIt(t *testing.T) {
+	storage := Storage{Outbox: true}
+
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	deliverAt, _ := time.Parse(time.RFC3339, "2017-06-25T15:00:00Z")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO messages \\(value,ip_address,moderation_status,moderation_reason,deliver_at,scheduled\\)").
+		WithArgs("hello", "127.0.0.1", "approved", "", deliverAt, true).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(11, time.Now()))
+	mock.ExpectCommit()
+
+	message := Message{Value: "hello", IpAddress: "127.0.0.1", DeliverAt: &deliverAt}
+
+	err = message.CreateMessage(context.Background(), db, storage, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err, "A scheduled message should only be recorded in the outbox once it is delivered")
+}
+
+func Test_ShouldDeliverDueMessagesInOrder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+	earlier, _ := time.Parse(time.RFC3339, "2017-06-25T15:00:00Z")
+	later := earlier.Add(time.Minute)
+
+	mock.ExpectQuery("UPDATE messages SET scheduled = \\$1, delivery_seq = nextval\\('messages_delivery_seq'\\) WHERE id IN \\(SELECT id FROM messages WHERE scheduled AND deliver_at <= NOW\\(\\) AT TIME ZONE 'UTC' " +
+		"ORDER BY deliver_at, id LIMIT 10 FOR UPDATE SKIP LOCKED\\) RETURNING id, value, ip_address, date_created, moderation_status, queue, deliver_at, key_id, owner").
+		WithArgs(false).
+		WillReturnRows(sqlmock.NewRows(scheduledColumns).
+		AddRow(3, "later", "10.0.0.1", dateCreated, "approved", nil, later, nil, nil).
+		AddRow(8, "earlier", "10.0.0.1", dateCreated, "approved", "orders", earlier, nil, nil))
+
+	messages, err := DeliverScheduledMessages(context.Background(), db, Storage{}, 10)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, len(messages), "Expected two messages to be delivered")
+	assert.Equal(t, 8, messages[0].Id, "Messages should be delivered in the order they were due")
+	assert.Equal(t, "orders", messages[0].Queue, "Queue was not mapped as expected")
+	assert.Equal(t, 3, messages[1].Id, "Messages should be delivered in the order they were due")
+}
+
+func Test_ShouldRecordDeliveredMessagesInOutbox(t *testing.T) {
+	storage := Storage{Outbox: true}
+
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+	deliverAt, _ := time.Parse(time.RFC3339, "2017-06-25T15:00:00Z")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE messages SET scheduled").
+		WillReturnRows(sqlmock.NewRows(scheduledColumns).
+		AddRow(11, "hello", "127.0.0.1", dateCreated, "approved", nil, deliverAt, nil, nil).
+		AddRow(12, "held", "127.0.0.1", dateCreated, "quarantined", nil, deliverAt, nil, nil))
+	mock.ExpectExec("INSERT INTO outbox").
+		WithArgs("created", 11, `{"event":"created","message_id":11,"ip_address":"127.0.0.1","message":{"id":11,"value":"hello","ip_address":"127.0.0.1","date_created":"2017-06-25T14:22:12.296925Z","status":"approved","deliver_at":"2017-06-25T15:00:00Z"}}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	messages, err := DeliverScheduledMessages(context.Background(), db, storage, 10)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err, "Only visible messages should be recorded in the outbox")
+
+	assert.Equal(t, 2, len(messages), "Expected both messages to be delivered")
+}
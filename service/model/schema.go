@@ -0,0 +1,54 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	sq "github.com/Masterminds/squirrel"
+	"strings"
+)
+
+// SchemaVersion is the schema version this build expects. Each schema change in
+// docker/postgres/init.sql records its version in the schema_migrations table.
+const SchemaVersion = 7
+
+// GetSchemaVersion returns the latest schema version applied to the database, or 0 if none has been.
+func GetSchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := sq.Select("MAX(version)").
+		From("schema_migrations").
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&version)
+
+	return int(version.Int64), err
+}
+
+// GetEventChannels returns the channels the triggers on the messages table send message events on,
+// which each trigger is given as its argument.
+func GetEventChannels(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := sq.Select("DISTINCT tgargs").
+		From("pg_trigger").
+		Where("tgrelid = 'messages'::regclass AND tgfoid = 'notify_message_change'::regproc").
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	channels := []string{}
+
+	for rows.Next() {
+		var args []byte
+		if err := rows.Scan(&args); err != nil {
+			return nil, err
+		}
+		// Each argument is terminated by a null byte
+		channels = append(channels, strings.Split(string(args), "\x00")[0])
+	}
+
+	return channels, rows.Err()
+}
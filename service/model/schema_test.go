@@ -0,0 +1,56 @@
+package model
+
+import (
+	"testing"
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ShouldGetSchemaVersion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT MAX\\(version\\) FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(3))
+
+	version, err := GetSchemaVersion(context.Background(), db)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 3, version, "Schema version was not mapped as expected")
+}
+
+func Test_ShouldReturnZeroSchemaVersionWhenNoneApplied(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT MAX\\(version\\) FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(nil))
+
+	version, err := GetSchemaVersion(context.Background(), db)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 0, version, "Expected no schema version")
+}
+
+func Test_ShouldGetEventChannelsFromTriggerArguments(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT DISTINCT tgargs FROM pg_trigger WHERE tgrelid = 'messages'::regclass AND tgfoid = 'notify_message_change'::regproc").
+		WillReturnRows(sqlmock.NewRows([]string{"tgargs"}).AddRow([]byte("message_events\x00")))
+
+	channels, err := GetEventChannels(context.Background(), db)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"message_events"}, channels, "Channel was not taken from the trigger argument")
+}
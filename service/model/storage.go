@@ -0,0 +1,23 @@
+package model
+
+// Storage controls how messages are stored, and is passed along with the database to each function
+// which reads or writes message values or records message events.
+type Storage struct {
+	// Cipher encrypts message values and outbox events at rest, and decrypts them as they are read.
+	// Values are stored in plain text when nil.
+	Cipher ValueCipher
+	// Originals encrypts the original values of redactions, which are not kept when it is nil.
+	Originals ValueCipher
+	// Outbox records an event in the outbox for each message created, moderated or deleted, within
+	// the same transaction as the change, so that no event is lost if publishing it fails.
+	Outbox bool
+	// Webhooks queues each event for delivery to the webhooks subscribed to it, within the same
+	// transaction as the change, so that no event is lost if the service stops straight after it.
+	Webhooks bool
+}
+
+// recordsEvents reports whether message events are recorded, and so whether changes to messages
+// are made in a transaction along with their events.
+func (s Storage) recordsEvents() bool {
+	return s.Outbox || s.Webhooks
+}
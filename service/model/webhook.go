@@ -0,0 +1,417 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryDead marks a delivery which failed too many times to be retried automatically.
+	DeliveryDead = "dead"
+)
+
+// WebhookFilter limits a webhook to events for messages containing Message and with an IP address
+// starting with Ip, as the message and ip parameters do for searches.
+type WebhookFilter struct {
+	Message string `json:"message"`
+	Ip      string `json:"ip"`
+}
+
+// matches reports whether an event for the message should be delivered. Deleted events are
+// delivered to every webhook subscribed to them, as the message is gone.
+func (f WebhookFilter) matches(event string, m *Message) bool {
+	if event == EventDeleted {
+		return true
+	}
+	return strings.Contains(m.Value, f.Message) && strings.HasPrefix(m.IpAddress, f.Ip)
+}
+
+type Webhook struct {
+	Id          int           `json:"id"`
+	Url         string        `json:"url"`
+	Events      []string      `json:"events"`
+	Filter      WebhookFilter `json:"filter"`
+	Secret      string        `json:"secret,omitempty"`
+	DateCreated time.Time     `json:"date_created"`
+}
+
+// webhookColumns are every column but the secret, which is only read to sign deliveries.
+var webhookColumns = []string{"id", "url", "events", "filter_message", "filter_ip", "date_created"}
+
+// GetWebhook loads a webhook without its secret.
+func (w *Webhook) GetWebhook(ctx context.Context, db *sql.DB) error {
+	return w.getWebhook(ctx, db)
+}
+
+func (w *Webhook) getWebhook(ctx context.Context, runner sq.BaseRunner) error {
+	return sq.Select(webhookColumns...).
+		From("webhooks").
+		Where(sq.Eq{"id": &w.Id}).
+		RunWith(runner).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&w.Id, &w.Url, pq.Array(&w.Events), &w.Filter.Message, &w.Filter.Ip, &w.DateCreated)
+}
+
+// CreateWebhook adds the webhook, recording the audit entry in the same transaction when it is not
+// nil. The secret is encrypted when the storage has a cipher.
+func (w *Webhook) CreateWebhook(ctx context.Context, db *sql.DB, storage Storage, audit *AuditEntry) error {
+	return audited(ctx, db, audit, func(runner sq.BaseRunner) error {
+		columns := []string{"url", "events", "filter_message", "filter_ip", "secret"}
+		values := []interface{}{w.Url, pq.Array(w.Events), w.Filter.Message, w.Filter.Ip, w.Secret}
+
+		if storage.Cipher != nil {
+			id, err := webhookSecret.nextId(ctx, runner)
+			if err != nil {
+				return err
+			}
+			sealed, err := storage.sealValue(w.Secret, webhookSecret.row(id))
+			if err != nil {
+				return err
+			}
+			values[4] = sealed
+			columns = append(columns, "id", "key_id")
+			values = append(values, id, storage.Cipher.ActiveKeyId())
+		}
+
+		err := sq.Insert("webhooks").
+			Columns(columns...).
+			Values(values...).
+			Suffix("RETURNING \"id\", \"date_created\"").
+			RunWith(runner).
+			PlaceholderFormat(sq.Dollar).
+			QueryRowContext(ctx).
+			Scan(&w.Id, &w.DateCreated)
+		if err != nil {
+			return err
+		}
+		return audit.snapshotAfter(ctx, runner, w.Id, webhookSnapshot)
+	})
+}
+
+// DeleteWebhook deletes a webhook along with its deliveries, returning sql.ErrNoRows if there is no
+// such webhook. The audit entry is recorded in the same transaction when it is not nil.
+func (w *Webhook) DeleteWebhook(ctx context.Context, db *sql.DB, audit *AuditEntry) error {
+	return audited(ctx, db, audit, func(runner sq.BaseRunner) error {
+		if err := audit.snapshotBefore(ctx, runner, w.Id, webhookSnapshot); err != nil {
+			return err
+		}
+
+		result, err := sq.Delete("webhooks").
+			Where(sq.Eq{"id": &w.Id}).
+			RunWith(runner).
+			PlaceholderFormat(sq.Dollar).
+			ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		if affected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+// GetWebhooks returns every webhook, without their secrets.
+func GetWebhooks(ctx context.Context, db *sql.DB) ([]Webhook, error) {
+	return queryWebhooks(ctx, sq.Select(webhookColumns...).
+		From("webhooks").
+		OrderBy("id").
+		RunWith(db))
+}
+
+func queryWebhooks(ctx context.Context, query sq.SelectBuilder) ([]Webhook, error) {
+	rows, err := query.PlaceholderFormat(sq.Dollar).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+
+	for rows.Next() {
+		var w Webhook
+		if err := rows.Scan(&w.Id, &w.Url, pq.Array(&w.Events), &w.Filter.Message, &w.Filter.Ip, &w.DateCreated); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// webhookSnapshot returns a webhook for the audit log, or nil if there is no such webhook. The
+// secret is left out.
+func webhookSnapshot(ctx context.Context, runner sq.BaseRunner, id int) (json.RawMessage, error) {
+	w := Webhook{Id: id}
+	err := w.getWebhook(ctx, runner)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return json.Marshal(w)
+}
+
+// WebhookDelivery is an event queued for delivery to a webhook, along with the outcome of its
+// latest attempt.
+type WebhookDelivery struct {
+	Id             int             `json:"id"`
+	WebhookId      int             `json:"webhook_id"`
+	Event          string          `json:"event"`
+	MessageId      int             `json:"message_id"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	ResponseStatus *int            `json:"response_status"`
+	LastError      string          `json:"last_error"`
+	DateCreated    time.Time       `json:"date_created"`
+	DateDelivered  *time.Time      `json:"date_delivered"`
+
+	// Url and Secret are those of the webhook, loaded when a delivery is claimed.
+	Url    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// webhookPayload is the body of each delivery. Deleted events have no message.
+type webhookPayload struct {
+	Event     string   `json:"event"`
+	MessageId int      `json:"message_id"`
+	Message   *Message `json:"message,omitempty"`
+}
+
+// queueWebhooks queues an event for a message to every webhook subscribed to it whose filter the
+// message matches, to be delivered as soon as possible.
+func queueWebhooks(ctx context.Context, runner sq.BaseRunner, storage Storage, event string, m *Message) error {
+	webhooks, err := queryWebhooks(ctx, sq.Select(webhookColumns...).
+		From("webhooks").
+		Where("? = ANY(events)", event).
+		OrderBy("id").
+		RunWith(runner))
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	p := webhookPayload{Event: event, MessageId: m.Id}
+	if event != EventDeleted {
+		message := *m
+		message.ModerationReason = ""
+		p.Message = &message
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	var deliveries []WebhookDelivery
+	for _, webhook := range webhooks {
+		if webhook.Filter.matches(event, m) {
+			deliveries = append(deliveries, WebhookDelivery{WebhookId: webhook.Id, Event: event, MessageId: m.Id, Payload: payload})
+		}
+	}
+	return insertWebhookDeliveries(ctx, runner, storage, deliveries)
+}
+
+// insertWebhookDeliveries queues deliveries to be attempted as soon as possible. Payloads are
+// encrypted when the storage has a cipher, as they include the message.
+func insertWebhookDeliveries(ctx context.Context, runner sq.BaseRunner, storage Storage, deliveries []WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	columns := []string{"webhook_id", "event", "message_id", "payload"}
+	if storage.Cipher != nil {
+		columns = append(columns, "id", "key_id")
+	}
+	query := sq.Insert("webhook_deliveries").Columns(columns...)
+	for _, d := range deliveries {
+		values := []interface{}{d.WebhookId, d.Event, d.MessageId, string(d.Payload)}
+		if storage.Cipher != nil {
+			id, err := deliveryPayload.nextId(ctx, runner)
+			if err != nil {
+				return err
+			}
+			sealed, err := storage.sealValue(string(d.Payload), deliveryPayload.row(id))
+			if err != nil {
+				return err
+			}
+			values[3] = sealed
+			values = append(values, id, storage.Cipher.ActiveKeyId())
+		}
+		query = query.Values(values...)
+	}
+
+	_, err := query.RunWith(runner).
+		PlaceholderFormat(sq.Dollar).
+		ExecContext(ctx)
+	return err
+}
+
+// ClaimWebhookDeliveries claims up to limit pending deliveries which are due, oldest first, along
+// with their webhook's URL and secret. Claimed deliveries are not due again until the lease has
+// passed, so that they are retried by any instance if the outcome is never recorded. Deliveries
+// claimed by other instances are skipped.
+func ClaimWebhookDeliveries(ctx context.Context, db *sql.DB, storage Storage, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	due := sq.Select("id").
+		From("webhook_deliveries").
+		Where(sq.Eq{"status": DeliveryPending}).
+		Where("next_attempt_at <= NOW()").
+		OrderBy("id").
+		Limit(uint64(limit)).
+		Suffix("FOR UPDATE SKIP LOCKED")
+
+	rows, err := sq.Update("webhook_deliveries").
+		Set("next_attempt_at", sq.Expr("NOW() + make_interval(secs => ?)", lease.Seconds())).
+		From("webhooks").
+		Where("webhooks.id = webhook_deliveries.webhook_id").
+		Where(sq.Expr("webhook_deliveries.id IN (?)", due)).
+		Suffix("RETURNING webhook_deliveries.id, webhook_id, event, message_id, payload, webhook_deliveries.key_id, attempts, " +
+			"url, secret, webhooks.key_id").
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+
+	for rows.Next() {
+		d := WebhookDelivery{Status: DeliveryPending}
+		var payload string
+		var keyId, secretKeyId sql.NullString
+		if err := rows.Scan(&d.Id, &d.WebhookId, &d.Event, &d.MessageId, &payload, &keyId, &d.Attempts, &d.Url, &d.Secret, &secretKeyId); err != nil {
+			return nil, err
+		}
+		if payload, err = storage.openValue(payload, keyId, deliveryPayload.row(int64(d.Id))); err != nil {
+			return nil, err
+		}
+		if d.Secret, err = storage.openValue(d.Secret, secretKeyId, webhookSecret.row(int64(d.WebhookId))); err != nil {
+			return nil, err
+		}
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// RecordWebhookAttempt records the outcome of an attempt to deliver. A delivery which is still
+// pending is next attempted after retryIn.
+func (d *WebhookDelivery) RecordWebhookAttempt(ctx context.Context, db *sql.DB, retryIn time.Duration) error {
+	query := sq.Update("webhook_deliveries").
+		Set("status", d.Status).
+		Set("attempts", d.Attempts).
+		Set("response_status", d.ResponseStatus).
+		Set("last_error", d.LastError)
+	if d.Status == DeliveryPending {
+		query = query.Set("next_attempt_at", sq.Expr("NOW() + make_interval(secs => ?)", retryIn.Seconds()))
+	}
+	if d.Status == DeliveryDelivered {
+		query = query.Set("date_delivered", sq.Expr("NOW()"))
+	}
+
+	_, err := query.Where(sq.Eq{"id": d.Id}).
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		ExecContext(ctx)
+	return err
+}
+
+// RetryWebhookDelivery queues a dead delivery to be attempted again as soon as possible, returning
+// sql.ErrNoRows if the webhook has no such dead delivery.
+func RetryWebhookDelivery(ctx context.Context, db *sql.DB, webhookId, id int) error {
+	result, err := sq.Update("webhook_deliveries").
+		Set("status", DeliveryPending).
+		Set("attempts", 0).
+		Set("next_attempt_at", sq.Expr("NOW()")).
+		Where(sq.Eq{"id": id, "webhook_id": webhookId, "status": DeliveryDead}).
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+var webhookDeliveryColumns = []string{"id", "webhook_id", "event", "message_id", "payload", "key_id", "status", "attempts",
+	"next_attempt_at", "response_status", "last_error", "date_created", "date_delivered"}
+
+// GetWebhookDeliveries retrieves a page of a webhook's deliveries, newest first, optionally only
+// those with the given status.
+func GetWebhookDeliveries(ctx context.Context, db *sql.DB, storage Storage, webhookId int, status string, offset, limit int) (*Page, error) {
+	conditions := sq.And{sq.Eq{"webhook_id": webhookId}}
+	if status != "" {
+		conditions = append(conditions, sq.Eq{"status": status})
+	}
+
+	var totalCount int
+	err := sq.Select("COUNT(id)").
+		From("webhook_deliveries").
+		Where(conditions).
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		QueryRowContext(ctx).
+		Scan(&totalCount)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sq.Select(webhookDeliveryColumns...).
+		From("webhook_deliveries").
+		Where(conditions).
+		OrderBy("id DESC").
+		Limit(uint64(limit)).
+		Offset(uint64(offset)).
+		RunWith(db).
+		PlaceholderFormat(sq.Dollar).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload string
+		var keyId sql.NullString
+		if err := rows.Scan(&d.Id, &d.WebhookId, &d.Event, &d.MessageId, &payload, &keyId, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.ResponseStatus, &d.LastError, &d.DateCreated, &d.DateDelivered); err != nil {
+			return nil, err
+		}
+		if payload, err = storage.openValue(payload, keyId, deliveryPayload.row(int64(d.Id))); err != nil {
+			return nil, err
+		}
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &Page{offset, limit, totalCount, deliveries}, nil
+}
@@ -0,0 +1,164 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"time"
+)
+
+func Test_ShouldCreateNewWebhook(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, err := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+	events, _ := pq.Array([]string{"created", "deleted"}).Value()
+
+	mock.ExpectQuery("INSERT INTO webhooks").
+		WithArgs("https://example.com/hooks", events, "hello", "10.0.", "shh").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(3, dateCreated))
+
+	webhook := Webhook{Url: "https://example.com/hooks", Events: []string{"created", "deleted"}, Filter: WebhookFilter{"hello", "10.0."}, Secret: "shh"}
+
+	err = webhook.CreateWebhook(context.Background(), db, Storage{}, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 3, webhook.Id, "Webhook Id was not mapped as expected")
+	assert.Equal(t, dateCreated, webhook.DateCreated, "Webhook date created was not mapped as expected")
+}
+
+func Test_ShouldEncryptWebhookSecrets(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	keyring := newTestKeyring(t, "new")
+
+	expectNextId(mock, "webhooks", 3)
+	mock.ExpectQuery("INSERT INTO webhooks \\(url,events,filter_message,filter_ip,secret,id,key_id\\)").
+		WithArgs("https://example.com/hooks", sqlmock.AnyArg(), "", "", sealedValue{keyring, "shh", webhookSecret.row(3)}, 3, "new").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(3, time.Now()))
+
+	webhook := Webhook{Url: "https://example.com/hooks", Events: []string{"created"}, Secret: "shh"}
+
+	err = webhook.CreateWebhook(context.Background(), db, Storage{Cipher: keyring}, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldQueueDeletionToEveryWebhookSubscribedInTransaction(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	payload := `{"event":"deleted","message_id":11}`
+	mock.ExpectBegin()
+	mock.ExpectQuery("DELETE FROM messages").
+		WithArgs(11).
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address", "owner", "moderation_status", "scheduled"}).AddRow("127.0.0.1", nil, "approved", false))
+	mock.ExpectQuery("SELECT (.+) FROM webhooks WHERE \\$1 = ANY\\(events\\) ORDER BY id").
+		WithArgs("deleted").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "url", "events", "filter_message", "filter_ip", "date_created"}).
+			AddRow(1, "https://example.com/hello", "{deleted}", "hello", "", time.Now()).
+			AddRow(2, "https://example.com/other", "{created,deleted}", "", "10.", time.Now()))
+	mock.ExpectExec("INSERT INTO webhook_deliveries \\(webhook_id,event,message_id,payload\\) VALUES \\(\\$1,\\$2,\\$3,\\$4\\),\\(\\$5,\\$6,\\$7,\\$8\\)").
+		WithArgs(1, "deleted", 11, payload, 2, "deleted", 11, payload).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	message := Message{Id: 11}
+
+	_, err = message.DeleteMessage(context.Background(), db, Storage{Webhooks: true}, nil)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func Test_ShouldEncryptWebhookDeliveryPayloads(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	keyring := newTestKeyring(t, "new")
+	storage := Storage{Cipher: keyring}
+
+	payload := `{"event":"created","message_id":11,"message":{"id":11,"value":"hello","ip_address":"127.0.0.1","date_created":"0001-01-01T00:00:00Z","status":"approved"}}`
+	mock.ExpectQuery("SELECT (.+) FROM webhooks").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "url", "events", "filter_message", "filter_ip", "date_created"}).
+			AddRow(1, "https://example.com/hooks", "{created}", "", "", time.Now()))
+	expectNextId(mock, "webhook_deliveries", 7)
+	mock.ExpectExec("INSERT INTO webhook_deliveries \\(webhook_id,event,message_id,payload,id,key_id\\) VALUES \\(\\$1,\\$2,\\$3,\\$4,\\$5,\\$6\\)").
+		WithArgs(1, "created", 11, sealedValue{keyring, payload, deliveryPayload.row(7)}, 7, "new").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("UPDATE webhook_deliveries").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "webhook_id", "event", "message_id", "payload", "key_id", "attempts", "url", "secret", "key_id"}).
+			AddRow(7, 1, "created", 11, sealTestValue(t, keyring, payload, deliveryPayload.row(7)), "new", 0, "https://example.com/hooks",
+				sealTestValue(t, keyring, "shh", webhookSecret.row(1)), "new"))
+
+	message := Message{Id: 11, Value: "hello", IpAddress: "127.0.0.1", Status: "approved"}
+	err = queueWebhooks(context.Background(), db, storage, EventCreated, &message)
+	assert.Nil(t, err)
+
+	deliveries, err := ClaimWebhookDeliveries(context.Background(), db, storage, 10, 30*time.Second)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, payload, string(deliveries[0].Payload), "Claimed payload was not decrypted")
+	assert.Equal(t, "shh", deliveries[0].Secret, "Claimed secret was not decrypted")
+}
+
+func Test_ShouldClaimDueWebhookDeliveries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("UPDATE webhook_deliveries SET next_attempt_at = NOW\\(\\) \\+ make_interval\\(secs => \\$1\\) FROM webhooks " +
+		"WHERE webhooks.id = webhook_deliveries.webhook_id AND webhook_deliveries.id IN \\(SELECT id FROM webhook_deliveries WHERE status = \\$2 AND next_attempt_at <= NOW\\(\\) ORDER BY id LIMIT 10 FOR UPDATE SKIP LOCKED\\)").
+		WithArgs(float64(30), "pending").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "webhook_id", "event", "message_id", "payload", "key_id", "attempts", "url", "secret", "key_id"}).
+			AddRow(7, 3, "created", 11, `{"event":"created"}`, nil, 2, "https://example.com/hooks", "shh", nil))
+
+	deliveries, err := ClaimWebhookDeliveries(context.Background(), db, Storage{}, 10, 30*time.Second)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, []WebhookDelivery{{Id: 7, WebhookId: 3, Event: "created", MessageId: 11, Payload: json.RawMessage(`{"event":"created"}`),
+		Status: DeliveryPending, Attempts: 2, Url: "https://example.com/hooks", Secret: "shh"}}, deliveries, "Claimed deliveries not as expected")
+}
+
+func Test_ShouldRetrieveWebhookDeliveriesWithStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	dateCreated, err := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectQuery("SELECT COUNT\\(id\\) FROM webhook_deliveries WHERE \\(webhook_id = \\$1 AND status = \\$2\\)").
+		WithArgs(3, "dead").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("SELECT (.+) FROM webhook_deliveries WHERE \\(webhook_id = \\$1 AND status = \\$2\\) ORDER BY id DESC LIMIT 20 OFFSET 0").
+		WithArgs(3, "dead").
+		WillReturnRows(sqlmock.NewRows(webhookDeliveryColumns).
+			AddRow(7, 3, "created", 11, `{}`, nil, "dead", 8, dateCreated, 503, "Webhook responded with 503 Service Unavailable", dateCreated, nil))
+
+	page, err := GetWebhookDeliveries(context.Background(), db, Storage{}, 3, DeliveryDead, 0, 20)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	deliveries := page.Results.([]WebhookDelivery)
+	assert.Equal(t, 1, page.TotalCount, "Total count not as expected")
+	assert.Equal(t, 503, *deliveries[0].ResponseStatus, "Response status was not mapped as expected")
+	assert.Nil(t, deliveries[0].DateDelivered, "Dead delivery should not have a delivery date")
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"amigo-tech-test/service/model"
+	"amigo-tech-test/service/moderation"
+	"context"
+	"database/sql"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+func (sr *MessageServiceRouter) getModerationQueue(w http.ResponseWriter, r *http.Request) {
+	offset, limit := getPaging(r.URL.Query(), sr.current().Paging)
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Search)
+	defer cancel()
+
+	var result *model.Page
+	err := sr.read(ctx, func(ctx context.Context) (err error) {
+		result, err = model.SearchModerationQueue(ctx, sr.db, sr.Storage, offset, limit)
+		return err
+	})
+	if err != nil {
+		respondWithStoreError(w, ctx, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, result)
+}
+
+func (sr *MessageServiceRouter) approveMessage(w http.ResponseWriter, r *http.Request) {
+	sr.moderateMessage(w, r, moderation.StatusApproved)
+}
+
+func (sr *MessageServiceRouter) rejectMessage(w http.ResponseWriter, r *http.Request) {
+	sr.moderateMessage(w, r, moderation.StatusRejected)
+}
+
+func (sr *MessageServiceRouter) moderateMessage(w http.ResponseWriter, r *http.Request, status string) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["Id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Write)
+	defer cancel()
+
+	m := model.Message{Id: id}
+	audit := sr.auditEntry(r, auditUpdate, auditMessage, id)
+	var event string
+	err = sr.write(ctx, func(ctx context.Context) (err error) {
+		event, err = m.UpdateModerationStatus(ctx, sr.db, sr.Storage, status, audit)
+		return err
+	})
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Message not awaiting moderation")
+		default:
+			respondWithStoreError(w, ctx, err)
+		}
+		return
+	}
+
+	if event != "" {
+		sr.publishEvent(r, event, id)
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success", "status": m.Status})
+}
@@ -0,0 +1,87 @@
+package moderation
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// WordBlocklist matches messages containing any of the listed words. Words are compared after
+// stemming, so blocking "spam" also matches "spamming" and "spammed".
+type WordBlocklist struct {
+	action Action
+	stems  map[string]string
+}
+
+func NewWordBlocklist(action Action, words ...string) *WordBlocklist {
+	stems := make(map[string]string, len(words))
+	for _, word := range words {
+		stems[stem(strings.ToLower(word))] = word
+	}
+	return &WordBlocklist{action, stems}
+}
+
+func (b *WordBlocklist) Check(value string) (Action, string) {
+	words := strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if blocked, ok := b.stems[stem(word)]; ok {
+			return b.action, fmt.Sprintf("Contains blocked word %q", blocked)
+		}
+	}
+	return Allow, ""
+}
+
+// RegexRule matches messages containing the pattern.
+type RegexRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Action  Action
+}
+
+func (rule *RegexRule) Check(value string) (Action, string) {
+	if rule.Pattern.MatchString(value) {
+		return rule.Action, fmt.Sprintf("Matches rule %q", rule.Name)
+	}
+	return Allow, ""
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// LinkLimit matches messages containing more than Max links.
+type LinkLimit struct {
+	Max    int
+	Action Action
+}
+
+func (limit *LinkLimit) Check(value string) (Action, string) {
+	if count := len(linkPattern.FindAllStringIndex(value, -1)); count > limit.Max {
+		return limit.Action, fmt.Sprintf("Contains %d links (maximum %d)", count, limit.Max)
+	}
+	return Allow, ""
+}
+
+// RepeatedCharacters matches messages where the same character is repeated more than Max times in a
+// row, e.g. "!!!!!!!!!!!!" or "heeeeeeeeeeey".
+type RepeatedCharacters struct {
+	Max    int
+	Action Action
+}
+
+func (limit *RepeatedCharacters) Check(value string) (Action, string) {
+	var previous rune
+	run := 0
+	for _, r := range value {
+		if r == previous {
+			run++
+		} else {
+			previous, run = r, 1
+		}
+		if run > limit.Max && !unicode.IsSpace(r) {
+			return limit.Action, fmt.Sprintf("Repeats %q more than %d times", r, limit.Max)
+		}
+	}
+	return Allow, ""
+}
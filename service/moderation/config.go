@@ -0,0 +1,64 @@
+package moderation
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Config describes the checks to build into a pipeline, as read from the "moderation" section of
+// conf.json. Checks without a configured action are left out.
+type Config struct {
+	Blocklist struct {
+		Words  []string `mapstructure:"words"`
+		Action string   `mapstructure:"action"`
+	} `mapstructure:"blocklist"`
+	Rules []struct {
+		Name    string `mapstructure:"name"`
+		Pattern string `mapstructure:"pattern"`
+		Action  string `mapstructure:"action"`
+	} `mapstructure:"rules"`
+	Links struct {
+		Max    int    `mapstructure:"max"`
+		Action string `mapstructure:"action"`
+	} `mapstructure:"links"`
+	RepeatedCharacters struct {
+		Max    int    `mapstructure:"max"`
+		Action string `mapstructure:"action"`
+	} `mapstructure:"repeated_characters"`
+}
+
+func NewPipelineFromConfig(config Config) (*Pipeline, error) {
+	var checks []Check
+
+	if action, err := ParseAction(config.Blocklist.Action); err != nil {
+		return nil, err
+	} else if action != Allow && len(config.Blocklist.Words) > 0 {
+		checks = append(checks, NewWordBlocklist(action, config.Blocklist.Words...))
+	}
+
+	for _, rule := range config.Rules {
+		action, err := ParseAction(rule.Action)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern for moderation rule %q: %s", rule.Name, err)
+		}
+		checks = append(checks, &RegexRule{rule.Name, pattern, action})
+	}
+
+	if action, err := ParseAction(config.Links.Action); err != nil {
+		return nil, err
+	} else if action != Allow {
+		checks = append(checks, &LinkLimit{config.Links.Max, action})
+	}
+
+	if action, err := ParseAction(config.RepeatedCharacters.Action); err != nil {
+		return nil, err
+	} else if action != Allow && config.RepeatedCharacters.Max > 0 {
+		checks = append(checks, &RepeatedCharacters{config.RepeatedCharacters.Max, action})
+	}
+
+	return NewPipeline(checks...), nil
+}
@@ -0,0 +1,88 @@
+package moderation
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Action is the outcome of moderating a message. Actions are ordered by severity, so that when
+// several checks match a message the most severe action is taken.
+type Action int
+
+const (
+	Allow Action = iota
+	Flag
+	Quarantine
+	Reject
+)
+
+// Message moderation statuses, stored against each message.
+const (
+	StatusApproved    = "approved"
+	StatusFlagged     = "flagged"
+	StatusQuarantined = "quarantined"
+	StatusRejected    = "rejected"
+)
+
+func ParseAction(value string) (Action, error) {
+	switch strings.ToLower(value) {
+	case "", "allow":
+		return Allow, nil
+	case "flag":
+		return Flag, nil
+	case "quarantine":
+		return Quarantine, nil
+	case "reject":
+		return Reject, nil
+	}
+	return Allow, fmt.Errorf("Unknown moderation action %q", value)
+}
+
+// Status returns the moderation status a message should be stored with following this action.
+func (a Action) Status() string {
+	switch a {
+	case Flag:
+		return StatusFlagged
+	case Quarantine:
+		return StatusQuarantined
+	case Reject:
+		return StatusRejected
+	}
+	return StatusApproved
+}
+
+// Check inspects a message value, returning the action to take and the reason for it. Checks which
+// find nothing wrong should return Allow.
+type Check interface {
+	Check(value string) (Action, string)
+}
+
+type Result struct {
+	Action  Action
+	Reasons []string
+}
+
+type Pipeline struct {
+	checks []Check
+}
+
+func NewPipeline(checks ...Check) *Pipeline {
+	return &Pipeline{checks}
+}
+
+// Moderate runs every check against the value, returning the most severe action along with the
+// reasons given by each check which matched.
+func (p *Pipeline) Moderate(value string) Result {
+	result := Result{Action: Allow}
+	for _, check := range p.checks {
+		action, reason := check.Check(value)
+		if action == Allow {
+			continue
+		}
+		if action > result.Action {
+			result.Action = action
+		}
+		result.Reasons = append(result.Reasons, reason)
+	}
+	return result
+}
@@ -0,0 +1,95 @@
+package moderation
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+)
+
+func Test_ShouldTakeMostSevereActionAndCollectReasons(t *testing.T) {
+	pipeline := NewPipeline(
+		&LinkLimit{Max: 0, Action: Flag},
+		NewWordBlocklist(Quarantine, "spam"),
+		&RepeatedCharacters{Max: 3, Action: Allow})
+
+	result := pipeline.Moderate("Spamming http://example.com !!!!!!")
+
+	assert.Equal(t, Quarantine, result.Action, "Most severe action was not taken")
+	assert.Equal(t, []string{"Contains 1 links (maximum 0)", "Contains blocked word \"spam\""}, result.Reasons, "Reasons not as expected")
+}
+
+func Test_ShouldAllowMessageWhenNoChecksMatch(t *testing.T) {
+	result := NewPipeline(NewWordBlocklist(Reject, "spam")).Moderate("A perfectly normal message")
+
+	assert.Equal(t, Allow, result.Action, "Message should have been allowed")
+	assert.Empty(t, result.Reasons)
+}
+
+func Test_ShouldMatchBlockedWordsAfterStemming(t *testing.T) {
+	blocklist := NewWordBlocklist(Reject, "spam", "hate")
+
+	for _, value := range []string{"SPAMS", "stop spammed me", "spammer!", "I hated it", "hates"} {
+		action, _ := blocklist.Check(value)
+		assert.Equal(t, Reject, action, "Expected %q to match the blocklist", value)
+	}
+
+	action, _ := blocklist.Check("spare heat")
+	assert.Equal(t, Allow, action, "Unrelated words should not match the blocklist")
+}
+
+func Test_ShouldNotMatchWordsSharingOnlyPartOfAStem(t *testing.T) {
+	blocklist := NewWordBlocklist(Reject, "hate")
+
+	for value, expected := range map[string]Action{
+		"hat":    Allow,
+		"hatter": Allow,
+		"need":   Allow,
+		"hating": Reject,
+		"hater":  Reject,
+	} {
+		action, _ := blocklist.Check(value)
+		assert.Equal(t, expected, action, "Unexpected action for %q", value)
+	}
+}
+
+func Test_ShouldMatchRegexRule(t *testing.T) {
+	rule := &RegexRule{"card number", regexp.MustCompile(`\d{4} \d{4}`), Flag}
+
+	action, reason := rule.Check("my card is 1234 5678")
+
+	assert.Equal(t, Flag, action)
+	assert.Equal(t, "Matches rule \"card number\"", reason)
+}
+
+func Test_ShouldIgnoreRepeatedWhitespace(t *testing.T) {
+	check := &RepeatedCharacters{Max: 3, Action: Reject}
+
+	action, _ := check.Check("indented        text")
+	assert.Equal(t, Allow, action, "Repeated whitespace should be allowed")
+
+	action, reason := check.Check("heeeeey")
+	assert.Equal(t, Reject, action)
+	assert.Equal(t, "Repeats 'e' more than 3 times", reason)
+}
+
+func Test_ShouldBuildPipelineFromConfig(t *testing.T) {
+	var config Config
+	config.Blocklist.Words = []string{"spam"}
+	config.Blocklist.Action = "reject"
+	config.Links.Max = 1
+	config.Links.Action = "flag"
+
+	pipeline, err := NewPipelineFromConfig(config)
+	assert.Nil(t, err)
+
+	assert.Equal(t, Reject, pipeline.Moderate("spam").Action)
+	assert.Equal(t, Flag, pipeline.Moderate("www.a.com www.b.com").Action)
+}
+
+func Test_ShouldFailToBuildPipelineDueToInvalidConfig(t *testing.T) {
+	var config Config
+	config.Links.Action = "explode"
+
+	_, err := NewPipelineFromConfig(config)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,65 @@
+package moderation
+
+import "strings"
+
+// stem reduces a lower case English word to an approximate root by removing common inflectional
+// suffixes. It loosely follows the first steps of the Porter stemmer, which is enough to match
+// plurals and verb forms against a blocklist without pulling in a full stemming library.
+func stem(word string) string {
+	if len(word) <= 3 {
+		return word
+	}
+
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ss"):
+	case strings.HasSuffix(word, "s"):
+		word = word[:len(word)-1]
+	}
+
+	for _, suffix := range []string{"ing", "ed", "er"} {
+		root := strings.TrimSuffix(word, suffix)
+		if root == word || !containsVowel(root) {
+			continue
+		}
+
+		// Undo the consonant doubling of e.g. "spamming" -> "spamm", or restore the e removed from
+		// a short root, so that "hated" shares the stem of "hate" but "hatter" does not
+		if n := len(root); n > 2 && root[n-1] == root[n-2] && !strings.ContainsRune("lsz", rune(root[n-1])) {
+			root = root[:n-1]
+		} else if endsInShortSyllable(root) {
+			root += "e"
+		}
+		word = root
+		break
+	}
+	return word
+}
+
+func containsVowel(word string) bool {
+	return strings.ContainsAny(word, "aeiouy")
+}
+
+// endsInShortSyllable reports whether the word is a single syllable ending consonant, vowel,
+// consonant, as in "hat" or "lov", where the last consonant is not w, x or y.
+func endsInShortSyllable(word string) bool {
+	n := len(word)
+	if n < 3 || strings.ContainsRune("wxy", rune(word[n-1])) {
+		return false
+	}
+	return !isVowel(word, n-3) && isVowel(word, n-2) && !isVowel(word, n-1) && !containsVowel(word[:n-2])
+}
+
+// isVowel reports whether the letter at i is a vowel, counting y as one when it follows a consonant.
+func isVowel(word string, i int) bool {
+	switch word[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return true
+	case 'y':
+		return i > 0 && !isVowel(word, i-1)
+	}
+	return false
+}
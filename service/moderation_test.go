@@ -0,0 +1,81 @@
+package service
+
+import (
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"amigo-tech-test/service/moderation"
+	"net/http"
+	"bytes"
+)
+
+func Test_ShouldRejectMessageFailingModeration(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Moderator: moderation.NewPipeline(moderation.NewWordBlocklist(moderation.Reject, "spam"))}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Buy spam now")))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Message rejected by moderation\",\"reasons\":[\"Contains blocked word \\\"spam\\\"\"]}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldQuarantineMessageFailingModeration(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Moderator: moderation.NewPipeline(&moderation.RepeatedCharacters{Max: 3, Action: moderation.Quarantine})}).NewServiceRouter(db)
+
+	mock.ExpectQuery("INSERT INTO messages").
+		WithArgs("heeeeey", "", "quarantined", "Repeats 'e' more than 3 times").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(22))
+
+	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("heeeeey")))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusAccepted, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"id\":22,\"status\":\"quarantined\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldApproveMessageAwaitingModeration(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: testAdmin}).NewServiceRouter(db)
+
+	mock.ExpectQuery("UPDATE messages").
+		WithArgs("approved", "quarantined", 22).
+		WillReturnRows(sqlmock.NewRows([]string{"moderation_status", "ip_address", "owner"}).AddRow("flagged", "127.0.0.1", nil))
+
+	req, _ := http.NewRequest("POST", "/admin/moderation/22/approve", nil)
+	response := executeAdminRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "{\"result\":\"success\",\"status\":\"approved\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldFailToRejectMessageNotAwaitingModeration(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: testAdmin}).NewServiceRouter(db)
+
+	mock.ExpectQuery("UPDATE messages").
+		WithArgs("rejected", 22).
+		WillReturnRows(sqlmock.NewRows([]string{"moderation_status", "ip_address", "owner"}))
+
+	req, _ := http.NewRequest("POST", "/admin/moderation/22/reject", nil)
+	response := executeAdminRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusNotFound, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Message not awaiting moderation\"}", response.Body.String(), "Response body does not match expected value")
+}
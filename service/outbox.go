@@ -0,0 +1,128 @@
+package service
+
+import (
+	"amigo-tech-test/service/model"
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	defaultOutboxPollInterval = time.Second
+	defaultOutboxBatchSize    = 100
+	defaultOutboxTimeout      = 30 * time.Second
+	defaultOutboxRetention    = 24 * time.Hour
+
+	// outboxPruneInterval is how often events sent longer ago than the retention period are deleted.
+	outboxPruneInterval = time.Hour
+)
+
+// Publisher sends the events relayed from the outbox to other systems.
+type Publisher interface {
+	// Publish sends an event's JSON payload, returning an error if it may not have been sent. The event
+	// ID is unique to the event, so that consumers can discard any published more than once.
+	Publish(ctx context.Context, eventId, event string, messageId int, payload []byte) error
+}
+
+// Outbox controls how events recorded in the outbox are relayed to the Publisher.
+type Outbox struct {
+	// PollInterval is how often the outbox is checked for events recorded by other instances,
+	// defaulting to a second. Events recorded by this instance are relayed straight away.
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	// BatchSize is how many events are relayed in each transaction, defaulting to 100.
+	BatchSize int `mapstructure:"batch_size"`
+	// Timeout bounds each batch, defaulting to 30 seconds. Events in a batch which times out are
+	// published again.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Retention is how long sent events are kept before they are deleted, defaulting to a day.
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+func (o Outbox) pollInterval() time.Duration {
+	return orDefault(o.PollInterval, defaultOutboxPollInterval)
+}
+
+func (o Outbox) batchSize() int {
+	return orDefault(o.BatchSize, defaultOutboxBatchSize)
+}
+
+func (o Outbox) timeout() time.Duration {
+	return orDefault(o.Timeout, defaultOutboxTimeout)
+}
+
+func (o Outbox) retention() time.Duration {
+	return orDefault(o.Retention, defaultOutboxRetention)
+}
+
+// wakeRelay relays the outbox without waiting for the next poll, after this instance records an event.
+func (sr *MessageServiceRouter) wakeRelay() {
+	select {
+	case sr.relayWake <- struct{}{}:
+	default:
+	}
+}
+
+func (sr *MessageServiceRouter) relayOutbox(ctx context.Context) {
+	pollBatches(ctx, sr.Outbox.pollInterval(), sr.relayWake, sr.Outbox.batchSize(), sr.relayOutboxBatch)
+}
+
+// relayOutboxBatch publishes a batch of events from the outbox in order, returning how many were
+// published or parked. A batch which has started is finished even if shutdown begins.
+func (sr *MessageServiceRouter) relayOutboxBatch(ctx context.Context) int {
+	ctx, cancel := withTimeout(context.WithoutCancel(ctx), sr.Outbox.timeout())
+	defer cancel()
+
+	var sent, parked int
+	var publishErr error
+	err := sr.write(ctx, func(ctx context.Context) (err error) {
+		sent, parked, err = model.RelayOutbox(ctx, sr.db, sr.Storage, sr.Outbox.batchSize(), func(ctx context.Context, event model.OutboxEvent) error {
+			publishErr = sr.Publisher.Publish(ctx, event.EventId, event.Event, event.MessageId, event.Payload)
+			return publishErr
+		})
+		// Failing to publish says nothing about the health of the database
+		if err == publishErr {
+			return nil
+		}
+		return err
+	})
+	if parked > 0 {
+		slog.ErrorContext(ctx, "Parked outbox events which could not be decrypted, they will not be published", "parked", parked)
+	}
+	if err == nil {
+		err = publishErr
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to relay outbox events, they will be retried", "error", err, "published", sent)
+	}
+	return sent + parked
+}
+
+func (sr *MessageServiceRouter) pruneOutboxPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(outboxPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sr.pruneOutbox(ctx)
+	}
+}
+
+func (sr *MessageServiceRouter) pruneOutbox(ctx context.Context) {
+	ctx, cancel := withTimeout(ctx, sr.current().Timeouts.Write)
+	defer cancel()
+
+	err := sr.write(ctx, func(ctx context.Context) error {
+		pruned, err := model.PruneOutbox(ctx, sr.db, sr.Outbox.retention())
+		if pruned > 0 {
+			slog.InfoContext(ctx, "Pruned sent outbox events", "count", pruned)
+		}
+		return err
+	})
+	if err != nil && ctx.Err() == nil {
+		slog.ErrorContext(ctx, "Unable to prune sent outbox events", "error", err)
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type publishedEvent struct {
+	EventId   string
+	Event     string
+	MessageId int
+	Payload   string
+}
+
+// fakePublisher records the events it publishes, failing with err when set.
+type fakePublisher struct {
+	published []publishedEvent
+	err       error
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, eventId, event string, messageId int, payload []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, publishedEvent{eventId, event, messageId, string(payload)})
+	return nil
+}
+
+// newRelayRouter routes requests with the outbox relayed to the publisher. The outbox is never polled
+// during a test, which relays batches itself.
+func newRelayRouter(t *testing.T, sr *MessageServiceRouter, db *sql.DB) *MessageServiceRouter {
+	sr.Outbox.PollInterval = time.Hour
+	router = sr.NewServiceRouter(db)
+	t.Cleanup(func() { sr.Shutdown(context.Background()) })
+	return sr
+}
+
+func expectOutboxBatch(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT pg_try_advisory_xact_lock").
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("SELECT (.+) FROM outbox WHERE date_sent IS NULL AND date_parked IS NULL AND txid < (.+) ORDER BY id").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_id", "event", "message_id", "payload", "key_id", "date_created"}).
+			AddRow(1, "a5e0c5f2-7f43-4d0c-8a4e-1b2f0c9d3e11", "created", 11, `{"event":"created","message_id":11}`, nil, time.Now()).
+			AddRow(2, "0c1d2e3f-4a5b-4c6d-8e7f-9a0b1c2d3e4f", "deleted", 11, `{"event":"deleted","message_id":11}`, nil, time.Now()))
+}
+
+func Test_ShouldPublishOutboxEvents(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	publisher := &fakePublisher{}
+	sr := newRelayRouter(t, &MessageServiceRouter{Publisher: publisher}, db)
+
+	expectOutboxBatch(mock)
+	mock.ExpectExec("UPDATE outbox SET date_sent = NOW\\(\\) WHERE id IN \\(\\$1,\\$2\\)").
+		WithArgs(int64(1), int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	assert.Equal(t, 2, sr.relayOutboxBatch(context.Background()), "Both events should be published")
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, []publishedEvent{
+		{"a5e0c5f2-7f43-4d0c-8a4e-1b2f0c9d3e11", "created", 11, `{"event":"created","message_id":11}`},
+		{"0c1d2e3f-4a5b-4c6d-8e7f-9a0b1c2d3e4f", "deleted", 11, `{"event":"deleted","message_id":11}`},
+	}, publisher.published, "Events should be published in order")
+}
+
+func Test_ShouldNotOpenCircuitBreakerWhenPublishingFails(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	publisher := &fakePublisher{err: context.DeadlineExceeded}
+	sr := newRelayRouter(t, &MessageServiceRouter{Publisher: publisher, Resilience: Resilience{BreakerThreshold: 1, BreakerCooldown: time.Minute}}, db)
+
+	expectOutboxBatch(mock)
+	mock.ExpectCommit()
+
+	assert.Equal(t, 0, sr.relayOutboxBatch(context.Background()), "No events should be published")
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Nil(t, sr.breaker.allow(), "A publisher timing out should not count against the database")
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"amigo-tech-test/service/model"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultVisibilityTimeout = 30 * time.Second
+	defaultMaxDeliveries     = 5
+	defaultDeadLetterSuffix  = ".dead-letter"
+	defaultMaxClaim          = 10
+)
+
+// Queues controls how messages posted to queues are claimed and delivered again.
+type Queues struct {
+	// VisibilityTimeout is how long a claimed message is leased before it can be claimed again,
+	// defaulting to 30 seconds.
+	VisibilityTimeout time.Duration `mapstructure:"visibility_timeout"`
+	// MaxDeliveries is how many times a message is claimed before it is moved to the dead-letter
+	// queue, defaulting to 5.
+	MaxDeliveries int `mapstructure:"max_deliveries"`
+	// DeadLetterSuffix names a queue's dead-letter queue, defaulting to ".dead-letter".
+	DeadLetterSuffix string `mapstructure:"dead_letter_suffix"`
+	// MaxClaim is how many messages may be claimed at once, defaulting to 10.
+	MaxClaim int `mapstructure:"max_claim"`
+}
+
+func (q Queues) visibilityTimeout() time.Duration {
+	if q.VisibilityTimeout <= 0 {
+		return defaultVisibilityTimeout
+	}
+	return q.VisibilityTimeout
+}
+
+func (q Queues) policy() model.QueuePolicy {
+	policy := model.QueuePolicy{MaxDeliveries: q.MaxDeliveries, DeadLetterSuffix: q.DeadLetterSuffix}
+	if policy.MaxDeliveries < 1 {
+		policy.MaxDeliveries = defaultMaxDeliveries
+	}
+	if policy.DeadLetterSuffix == "" {
+		policy.DeadLetterSuffix = defaultDeadLetterSuffix
+	}
+	return policy
+}
+
+func (q Queues) maxClaim() int {
+	if q.MaxClaim < 1 {
+		return defaultMaxClaim
+	}
+	return q.MaxClaim
+}
+
+func (sr *MessageServiceRouter) claimMessages(w http.ResponseWriter, r *http.Request) {
+	queue := mux.Vars(r)["Name"]
+
+	limit, err := strconv.Atoi(getQueryParamOrDefault(r.URL.Query(), "limit", "1"))
+	if err != nil || limit < 1 {
+		respondWithError(w, http.StatusBadRequest, "Invalid limit")
+		return
+	}
+	if limit > sr.Queues.maxClaim() {
+		limit = sr.Queues.maxClaim()
+	}
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Write)
+	defer cancel()
+
+	audit := sr.auditEntry(r, auditClaim, auditMessage, 0)
+	var claimed []model.ClaimedMessage
+	err = sr.write(ctx, func(ctx context.Context) (err error) {
+		claimed, err = model.ClaimMessages(ctx, sr.db, sr.Storage, queue, limit, sr.Queues.visibilityTimeout(), sr.Queues.policy(), audit)
+		return err
+	})
+	if err != nil {
+		respondWithStoreError(w, ctx, err)
+		return
+	}
+	sr.wakeRelay()
+
+	respondWithJSON(w, http.StatusOK, claimed)
+}
+
+// lease identifies the claim being acknowledged or released.
+type lease struct {
+	LeaseId string `json:"lease_id"`
+}
+
+// readLease reads the message ID and lease ID of a request to acknowledge or release a message,
+// responding with an error if either is missing or the body is longer than messages may be.
+func (sr *MessageServiceRouter) readLease(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["Id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid message ID")
+		return 0, "", false
+	}
+
+	body, err := sr.current().Payload.readBody(w, r)
+	defer r.Body.Close()
+	if err == errBodyTooLarge {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Lease payload too large")
+		return 0, "", false
+	}
+
+	var l lease
+	if err != nil || json.Unmarshal(body, &l) != nil || l.LeaseId == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid lease payload")
+		return 0, "", false
+	}
+
+	return id, l.LeaseId, true
+}
+
+func (sr *MessageServiceRouter) acknowledgeMessage(w http.ResponseWriter, r *http.Request) {
+	id, leaseId, ok := sr.readLease(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Write)
+	defer cancel()
+
+	audit := sr.auditEntry(r, auditAcknowledge, auditMessage, id)
+	err := sr.write(ctx, func(ctx context.Context) error {
+		return model.AcknowledgeMessage(ctx, sr.db, sr.Storage, id, leaseId, audit)
+	})
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusConflict, "Message is not leased with this lease ID")
+		default:
+			respondWithStoreError(w, ctx, err)
+		}
+		return
+	}
+	sr.wakeRelay()
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (sr *MessageServiceRouter) releaseMessage(w http.ResponseWriter, r *http.Request) {
+	id, leaseId, ok := sr.readLease(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Write)
+	defer cancel()
+
+	audit := sr.auditEntry(r, auditRelease, auditMessage, id)
+	var queue string
+	err := sr.write(ctx, func(ctx context.Context) (err error) {
+		queue, err = model.ReleaseMessage(ctx, sr.db, sr.Storage, id, leaseId, sr.Queues.policy(), audit)
+		return err
+	})
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusConflict, "Message is not leased with this lease ID")
+		default:
+			respondWithStoreError(w, ctx, err)
+		}
+		return
+	}
+	sr.wakeRelay()
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success", "queue": queue})
+}
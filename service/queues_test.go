@@ -0,0 +1,173 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"time"
+)
+
+var queuedColumns = []string{"id", "value", "ip_address", "date_created", "moderation_status", "queue", "key_id", "owner"}
+
+func Test_ShouldCreateMessageInQueue(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+
+	mock.ExpectQuery("INSERT INTO messages \\(value,ip_address,moderation_status,moderation_reason,queue\\)").
+		WithArgs("message4", "", "approved", "", "orders").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+
+	req, _ := http.NewRequest("POST", "/queues/orders/messages", bytes.NewBuffer([]byte("message4")))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusCreated, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"id\":4}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldClaimMessagesUpToMaximum(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Queues: Queues{VisibilityTimeout: time.Minute, MaxClaim: 2}}).NewServiceRouter(db)
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectQuery("UPDATE messages SET queue = queue").
+		WithArgs(".dead-letter", 0, nil, nil, "orders", 5, 12, ".dead-letter").
+		WillReturnRows(sqlmock.NewRows(queuedColumns))
+	mock.ExpectQuery("UPDATE messages SET lease_id = gen_random_uuid\\(\\).* LIMIT 2 FOR UPDATE SKIP LOCKED").
+		WithArgs(float64(60), "orders", 5, 12, ".dead-letter").
+		WillReturnRows(sqlmock.NewRows(append(queuedColumns, "lease_id", "leased_until", "deliveries")).
+		AddRow(4, "message4", "::1", dateCreated, "approved", "orders", nil, nil, "a2e0", dateCreated.Add(time.Minute), 1))
+
+	req, _ := http.NewRequest("POST", "/queues/orders/claim?limit=50", nil)
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Response status code not as expected")
+	assert.Equal(t, "[{\"id\":4,\"value\":\"message4\",\"ip_address\":\"::1\",\"date_created\":\"2017-06-25T14:22:12.296925Z\",\"status\":\"approved\",\"queue\":\"orders\","+
+		"\"lease_id\":\"a2e0\",\"leased_until\":\"2017-06-25T14:23:12.296925Z\",\"deliveries\":1}]", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldFailToAcknowledgeMessageNotLeased(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+
+	mock.ExpectQuery("UPDATE messages SET date_acknowledged = NOW\\(\\)").
+		WithArgs(nil, nil, 4, "a2e0").
+		WillReturnRows(sqlmock.NewRows(queuedColumns))
+
+	req, _ := http.NewRequest("POST", "/messages/4/ack", bytes.NewBuffer([]byte(`{"lease_id":"a2e0"}`)))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusConflict, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Message is not leased with this lease ID\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldReleaseMessageToItsDeadLetterQueue(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Queues: Queues{MaxDeliveries: 3, DeadLetterSuffix: ".failed"}}).NewServiceRouter(db)
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectQuery("UPDATE messages SET queue = CASE").
+		WithArgs(3, 7, ".failed", ".failed", 3, 7, ".failed", nil, nil, 4, "a2e0").
+		WillReturnRows(sqlmock.NewRows(append(queuedColumns, "deliveries")).
+		AddRow(4, "message4", "::1", dateCreated, "approved", "orders.failed", nil, nil, 0))
+
+	req, _ := http.NewRequest("POST", "/messages/4/nack", bytes.NewBuffer([]byte(`{"lease_id":"a2e0"}`)))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"queue\":\"orders.failed\",\"result\":\"success\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldRequireLeaseIdToReleaseMessage(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("POST", "/messages/4/nack", bytes.NewBuffer([]byte(`{}`)))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Invalid lease payload\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldFailToReleaseMessageDueToLeasePayloadTooLarge(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Payload: PayloadRules{MaxBodyBytes: 10}}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("POST", "/messages/4/nack", bytes.NewBuffer([]byte(`{"lease_id":"a2e0"}`)))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Lease payload too large\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldNotPostToDeadLetterQueue(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Queues: Queues{DeadLetterSuffix: ".failed"}}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("POST", "/queues/orders.failed/messages", bytes.NewBuffer([]byte("message4")))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Messages cannot be posted to a dead-letter queue\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldAuditAcknowledgement(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{AuditLog: true}).NewServiceRouter(db)
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM messages").
+		WithArgs(4).
+		WillReturnRows(sqlmock.NewRows(messageSnapshotColumns).AddRow(4, "message4", "::1", dateCreated, "approved", "", nil, "orders", 1, dateCreated, nil))
+	mock.ExpectQuery("UPDATE messages SET date_acknowledged = NOW\\(\\)").
+		WithArgs(nil, nil, 4, "a2e0").
+		WillReturnRows(sqlmock.NewRows(queuedColumns).AddRow(4, "message4", "::1", dateCreated, "approved", "orders", nil, nil))
+	mock.ExpectQuery("SELECT (.+) FROM messages").
+		WithArgs(4).
+		WillReturnRows(sqlmock.NewRows(messageSnapshotColumns).AddRow(4, "message4", "::1", dateCreated, "approved", "", nil, "orders", 1, nil, dateCreated))
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT hash FROM audit_log").WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+	mock.ExpectQuery("INSERT INTO audit_log").
+		WithArgs("acknowledge", "message", 4, "anonymous", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	req, _ := http.NewRequest("POST", "/messages/4/ack", bytes.NewBuffer([]byte(`{"lease_id":"a2e0"}`)))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Response status code not as expected")
+}
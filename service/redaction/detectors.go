@@ -0,0 +1,166 @@
+package redaction
+
+import (
+	"math/big"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Detector finds one kind of personal information within a message.
+type Detector interface {
+	Kind() string
+	// Find returns the [start, end) byte offsets of every match within the value.
+	Find(value string) [][]int
+}
+
+// patternDetector matches a regular expression, optionally checking each candidate with valid.
+type patternDetector struct {
+	kind    string
+	pattern *regexp.Regexp
+	valid   func(match string) bool
+}
+
+func (d *patternDetector) Kind() string {
+	return d.kind
+}
+
+func (d *patternDetector) Find(value string) [][]int {
+	var matches [][]int
+	for _, loc := range d.pattern.FindAllStringIndex(value, -1) {
+		if d.valid == nil || d.valid(value[loc[0]:loc[1]]) {
+			matches = append(matches, loc)
+		}
+	}
+	return matches
+}
+
+var (
+	Email = &patternDetector{
+		kind:    "email",
+		pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+	}
+	Phone = &patternDetector{
+		kind:    "phone",
+		// Anchored on word boundaries, so that digits within longer numbers or codes are left alone
+		pattern: regexp.MustCompile(`(?:\B\+\d{1,3}[ .-]?(?:\(\d{1,4}\)[ .-]?)?|\B\(\d{1,4}\)[ .-]?|\b)\d{2,5}(?:[ .-]?\d{2,5}){1,4}\b`),
+		valid:   phoneValid,
+	}
+	Card = &patternDetector{
+		kind:    "card",
+		pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		valid:   cardValid,
+	}
+	IBAN = &ibanDetector{
+		pattern: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`),
+	}
+)
+
+// ibanDetector matches IBANs, which are often written in groups of four. The groups make the pattern
+// run on into any capitalised words which follow, so each candidate is cut back to the longest run of
+// whole words passing the checksum, and the search resumes after it.
+type ibanDetector struct {
+	pattern *regexp.Regexp
+}
+
+func (d *ibanDetector) Kind() string {
+	return "iban"
+}
+
+func (d *ibanDetector) Find(value string) [][]int {
+	var matches [][]int
+	for offset := 0; offset < len(value); {
+		loc := d.pattern.FindStringIndex(value[offset:])
+		if loc == nil {
+			break
+		}
+		start, end := offset+loc[0], offset+loc[1]
+
+		if valid := longestIBAN(value, start, end); valid > 0 {
+			matches = append(matches, []int{start, valid})
+			offset = valid
+		} else if space := strings.IndexByte(value[start:end], ' '); space >= 0 {
+			// Another IBAN may start within the words the candidate ran on into
+			offset = start + space
+		} else {
+			offset = end
+		}
+	}
+	return matches
+}
+
+// longestIBAN returns the end of the longest valid IBAN starting at start and ending at a word
+// boundary no later than end, or 0 if there is none.
+func longestIBAN(value string, start, end int) int {
+	for ; end > start; end-- {
+		if (end == len(value) || value[end] == ' ') && value[end-1] != ' ' && ibanValid(value[start:end]) {
+			return end
+		}
+	}
+	return 0
+}
+
+// Detectors lists the built-in detectors by kind, in the order they should be applied. Cards and
+// IBANs are redacted before phone numbers so that their digits are not mistaken for one.
+var Detectors = []Detector{Email, IBAN, Card, Phone}
+
+func digits(value string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, value)
+}
+
+// datePattern matches a candidate starting with a date, which may run on into a time or another
+// number. The separator after the date is required so that a number merely starting like one is kept.
+var datePattern = regexp.MustCompile(`^(?:\d{4}[-/.]\d{1,2}[-/.]\d{1,2}|\d{1,2}[-/.]\d{1,2}[-/.]\d{2,4})(?:[ .-]|$)`)
+
+// phoneValid accepts between 7 and 15 digits (the E.164 maximum), excluding anything starting with a date.
+func phoneValid(match string) bool {
+	n := len(digits(match))
+	return n >= 7 && n <= 15 && !datePattern.MatchString(match)
+}
+
+func cardValid(match string) bool {
+	number := digits(match)
+	return len(number) >= 13 && len(number) <= 19 && luhnValid(number)
+}
+
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// ibanValid checks the ISO 13616 mod-97 checksum.
+func ibanValid(match string) bool {
+	iban := strings.Replace(match, " ", "", -1)
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+
+	var numeric strings.Builder
+	for _, r := range iban[4:] + iban[:4] {
+		if r >= 'A' && r <= 'Z' {
+			numeric.WriteString(big.NewInt(int64(r - 'A' + 10)).String())
+		} else {
+			numeric.WriteRune(r)
+		}
+	}
+
+	n, ok := new(big.Int).SetString(numeric.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
@@ -0,0 +1,77 @@
+package redaction
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Redaction struct {
+	Kind string
+	// Original holds the original value, or is empty when the redactor only masks. It is encrypted
+	// as it is stored, for the row it is stored in.
+	Original string
+}
+
+// Redactor replaces the personal information found by its detectors with a placeholder such as
+// "[redacted email]". When keeping originals it also returns each original value, to be stored
+// encrypted.
+type Redactor struct {
+	detectors     []Detector
+	keepOriginals bool
+}
+
+func NewRedactor(keepOriginals bool, detectors ...Detector) *Redactor {
+	return &Redactor{detectors, keepOriginals}
+}
+
+// DetectorsByKind looks up the built-in detectors with the given kinds, keeping the order in which
+// they are applied.
+func DetectorsByKind(kinds ...string) ([]Detector, error) {
+	wanted := make(map[string]bool, len(kinds))
+	for _, kind := range kinds {
+		wanted[strings.ToLower(kind)] = true
+	}
+
+	var detectors []Detector
+	for _, detector := range Detectors {
+		if wanted[detector.Kind()] {
+			detectors = append(detectors, detector)
+			delete(wanted, detector.Kind())
+		}
+	}
+
+	for kind := range wanted {
+		return nil, fmt.Errorf("Unknown redaction kind %q", kind)
+	}
+	return detectors, nil
+}
+
+func (r *Redactor) Redact(value string) (string, []Redaction) {
+	var redactions []Redaction
+
+	for _, detector := range r.detectors {
+		matches := detector.Find(value)
+		if len(matches) == 0 {
+			continue
+		}
+
+		placeholder := fmt.Sprintf("[redacted %s]", detector.Kind())
+		var redacted strings.Builder
+		last := 0
+		for _, match := range matches {
+			redaction := Redaction{Kind: detector.Kind()}
+			if r.keepOriginals {
+				redaction.Original = value[match[0]:match[1]]
+			}
+			redactions = append(redactions, redaction)
+
+			redacted.WriteString(value[last:match[0]])
+			redacted.WriteString(placeholder)
+			last = match[1]
+		}
+		redacted.WriteString(value[last:])
+		value = redacted.String()
+	}
+
+	return value, redactions
+}
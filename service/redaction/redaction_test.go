@@ -0,0 +1,88 @@
+package redaction
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ShouldMaskEachKindOfPersonalInformation(t *testing.T) {
+	redactor := NewRedactor(false, Detectors...)
+
+	value, redactions := redactor.Redact("Mail jo.bloggs@example.co.uk or call +44 20 7946 0958, card 4111 1111 1111 1111, IBAN GB82 WEST 1234 5698 7654 32")
+
+	assert.Equal(t, "Mail [redacted email] or call [redacted phone], card [redacted card], IBAN [redacted iban]", value, "Message was not redacted as expected")
+
+	kinds := []string{}
+	for _, r := range redactions {
+		kinds = append(kinds, r.Kind)
+		assert.Empty(t, r.Original, "Originals should not be kept when masking")
+	}
+	assert.Equal(t, []string{"email", "iban", "card", "phone"}, kinds, "Redactions were not recorded as expected")
+}
+
+func Test_ShouldIgnoreNumbersFailingChecksums(t *testing.T) {
+	redactor := NewRedactor(false, Card, IBAN)
+
+	value, redactions := redactor.Redact("Order 4111 1111 1111 1112 for GB82 WEST 1234 5698 7654 33")
+
+	assert.Equal(t, "Order 4111 1111 1111 1112 for GB82 WEST 1234 5698 7654 33", value, "Invalid numbers should not be redacted")
+	assert.Empty(t, redactions)
+}
+
+func Test_ShouldNotMistakeShortNumbersForPhoneNumbers(t *testing.T) {
+	_, redactions := NewRedactor(false, Phone).Redact("Meet at 10 30 on 2017-06-25")
+
+	assert.Empty(t, redactions)
+}
+
+func Test_ShouldNotMistakeDateAndTimeForPhoneNumber(t *testing.T) {
+	value, redactions := NewRedactor(false, Phone).Redact("Posted 2017-06-25 10:30, call 020 7946 0958")
+
+	assert.Equal(t, "Posted 2017-06-25 10:30, call [redacted phone]", value, "Only the phone number should be redacted")
+	assert.Equal(t, 1, len(redactions), "Expected one redaction")
+}
+
+func Test_ShouldNotRedactDigitsWithinLongerNumbers(t *testing.T) {
+	input := "Invoice INV1234567890 for GBP1234567.00, ref 12345678901234567890123456789012"
+	value, redactions := NewRedactor(false, Phone).Redact(input)
+
+	assert.Equal(t, input, value, "Digits within longer numbers should not be redacted")
+	assert.Empty(t, redactions)
+}
+
+func Test_ShouldRedactPhoneNumbersWithPrefixes(t *testing.T) {
+	value, _ := NewRedactor(false, Phone).Redact("Call +44 20 7946 0958, (020) 7946 0958 or +44(0)20-7946-0958")
+
+	assert.Equal(t, "Call [redacted phone], [redacted phone] or [redacted phone]", value, "Phone numbers were not redacted as expected")
+}
+
+func Test_ShouldRedactIBANFollowedByCapitalisedWords(t *testing.T) {
+	redactor := NewRedactor(false, IBAN)
+
+	for input, expected := range map[string]string{
+		"GB82WEST12345698765432 OK":                                  "[redacted iban] OK",
+		"GB82 WEST 1234 5698 7654 32 THANKS":                         "[redacted iban] THANKS",
+		"Pay GB82 WEST 1234 5698 7654 32 AND DE89370400440532013000": "Pay [redacted iban] AND [redacted iban]",
+	} {
+		value, _ := redactor.Redact(input)
+
+		assert.Equal(t, expected, value, "IBAN was not redacted as expected")
+	}
+}
+
+func Test_ShouldKeepOriginalsWhenAsked(t *testing.T) {
+	value, redactions := NewRedactor(true, Email).Redact("Contact jo@example.com")
+
+	assert.Equal(t, "Contact [redacted email]", value, "Message was not redacted as expected")
+	assert.Equal(t, 1, len(redactions), "Expected one redaction")
+	assert.Equal(t, "jo@example.com", redactions[0].Original, "Original value was not kept")
+}
+
+func Test_ShouldLookUpDetectorsByKind(t *testing.T) {
+	detectors, err := DetectorsByKind("phone", "EMAIL")
+	assert.Nil(t, err)
+	assert.Equal(t, []Detector{Email, Phone}, detectors, "Detectors were not returned in order")
+
+	_, err = DetectorsByKind("passport")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"amigo-tech-test/service/redaction"
+	"net/http"
+	"bytes"
+	"time"
+)
+
+func Test_ShouldRedactMessageBeforeStoringIt(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Redactor: redaction.NewRedactor(false, redaction.Email)}).NewServiceRouter(db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO messages").
+		WithArgs("Contact [redacted email]", "", "approved", "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(22))
+	mock.ExpectQuery("INSERT INTO message_redactions").
+		WithArgs(22, "email").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
+
+	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Contact jo@example.com")))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "{\"id\":22}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldStoreRedactedMessageAtMaximumLength(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Payload: PayloadRules{MaxLength: 21}, Redactor: redaction.NewRedactor(false, redaction.Email)}).NewServiceRouter(db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO messages").
+		WithArgs("Mail [redacted email]", "", "approved", "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(22))
+	mock.ExpectQuery("INSERT INTO message_redactions").
+		WithArgs(22, "email").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
+
+	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Mail a@b.co")))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusCreated, response.Code, "Response status code not as expected")
+}
+
+func Test_ShouldFailToCreateMessageLengthenedPastMaximumByRedaction(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Payload: PayloadRules{MaxLength: 20}, Redactor: redaction.NewRedactor(false, redaction.Email)}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Mail a@b.co")))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Invalid message payload\",\"violations\":[{\"rule\":\"max_length\",\"message\":\"Message must be at most 20 characters\"}]}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldRetrieveRedactionsForMessage(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Admin: testAdmin}).NewServiceRouter(db)
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	mock.ExpectQuery("SELECT id, message_id, kind, original IS NOT NULL, date_created FROM message_redactions").
+		WithArgs(22).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "message_id", "kind", "encrypted", "date_created"}).AddRow(1, 22, "email", true, dateCreated))
+
+	req, _ := http.NewRequest("GET", "/admin/messages/22/redactions", nil)
+	response := executeAdminRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "[{\"id\":1,\"message_id\":22,\"kind\":\"email\",\"encrypted\":true,\"date_created\":\"2017-06-25T14:22:12.296925Z\"}]", response.Body.String(), "Response body does not match expected value")
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"amigo-tech-test/util"
+	"context"
+	"database/sql"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultReplicaCheckInterval = 5 * time.Second
+
+	// readPrimaryHeader asks for a request to read from the primary rather than a replica.
+	readPrimaryHeader = "X-Read-Primary"
+	// readPrimaryCookie is set after a client writes, so that its reads go to the primary until
+	// the replicas have caught up.
+	readPrimaryCookie = "read_primary"
+)
+
+// reader returns the database to read from for the request: a healthy replica, unless the client
+// asked to read from the primary or has just written, or no replica is healthy.
+func (sr *MessageServiceRouter) reader(r *http.Request) *sql.DB {
+	if readPrimary, _ := strconv.ParseBool(r.Header.Get(readPrimaryHeader)); readPrimary {
+		return sr.db
+	}
+	if _, err := r.Cookie(readPrimaryCookie); err == nil {
+		return sr.db
+	}
+	if db := sr.replicas.Pick(); db != nil {
+		return db
+	}
+	return sr.db
+}
+
+// readReplica runs an idempotent read against the database reader picks for the request. Replica
+// reads are kept out of the circuit breaker, which guards the primary, so a failing replica cannot
+// fail writes fast. A read which fails on a replica with a transient error is run again on the
+// primary, with its retries.
+func (sr *MessageServiceRouter) readReplica(ctx context.Context, r *http.Request, op func(ctx context.Context, db *sql.DB) error) error {
+	if db := sr.reader(r); db != sr.db {
+		err := op(ctx, db)
+		if !util.IsTransientError(err) {
+			return err
+		}
+		slog.WarnContext(ctx, "Read replica failed, reading from the primary", "error", err)
+	}
+	return sr.read(ctx, func(ctx context.Context) error { return op(ctx, sr.db) })
+}
+
+// readYourWrites sets the cookie sending the client's reads to the primary for the ReadYourWrites
+// window, so that it sees what it has just written despite replication lag.
+func (sr *MessageServiceRouter) readYourWrites(w http.ResponseWriter) {
+	if sr.replicas == nil || sr.ReadYourWrites <= 0 {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     readPrimaryCookie,
+		Value:    "1",
+		Path:     "/messages",
+		MaxAge:   int(math.Ceil(sr.ReadYourWrites.Seconds())),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// checkReplicas health checks the replicas on startup, then every ReplicaCheckInterval until
+// shutdown.
+func (sr *MessageServiceRouter) checkReplicas(ctx context.Context) {
+	interval := sr.ReplicaCheckInterval
+	if interval <= 0 {
+		interval = defaultReplicaCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sr.replicas.Check(ctx, sr.current().Timeouts.Read)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
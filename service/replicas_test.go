@@ -0,0 +1,129 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func expectMessageLookup(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(11).
+		WillReturnRows(sqlmock.NewRows([]string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}).AddRow("Test message value", "192.168.200.201", time.Now(), "approved", nil, 1))
+}
+
+func newRouterWithHealthyReplica(t *testing.T, sr *MessageServiceRouter, db, replica *sql.DB) {
+	router = sr.NewServiceRouter(db, replica)
+	sr.replicas.Check(context.Background(), 0)
+	t.Cleanup(func() { sr.Shutdown(context.Background()) })
+}
+
+func Test_ShouldReadMessageFromReplica(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	replica, replicaMock, _ := sqlmock.New()
+	defer replica.Close()
+	newRouterWithHealthyReplica(t, &MessageServiceRouter{}, db, replica)
+
+	expectMessageLookup(replicaMock)
+
+	req, _ := http.NewRequest("GET", "/messages/11", nil)
+	response := executeRequest(req)
+
+	assert.Nil(t, replicaMock.ExpectationsWereMet(), "Lookup should be read from the replica")
+	assert.Nil(t, mock.ExpectationsWereMet(), "Primary should not be read from")
+	assert.Equal(t, http.StatusOK, response.Code, "Response status code not as expected")
+}
+
+func Test_ShouldReadMessageFromPrimaryWhenRequested(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	replica, _, _ := sqlmock.New()
+	defer replica.Close()
+	newRouterWithHealthyReplica(t, &MessageServiceRouter{}, db, replica)
+
+	expectMessageLookup(mock)
+
+	req, _ := http.NewRequest("GET", "/messages/11", nil)
+	req.Header.Set("X-Read-Primary", "true")
+	response := executeRequest(req)
+
+	assert.Nil(t, mock.ExpectationsWereMet(), "Lookup should be read from the primary")
+	assert.Equal(t, http.StatusOK, response.Code, "Response status code not as expected")
+}
+
+func Test_ShouldReadOwnWritesFromPrimaryAfterCreatingMessage(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	replica, _, _ := sqlmock.New()
+	defer replica.Close()
+	newRouterWithHealthyReplica(t, &MessageServiceRouter{ReadYourWrites: 5 * time.Second}, db, replica)
+
+	mock.ExpectQuery("INSERT INTO messages").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(11))
+	expectMessageLookup(mock)
+
+	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Test message value")))
+	response := executeRequest(req)
+
+	cookies := response.Result().Cookies()
+	assert.Len(t, cookies, 1, "Create should set the read-your-writes cookie")
+	assert.Equal(t, 5, cookies[0].MaxAge, "Cookie should last for the read-your-writes window")
+
+	req, _ = http.NewRequest("GET", "/messages/11", nil)
+	req.AddCookie(cookies[0])
+	response = executeRequest(req)
+
+	assert.Nil(t, mock.ExpectationsWereMet(), "Lookup after a write should be read from the primary")
+	assert.Equal(t, http.StatusOK, response.Code, "Response status code not as expected")
+}
+
+func Test_ShouldReadFromPrimaryWhenNoReplicaIsHealthy(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	replica, _, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	defer replica.Close()
+	sr := &MessageServiceRouter{}
+	router = sr.NewServiceRouter(db, replica)
+	sr.replicas.Check(context.Background(), 0)
+	defer sr.Shutdown(context.Background())
+
+	expectMessageLookup(mock)
+
+	req, _ := http.NewRequest("GET", "/messages/11", nil)
+	response := executeRequest(req)
+
+	assert.Nil(t, mock.ExpectationsWereMet(), "Lookup should fall back to the primary")
+	assert.Equal(t, http.StatusOK, response.Code, "Response status code not as expected")
+}
+
+func Test_ShouldFallBackToPrimaryWithoutOpeningBreakerWhenReplicaFails(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	replica, replicaMock, _ := sqlmock.New()
+	defer replica.Close()
+	newRouterWithHealthyReplica(t, &MessageServiceRouter{Resilience: Resilience{BreakerThreshold: 1, BreakerCooldown: time.Minute}}, db, replica)
+
+	replicaMock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WillReturnError(errDatabaseStarting)
+	expectMessageLookup(mock)
+	mock.ExpectQuery("INSERT INTO messages").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(12))
+
+	req, _ := http.NewRequest("GET", "/messages/11", nil)
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Lookup should fall back to the primary")
+
+	req, _ = http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Test message value")))
+	response = executeRequest(req)
+
+	assert.Nil(t, replicaMock.ExpectationsWereMet())
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, http.StatusCreated, response.Code, "A failing replica should not open the breaker for writes")
+}
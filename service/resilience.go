@@ -0,0 +1,132 @@
+package service
+
+import (
+	"amigo-tech-test/util"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Resilience controls how the router copes with an unhealthy database.
+type Resilience struct {
+	// ReadRetries is how many times a read which fails with a transient error is retried. Writes are
+	// never retried, as they may have been applied before the error.
+	ReadRetries int
+	// RetryBackoff is the delay before the first retry, doubling up to RetryMaxBackoff.
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+	// BreakerThreshold is the number of consecutive failed operations which open the circuit
+	// breaker, failing database operations fast with 503 until BreakerCooldown has passed and a
+	// trial operation succeeds. The breaker is disabled when zero.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// circuitOpenError is returned without calling the database while the circuit breaker is open.
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return "Database unavailable"
+}
+
+// circuitBreaker opens after a run of consecutive failures. Once its cool-down has passed, a single
+// trial operation is let through, closing the breaker if it succeeds or reopening it if not. Its
+// methods do nothing on a nil receiver, so the breaker can be left disabled.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold < 1 {
+		return nil
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns a *circuitOpenError if the operation should not be attempted.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return &circuitOpenError{wait}
+	}
+	if b.trial {
+		return &circuitOpenError{time.Second}
+	}
+	b.trial = true
+	return nil
+}
+
+// record reports the outcome of an operation which was allowed.
+func (b *circuitBreaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasOpen := b.failures >= b.threshold
+	b.trial = false
+
+	if !failed {
+		b.failures = 0
+		if wasOpen {
+			slog.Info("Database circuit breaker closed")
+		}
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		if !wasOpen {
+			slog.Warn("Database circuit breaker opened", "failures", b.failures, "cooldown", b.cooldown)
+		}
+	}
+}
+
+// unhealthy reports whether an error suggests the database itself is failing, rather than the
+// operation or the request.
+func unhealthy(err error) bool {
+	return util.IsTransientError(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// call runs a database operation through the circuit breaker.
+func (sr *MessageServiceRouter) call(ctx context.Context, op func(ctx context.Context) error) error {
+	if err := sr.breaker.allow(); err != nil {
+		return err
+	}
+	err := op(ctx)
+	sr.breaker.record(unhealthy(err))
+	return err
+}
+
+// read runs an idempotent database operation, retrying it when it fails with a transient error.
+func (sr *MessageServiceRouter) read(ctx context.Context, op func(ctx context.Context) error) error {
+	backoff := util.Backoff{Initial: sr.Resilience.RetryBackoff, Max: sr.Resilience.RetryMaxBackoff}
+	return util.Retry(ctx, sr.Resilience.ReadRetries+1, backoff, util.IsTransientError, func(ctx context.Context) error {
+		return sr.call(ctx, op)
+	})
+}
+
+// write runs a database operation which is not safe to repeat.
+func (sr *MessageServiceRouter) write(ctx context.Context, op func(ctx context.Context) error) error {
+	return sr.call(ctx, op)
+}
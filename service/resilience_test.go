@@ -0,0 +1,88 @@
+package service
+
+import (
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var errDatabaseStarting = &pq.Error{Code: "57P03", Message: "the database system is starting up"}
+
+func Test_ShouldRetryReadAfterTransientError(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Resilience: Resilience{ReadRetries: 1, RetryBackoff: time.Millisecond}}).NewServiceRouter(db)
+
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(11).
+		WillReturnError(errDatabaseStarting)
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(11).
+		WillReturnRows(sqlmock.NewRows([]string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}).AddRow("Test message value", "192.168.200.201", time.Now(), "approved", nil, 1))
+
+	req, _ := http.NewRequest("GET", "/messages/11", nil)
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, response.Code, "Read should succeed once retried")
+}
+
+func Test_ShouldNotRetryWriteAfterTransientError(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Resilience: Resilience{ReadRetries: 3, RetryBackoff: time.Millisecond}}).NewServiceRouter(db)
+
+	mock.ExpectQuery("DELETE FROM messages").
+		WithArgs(123).
+		WillReturnError(errDatabaseStarting)
+
+	req, _ := http.NewRequest("DELETE", "/messages/123", nil)
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusInternalServerError, response.Code, "Write should fail without being retried")
+}
+
+func Test_ShouldFailFastWhenCircuitBreakerIsOpen(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Resilience: Resilience{BreakerThreshold: 2, BreakerCooldown: time.Minute}}).NewServiceRouter(db)
+
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("DELETE FROM messages").
+			WithArgs(123).
+			WillReturnError(errDatabaseStarting)
+
+		req, _ := http.NewRequest("DELETE", "/messages/123", nil)
+		executeRequest(req)
+	}
+
+	req, _ := http.NewRequest("GET", "/messages/11", nil)
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err, "Database should not be called while the circuit breaker is open")
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Open circuit breaker should return 503")
+	assert.Equal(t, "60", response.Header().Get("Retry-After"), "Retry-After should be the remaining cool-down")
+	assert.Equal(t, "{\"error\":\"Database unavailable\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldCloseCircuitBreakerAfterSuccessfulTrial(t *testing.T) {
+	breaker := newCircuitBreaker(1, 0)
+
+	breaker.record(true)
+	assert.Nil(t, breaker.allow(), "Trial operation should be allowed once the cool-down has passed")
+	assert.NotNil(t, breaker.allow(), "Only one trial operation should be allowed at a time")
+
+	breaker.record(false)
+	assert.Nil(t, breaker.allow(), "Circuit breaker should close after a successful trial")
+	assert.Nil(t, breaker.allow(), "Closed circuit breaker should allow every operation")
+}
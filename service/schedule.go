@@ -0,0 +1,58 @@
+package service
+
+import (
+	"amigo-tech-test/service/model"
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	defaultSchedulePollInterval = time.Second
+	defaultScheduleBatchSize    = 100
+)
+
+// Scheduling controls the delivery of messages created with a delivery time.
+type Scheduling struct {
+	// Enabled accepts messages with a delivery time, and delivers them once they are due.
+	Enabled bool `mapstructure:"enabled"`
+	// PollInterval is how often scheduled messages are checked for any which are due, defaulting to
+	// a second.
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	// BatchSize is how many messages are delivered in each transaction, defaulting to 100.
+	BatchSize int `mapstructure:"batch_size"`
+}
+
+func (s Scheduling) pollInterval() time.Duration {
+	return orDefault(s.PollInterval, defaultSchedulePollInterval)
+}
+
+func (s Scheduling) batchSize() int {
+	return orDefault(s.BatchSize, defaultScheduleBatchSize)
+}
+
+func (sr *MessageServiceRouter) deliverScheduledMessages(ctx context.Context) {
+	pollBatches(ctx, sr.Scheduling.pollInterval(), nil, sr.Scheduling.batchSize(), sr.deliverScheduledBatch)
+}
+
+// deliverScheduledBatch makes a batch of due messages visible and publishes their created events,
+// returning how many were delivered. Shutdown does not interrupt a batch once it is under way.
+func (sr *MessageServiceRouter) deliverScheduledBatch(ctx context.Context) int {
+	ctx, cancel := withTimeout(context.WithoutCancel(ctx), sr.current().Timeouts.Write)
+	defer cancel()
+
+	var delivered []model.Message
+	err := sr.write(ctx, func(ctx context.Context) (err error) {
+		delivered, err = model.DeliverScheduledMessages(ctx, sr.db, sr.Storage, sr.Scheduling.batchSize())
+		return err
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to deliver scheduled messages, they will be retried", "error", err)
+		return 0
+	}
+
+	for _, m := range delivered {
+		sr.announceEvent(ctx, eventCreated, m.Id)
+	}
+	return len(delivered)
+}
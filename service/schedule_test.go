@@ -0,0 +1,94 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"time"
+)
+
+func Test_ShouldAcceptScheduledMessage(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	sr := &MessageServiceRouter{Scheduling: Scheduling{Enabled: true, PollInterval: time.Hour}}
+	router = sr.NewServiceRouter(db)
+	defer sr.Shutdown(context.Background())
+	events := sr.events.subscribe(1)
+
+	deliverAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	mock.ExpectQuery("INSERT INTO messages \\(value,ip_address,moderation_status,moderation_reason,deliver_at,scheduled\\)").
+		WithArgs("message4", "", "approved", "", deliverAt, true).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+
+	req, _ := http.NewRequest("POST", "/messages/?deliver_at="+deliverAt.Format(time.RFC3339), bytes.NewBuffer([]byte("message4")))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusAccepted, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"deliver_at\":\""+deliverAt.Format(time.RFC3339)+"\",\"id\":4}", response.Body.String(), "Response body does not match expected value")
+	assert.Empty(t, events, "A scheduled message should not be published until it is delivered")
+}
+
+func Test_ShouldRefuseScheduledMessageWhenSchedulingDisabled(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("POST", "/messages/?deliver_at=2017-06-25T15:00:00Z", bytes.NewBuffer([]byte("message4")))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Scheduled delivery is not enabled\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldRefuseInvalidDeliveryTime(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("POST", "/messages/?deliver_at=tomorrow", bytes.NewBuffer([]byte("message4")))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Invalid deliver_at, expected an RFC 3339 time\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldPublishScheduledMessagesOnceDelivered(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	sr := &MessageServiceRouter{Scheduling: Scheduling{Enabled: true, PollInterval: time.Hour}}
+	router = sr.NewServiceRouter(db)
+	defer sr.Shutdown(context.Background())
+	events := sr.events.subscribe(1)
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+	deliverAt, _ := time.Parse(time.RFC3339, "2017-06-25T15:00:00Z")
+
+	mock.ExpectQuery("UPDATE messages SET scheduled").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "value", "ip_address", "date_created", "moderation_status", "queue", "deliver_at", "key_id", "owner"}).
+		AddRow(4, "message4", "::1", dateCreated, "approved", nil, deliverAt, nil, nil))
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}).
+		AddRow("message4", "::1", dateCreated, "approved", nil, 1))
+
+	delivered := sr.deliverScheduledBatch(context.Background())
+	assert.Equal(t, 1, delivered, "Expected one message to be delivered")
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	event := <-events
+	assert.Equal(t, eventCreated, event.Type, "A delivered message should be published as created")
+	assert.Equal(t, 4, event.Id, "Event message ID not as expected")
+}
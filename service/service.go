@@ -1,34 +1,216 @@
 package service
 
 import (
+	"context"
 	"net/http"
 	"database/sql"
-	"io/ioutil"
 	"github.com/gorilla/mux"
+	"math"
+	"net"
 	"strconv"
 	"amigo-tech-test/service/model"
+	"amigo-tech-test/service/moderation"
+	"amigo-tech-test/service/redaction"
+	"amigo-tech-test/util"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type ServiceRouter interface {
-	NewServiceRouter( db *sql.DB) *mux.Router
+	NewServiceRouter(db *sql.DB, replicas ...*sql.DB) *mux.Router
+	Drain()
+	Shutdown(ctx context.Context) error
 }
 
+// MessageServiceRouter serves the messages API. Payload, Moderator, Timeouts and Paging are its
+// initial settings, which Reconfigure can replace while it is running.
 type MessageServiceRouter struct {
-	db *sql.DB
+	// BlockMode controls which requests from blocked networks are rejected (BlockWrites or
+	// BlockAll). The check is disabled when empty.
+	BlockMode string
+	// BlockListRefresh is how often the block list is reloaded from the database, so that changes
+	// made on other instances take effect, defaulting to 30 seconds.
+	BlockListRefresh time.Duration
+	// Admin controls how requests to /admin are authenticated. Every admin request is refused when
+	// no credential is configured.
+	Admin AdminAuth
+	// Payload holds the limits and sanitisation rules applied to new messages.
+	Payload PayloadRules
+	// Moderator screens new messages before they are stored. Moderation is skipped when nil.
+	Moderator *moderation.Pipeline
+	// Redactor removes personal information from new messages before they are stored. Redaction is
+	// skipped when nil.
+	Redactor *redaction.Redactor
+	// AuditLog records every create, update and delete in the audit log when set.
+	AuditLog bool
+	// TrustedProxies are the networks of the authenticating proxies whose X-Actor header is recorded
+	// as the actor in the audit log. The header is ignored from anywhere else.
+	TrustedProxies []*net.IPNet
+	// Metrics exposes request and message metrics in Prometheus format on /metrics when set.
+	Metrics bool
+	// Timeouts bound the database operations made while handling each request.
+	Timeouts Timeouts
+	// Paging limits the size of the pages returned by searches.
+	Paging Paging
+	// Resilience controls retries and the circuit breaker guarding the database.
+	Resilience Resilience
+	// Streams controls the message streams served on /messages/stream.
+	Streams Streams
+	// EventListener receives message events from the database, so that streams and sockets on every
+	// instance see each change. Events only reach those on the instance which made the change when nil.
+	EventListener EventListener
+	// Webhooks controls the delivery of message events to webhooks.
+	Webhooks Webhooks
+	// Storage controls whether message values are encrypted at rest, and whether message changes
+	// are recorded in the outbox. Events are also queued for webhooks when they are enabled.
+	Storage model.Storage
+	// Publisher receives the events relayed from the outbox, which message changes are recorded in
+	// when Storage.Outbox is set. Nothing is relayed when nil.
+	Publisher Publisher
+	// Outbox controls how events are relayed to the Publisher.
+	Outbox Outbox
+	// Queues controls how messages posted to queues are claimed and delivered again.
+	Queues Queues
+	// Scheduling is the scheduler's configuration. Messages are only accepted with a delivery time
+	// when it is enabled.
+	Scheduling Scheduling
+	// ReadYourWrites is how long a client's reads go to the primary rather than a replica after it
+	// creates or deletes a message. Clients can also ask for a read from the primary with the
+	// X-Read-Primary header.
+	ReadYourWrites time.Duration
+	// ReplicaCheckInterval is how often read replicas are health checked, defaulting to 5 seconds.
+	ReplicaCheckInterval time.Duration
+	// Config returns the active configuration, with secrets masked, for /admin/config. The endpoint
+	// is not registered when nil.
+	Config func() map[string]any
+
+	db        *sql.DB
+	replicas  *util.Replicas
+	blockList *blockList
+	workers   *workers
+	metrics   *metrics
+	draining  atomic.Bool
+	drained   chan struct{}
+	events    *eventBus
+	settings  atomic.Pointer[Settings]
+	breaker   *circuitBreaker
+
+	webhookClient *http.Client
+	relayWake     chan struct{}
 }
 
-func (sr *MessageServiceRouter) NewServiceRouter(db *sql.DB) *mux.Router {
+// NewServiceRouter routes requests to handlers using the primary database for writes, and spreading
+// message lookups and searches across any read replicas.
+func (sr *MessageServiceRouter) NewServiceRouter(db *sql.DB, replicas ...*sql.DB) *mux.Router {
 	sr.db = db
+	sr.replicas = util.NewReplicas(replicas...)
+	sr.breaker = newCircuitBreaker(sr.Resilience.BreakerThreshold, sr.Resilience.BreakerCooldown)
+	sr.Reconfigure(Settings{Payload: sr.Payload, Moderator: sr.Moderator, Timeouts: sr.Timeouts, Paging: sr.Paging})
+	sr.workers = newWorkers()
+	if sr.replicas != nil {
+		sr.workers.run(sr.checkReplicas)
+	}
+	sr.drained = make(chan struct{})
+	sr.events = newEventBus()
+	if sr.EventListener != nil {
+		sr.workers.run(func(ctx context.Context) {
+			sr.checkEventChannel(ctx)
+			sr.EventListener.Listen(ctx, func(payload []byte) { sr.receiveEvent(ctx, payload) })
+		})
+	}
+	if sr.Webhooks.Enabled {
+		sr.Storage.Webhooks = true
+		sr.webhookClient = newWebhookClient(sr.Webhooks.timeout(), sr.Webhooks.allowedNetworks())
+		sr.workers.run(sr.deliverWebhooks)
+	}
+	if sr.Publisher != nil {
+		sr.relayWake = make(chan struct{}, 1)
+		sr.workers.run(sr.relayOutbox)
+		sr.workers.run(sr.pruneOutboxPeriodically)
+	}
+	if sr.Scheduling.Enabled {
+		sr.workers.run(sr.deliverScheduledMessages)
+	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/messages/", sr.getMessages).Methods("GET")
-	r.HandleFunc("/messages/", sr.createMessage).Methods("POST")
-	r.HandleFunc("/messages/{Id:[0-9]+}", sr.getMessage).Methods("GET")
-	r.HandleFunc("/messages/{Id:[0-9]+}", sr.deleteMessage).Methods("DELETE")
+	r.Use(nameSpanAfterRoute)
+	r.HandleFunc("/healthz", sr.getHealth).Methods("GET")
+	r.HandleFunc("/readyz", sr.getReadiness).Methods("GET")
+
+	if sr.Metrics {
+		sr.metrics = newMetrics(db, func() time.Duration { return sr.current().Timeouts.Read })
+		r.Handle("/metrics", sr.metrics.handler()).Methods("GET")
+		r.Use(sr.metrics.instrument)
+		// Middleware only runs for matched routes, so requests matching none are instrumented here
+		r.NotFoundHandler = sr.metrics.instrument(http.NotFoundHandler())
+		r.MethodNotAllowedHandler = sr.metrics.instrument(http.HandlerFunc(methodNotAllowed))
+	}
+
+	messages := r.PathPrefix("/messages").Subrouter()
+	messages.HandleFunc("/", sr.getMessages).Methods("GET")
+	messages.HandleFunc("/", sr.createMessage).Methods("POST")
+	messages.HandleFunc("/stream", sr.streamMessages).Methods("GET")
+	messages.HandleFunc("/{Id:[0-9]+}", sr.getMessage).Methods("GET")
+	messages.HandleFunc("/{Id:[0-9]+}", sr.deleteMessage).Methods("DELETE")
+	messages.HandleFunc("/{Id:[0-9]+}/ack", sr.acknowledgeMessage).Methods("POST")
+	messages.HandleFunc("/{Id:[0-9]+}/nack", sr.releaseMessage).Methods("POST")
+
+	queues := r.PathPrefix("/queues/{Name:[A-Za-z0-9_.-]+}").Subrouter()
+	queues.HandleFunc("/messages", sr.createMessage).Methods("POST")
+	queues.HandleFunc("/claim", sr.claimMessages).Methods("POST")
+
+	if sr.BlockMode != "" {
+		sr.blockList = &blockList{}
+		sr.refreshBlockList(context.Background())
+		sr.workers.run(sr.refreshBlockListPeriodically)
+		messages.Use(sr.rejectBlockedNetworks)
+		queues.Use(sr.rejectBlockedNetworks)
+	}
+
+	// Posts over the socket are checked against the block list as they are made
+	var socket http.Handler = http.HandlerFunc(sr.serveWebSocket)
+	if sr.BlockMode == BlockAll {
+		socket = sr.rejectBlockedNetworks(socket)
+	}
+	r.Handle("/ws", socket).Methods("GET")
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(sr.authenticateAdmin)
+	if sr.BlockMode != "" {
+		admin.Use(sr.rejectBlockedNetworks)
+	}
+	admin.HandleFunc("/blocked-networks/", sr.getBlockedNetworks).Methods("GET")
+	admin.HandleFunc("/blocked-networks/", sr.createBlockedNetwork).Methods("POST")
+	admin.HandleFunc("/blocked-networks/{Id:[0-9]+}", sr.deleteBlockedNetwork).Methods("DELETE")
+	admin.HandleFunc("/audit", sr.getAuditLog).Methods("GET")
+	if sr.Webhooks.Enabled {
+		admin.HandleFunc("/webhooks/", sr.getWebhooks).Methods("GET")
+		admin.HandleFunc("/webhooks/", sr.createWebhook).Methods("POST")
+		admin.HandleFunc("/webhooks/{Id:[0-9]+}", sr.deleteWebhook).Methods("DELETE")
+		admin.HandleFunc("/webhooks/{Id:[0-9]+}/deliveries", sr.getWebhookDeliveries).Methods("GET")
+		admin.HandleFunc("/webhooks/{Id:[0-9]+}/deliveries/{DeliveryId:[0-9]+}/retry", sr.retryWebhookDelivery).Methods("POST")
+	}
+	if sr.Config != nil {
+		admin.HandleFunc("/config", sr.getConfig).Methods("GET")
+	}
+	admin.HandleFunc("/messages/{Id:[0-9]+}/redactions", sr.getRedactions).Methods("GET")
+	admin.HandleFunc("/moderation/", sr.getModerationQueue).Methods("GET")
+	admin.HandleFunc("/moderation/{Id:[0-9]+}/approve", sr.approveMessage).Methods("POST")
+	admin.HandleFunc("/moderation/{Id:[0-9]+}/reject", sr.rejectMessage).Methods("POST")
 
 	return r
 }
 
+// Shutdown stops the router's background workers, waiting for them to flush any work in progress
+// until the context expires.
+func (sr *MessageServiceRouter) Shutdown(ctx context.Context) error {
+	if sr.workers == nil {
+		return nil
+	}
+	return sr.workers.shutdown(ctx)
+}
+
 func (sr *MessageServiceRouter) getMessage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["Id"])
@@ -37,13 +219,16 @@ func (sr *MessageServiceRouter) getMessage(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Read)
+	defer cancel()
+
 	m := model.Message{Id: id}
-	if err := m.GetMessage(sr.db); err != nil {
+	if err := sr.readReplica(ctx, r, func(ctx context.Context, db *sql.DB) error { return m.GetMessage(ctx, db, sr.Storage) }); err != nil {
 		switch err {
 		case sql.ErrNoRows:
 			respondWithError(w, http.StatusNotFound, "Message not found")
 		default:
-			respondWithError(w, http.StatusInternalServerError, err.Error())
+			respondWithStoreError(w, ctx, err)
 		}
 		return
 	}
@@ -52,24 +237,28 @@ func (sr *MessageServiceRouter) getMessage(w http.ResponseWriter, r *http.Reques
 }
 
 func (sr *MessageServiceRouter) getMessages(w http.ResponseWriter, r *http.Request) {
+	settings := sr.current()
 	queryVals := r.URL.Query()
 
-	limit, _  := strconv.Atoi(getQueryParamOrDefault(queryVals, "limit", "20"))
-	offset, _  := strconv.Atoi(getQueryParamOrDefault(queryVals, "offset", "0"))
+	offset, limit := getPaging(queryVals, settings.Paging)
 	messageQuery := getQueryParamOrDefault(queryVals, "message", "")
 	ipAddress := getQueryParamOrDefault(queryVals, "ip", "")
 
-	if limit < 1 || limit > 20 {
-		limit = 20
-	}
-
-	if(offset < 0) {
-		offset = 0
-	}
+	ctx, cancel := withTimeout(r.Context(), settings.Timeouts.Search)
+	defer cancel()
 
-	result, err := model.Search(sr.db, offset, limit, messageQuery, ipAddress)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	start := time.Now()
+	var result *model.Page
+	err := sr.readReplica(ctx, r, func(ctx context.Context, db *sql.DB) (err error) {
+		result, err = model.Search(ctx, db, sr.Storage, offset, limit, messageQuery, ipAddress)
+		return err
+	})
+	sr.metrics.observeSearch(start)
+	if err == model.ErrFilterTooShort || err == model.ErrFilterTooBroad {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		respondWithStoreError(w, ctx, err)
 		return
 	}
 
@@ -77,28 +266,146 @@ func (sr *MessageServiceRouter) getMessages(w http.ResponseWriter, r *http.Reque
 }
 
 func (sr *MessageServiceRouter) createMessage(w http.ResponseWriter, r *http.Request) {
-	var m model.Message
-	bodyBytes, err := ioutil.ReadAll(r.Body)
-	if err != nil {
+	settings := sr.current()
+	bodyBytes, err := settings.Payload.readBody(w, r)
+	if err == errBodyTooLarge {
+		respondWithError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid message payload")
 		return
 	}
 	defer r.Body.Close()
 
-	m.Value = string(bodyBytes)
-	ip, error := getClientIp(r)
-	if error == nil {
-		m.IpAddress = ip.String()
+	var deliverAt time.Time
+	if value := r.URL.Query().Get("deliver_at"); value != "" {
+		if deliverAt, err = time.Parse(time.RFC3339, value); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid deliver_at, expected an RFC 3339 time")
+			return
+		}
 	}
 
-	if err := m.CreateMessage(sr.db); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	m, failure := sr.newMessage(r, settings, bodyBytes, deliverAt)
+	if failure != nil {
+		failure.respond(w)
+		return
+	}
+	sr.readYourWrites(w)
+
+	// Messages which are not yet visible are accepted rather than created
+	if m.Status == moderation.StatusQuarantined || m.DeliverAt != nil {
+		body := map[string]interface{}{"id": m.Id}
+		if m.Status == moderation.StatusQuarantined {
+			body["status"] = m.Status
+		}
+		if m.DeliverAt != nil {
+			body["deliver_at"] = m.DeliverAt
+		}
+		respondWithJSON(w, http.StatusAccepted, body)
 		return
 	}
 
 	respondWithJSON(w, http.StatusCreated, map[string]int{"id": m.Id})
 }
 
+// messageError explains why a new message was not stored: the rules it violated, the reasons it
+// was rejected by moderation, or the failure which prevented it from being stored.
+type messageError struct {
+	Status     int
+	Message    string
+	Violations []Violation
+	Reasons    []string
+	RetryAfter time.Duration
+}
+
+func (e *messageError) respond(w http.ResponseWriter) {
+	switch {
+	case len(e.Violations) > 0:
+		respondWithViolations(w, e.Violations)
+	case len(e.Reasons) > 0:
+		body := map[string]interface{}{
+			"error":   e.Message,
+			"reasons": e.Reasons,
+		}
+		if id := responseRequestId(w); id != "" {
+			body["request_id"] = id
+		}
+		respondWithJSON(w, e.Status, body)
+	default:
+		if e.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+		}
+		respondWithError(w, e.Status, e.Message)
+	}
+}
+
+// newMessage validates, moderates and redacts a message value before storing it, then records it
+// in the audit log and publishes it to streams. Messages posted over HTTP and WebSockets are
+// handled the same way. A message with a delivery time in the future is hidden until then, and
+// published once the scheduler delivers it.
+func (sr *MessageServiceRouter) newMessage(r *http.Request, settings *Settings, body []byte, deliverAt time.Time) (*model.Message, *messageError) {
+	if !deliverAt.IsZero() && !sr.Scheduling.Enabled {
+		return nil, &messageError{Status: http.StatusBadRequest, Message: "Scheduled delivery is not enabled"}
+	}
+
+	value, violations := settings.Payload.apply(body)
+	if len(violations) > 0 {
+		return nil, &messageError{Status: http.StatusBadRequest, Message: "Invalid message payload", Violations: violations}
+	}
+
+	// Messages posted to a queue are created in it. Dead-letter queues are only filled by messages
+	// running out of deliveries, though they are claimed from like any other
+	m := &model.Message{Value: value, Queue: mux.Vars(r)["Name"]}
+	if m.Queue != "" && strings.HasSuffix(m.Queue, sr.Queues.policy().DeadLetterSuffix) {
+		return nil, &messageError{Status: http.StatusBadRequest, Message: "Messages cannot be posted to a dead-letter queue"}
+	}
+	if deliverAt.After(time.Now()) {
+		deliverAt = deliverAt.UTC()
+		m.DeliverAt = &deliverAt
+	}
+	if settings.Moderator != nil {
+		result := settings.Moderator.Moderate(m.Value)
+		if result.Action == moderation.Reject {
+			return nil, &messageError{Status: http.StatusUnprocessableEntity, Message: "Message rejected by moderation", Reasons: result.Reasons}
+		}
+		m.Status = result.Action.Status()
+		m.ModerationReason = strings.Join(result.Reasons, "; ")
+	}
+
+	if sr.Redactor != nil {
+		redacted, redactions := sr.Redactor.Redact(m.Value)
+		m.Value = redacted
+		for _, r := range redactions {
+			m.Redactions = append(m.Redactions, model.Redaction{Kind: r.Kind, Original: r.Original})
+		}
+
+		// Placeholders can be longer than the values they replace, so the limits are checked again
+		if violations := settings.Payload.checkLength(m.Value); len(violations) > 0 {
+			return nil, &messageError{Status: http.StatusBadRequest, Message: "Invalid message payload", Violations: violations}
+		}
+	}
+
+	if ip, err := getClientIp(r); err == nil {
+		m.IpAddress = ip.String()
+	}
+	m.Owner = sr.requestActor(r)
+
+	ctx, cancel := withTimeout(r.Context(), settings.Timeouts.Write)
+	defer cancel()
+
+	audit := sr.auditEntry(r, auditCreate, auditMessage, 0)
+	if err := sr.write(ctx, func(ctx context.Context) error { return m.CreateMessage(ctx, sr.db, sr.Storage, audit) }); err != nil {
+		status, message, retryAfter := storeError(ctx, err)
+		return nil, &messageError{Status: status, Message: message, RetryAfter: retryAfter}
+	}
+
+	sr.metrics.messageCreated(m.Status)
+	if m.DeliverAt == nil {
+		sr.publishEvent(r, eventCreated, m.Id)
+	}
+	return m, nil
+}
+
 func (sr *MessageServiceRouter) deleteMessage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["Id"])
@@ -107,11 +414,27 @@ func (sr *MessageServiceRouter) deleteMessage(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Write)
+	defer cancel()
+
 	p := model.Message{Id: id}
-	if err := p.DeleteMessage(sr.db); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	audit := sr.auditEntry(r, auditDelete, auditMessage, id)
+	var visible bool
+	err = sr.write(ctx, func(ctx context.Context) (err error) {
+		visible, err = p.DeleteMessage(ctx, sr.db, sr.Storage, audit)
+		return err
+	})
+	if err != nil {
+		respondWithStoreError(w, ctx, err)
 		return
 	}
+	sr.metrics.messageDeleted()
+	sr.readYourWrites(w)
+	// Readers never saw a message which was quarantined, and one not yet delivered by the scheduler
+	// had no created event, so neither has a deleted event
+	if visible {
+		sr.publishEvent(r, eventDeleted, id)
+	}
 
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
@@ -10,6 +10,7 @@ import (
 	"database/sql"
 	"errors"
 	"bytes"
+	"net"
 	"time"
 )
 
@@ -21,10 +22,10 @@ func Test_ShouldGetMessageWithoutErrors(t *testing.T) {
 	router = (&MessageServiceRouter{}).NewServiceRouter(db)
 	dateCreated, err := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
 
-	columns := []string{"value", "ip_address", "date_created"}
-	mock.ExpectQuery("SELECT value, ip_address, date_created FROM messages").
+	columns := []string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
 		WithArgs(11).
-		WillReturnRows(sqlmock.NewRows(columns).AddRow("Test message value", "192.168.200.201", dateCreated))
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("Test message value", "192.168.200.201", dateCreated, "approved", nil, 1))
 
 	req, _ := http.NewRequest("GET", "/messages/11", nil)
 	response := executeRequest(req)
@@ -40,7 +41,7 @@ func Test_ShouldFailToGetMessageDueToMessageNotFound(t *testing.T) {
 	defer db.Close()
 	router = (&MessageServiceRouter{}).NewServiceRouter(db)
 
-	mock.ExpectQuery("SELECT value, ip_address, date_created FROM messages").
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
 		WithArgs(11).
 		WillReturnError(sql.ErrNoRows)
 
@@ -58,7 +59,7 @@ func Test_ShouldFailToGetMessageDueToError(t *testing.T) {
 	defer db.Close()
 	router = (&MessageServiceRouter{}).NewServiceRouter(db)
 
-	mock.ExpectQuery("SELECT value, ip_address, date_created FROM messages").
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
 		WithArgs(11).
 		WillReturnError(errors.New("Database connection closed"))
 
@@ -93,18 +94,18 @@ func Test_ShouldSuccessfullyRetrieveMessages(t *testing.T) {
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).
 		AddRow(100))
 
-	columns := []string{"id", "value", "ip_address", "date_created"}
-	mock.ExpectQuery("SELECT id, value, ip_address, date_created FROM messages").
+	columns := []string{"id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
 		WithArgs("%Test message value%", "192.168%").
 		WillReturnRows(sqlmock.NewRows(columns).
-		AddRow(1, "Test message value", "192.168.200.201", dateCreated))
+		AddRow(1, "Test message value", "192.168.200.201", dateCreated, "approved", nil, 1))
 
 	req, _ := http.NewRequest("GET", "/messages/?message=Test%20message%20value&ip=192.168", nil)
 	response := executeRequest(req)
 	err = mock.ExpectationsWereMet()
 	assert.Nil(t, err)
 
-	assert.Equal(t, "{\"offset\":0,\"limit\":20,\"total_count\":100,\"results\":[{\"id\":1,\"value\":\"Test message value\",\"ip_address\":\"192.168.200.201\",\"date_created\":\"2017-06-25T14:22:12.296925Z\"}]}", response.Body.String(), "Response body does not match expected value")
+	assert.Equal(t, "{\"offset\":0,\"limit\":20,\"total_count\":100,\"results\":[{\"id\":1,\"value\":\"Test message value\",\"ip_address\":\"192.168.200.201\",\"date_created\":\"2017-06-25T14:22:12.296925Z\",\"status\":\"approved\"}]}", response.Body.String(), "Response body does not match expected value")
 }
 
 func Test_ShouldFailToRetrieveMessagesAndRespondWithError(t *testing.T) {
@@ -117,7 +118,7 @@ func Test_ShouldFailToRetrieveMessagesAndRespondWithError(t *testing.T) {
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).
 		AddRow(100))
 
-	mock.ExpectQuery("SELECT id, value, ip_address, date_created FROM messages").
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
 		WithArgs("%Test message value%", "192.168%").
 		WillReturnError(errors.New("Database connection closed"))
 
@@ -137,7 +138,7 @@ func Test_ShouldSuccessfullyCreateMessageWithClientIpAddress(t *testing.T) {
 
 	columns := []string{"id"}
 	mock.ExpectQuery("INSERT INTO messages").
-		WithArgs("Test message value", "192.168.200.201").
+		WithArgs("Test message value", "192.168.200.201", "approved", "").
 		WillReturnRows(sqlmock.NewRows(columns).AddRow(22))
 
 	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Test message value")))
@@ -157,7 +158,7 @@ func Test_ShouldSuccessfullyCreateMessageWithoutClientIpAddress(t *testing.T) {
 
 	columns := []string{"id"}
 	mock.ExpectQuery("INSERT INTO messages").
-		WithArgs("Test message value", "").
+		WithArgs("Test message value", "", "approved", "").
 		WillReturnRows(sqlmock.NewRows(columns).AddRow(22))
 
 	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Test message value")))
@@ -169,13 +170,34 @@ func Test_ShouldSuccessfullyCreateMessageWithoutClientIpAddress(t *testing.T) {
 	assert.Equal(t, "{\"id\":22}", response.Body.String(), "Response body does not match expected value")
 }
 
+func Test_ShouldRecordOwnerOfMessageFromTrustedProxy(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	router = (&MessageServiceRouter{TrustedProxies: []*net.IPNet{proxies}}).NewServiceRouter(db)
+
+	mock.ExpectQuery("INSERT INTO messages \\(value,ip_address,moderation_status,moderation_reason,owner\\)").
+		WithArgs("Test message value", "10.0.0.1", "approved", "", "orders").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(22))
+
+	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Test message value")))
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("X-Actor", "orders")
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "{\"id\":22}", response.Body.String(), "Response body does not match expected value")
+}
+
 func Test_ShouldFailToCreateMessageDueToError(t *testing.T) {
 	db, mock, _ := sqlmock.New()
 	defer db.Close()
 	router = (&MessageServiceRouter{}).NewServiceRouter(db)
 
 	mock.ExpectQuery("INSERT INTO messages").
-		WithArgs("Test message value", "").
+		WithArgs("Test message value", "", "approved", "").
 		WillReturnError(errors.New("Database connection closed"))
 
 	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Test message value")))
@@ -192,9 +214,9 @@ func Test_ShouldDeleteMessageSuccessfully(t *testing.T) {
 	defer db.Close()
 	router = (&MessageServiceRouter{}).NewServiceRouter(db)
 
-	mock.ExpectExec("DELETE FROM messages").
+	mock.ExpectQuery("DELETE FROM messages").
 		WithArgs(123).
-		WillReturnResult(sqlmock.NewResult(0,1))
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address", "owner", "moderation_status", "scheduled"}).AddRow("192.168.200.201", nil, "approved", false))
 
 	req, _ := http.NewRequest("DELETE", "/messages/123", nil)
 	response := executeRequest(req)
@@ -221,7 +243,7 @@ func Test_ShouldFailToDeleteMessageDueToErrorDeletingMessageFromDatabase(t *test
 	defer db.Close()
 	router = (&MessageServiceRouter{}).NewServiceRouter(db)
 
-	mock.ExpectExec("DELETE FROM messages").
+	mock.ExpectQuery("DELETE FROM messages").
 		WithArgs(123).
 		WillReturnError(errors.New("Database connection closed"))
 
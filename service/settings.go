@@ -0,0 +1,52 @@
+package service
+
+import (
+	"amigo-tech-test/service/moderation"
+	"net/http"
+)
+
+const defaultPageLimit = 20
+
+// Settings hold the parts of the router's configuration which can be changed while it is running.
+type Settings struct {
+	Payload   PayloadRules
+	Moderator *moderation.Pipeline
+	Timeouts  Timeouts
+	Paging    Paging
+}
+
+// Paging limits the size of the pages returned by searches. Zero values default to 20 results.
+type Paging struct {
+	// DefaultLimit is the page size used when a request does not ask for one.
+	DefaultLimit int `mapstructure:"default_limit"`
+	// MaxLimit is the largest page size a request may ask for.
+	MaxLimit int `mapstructure:"max_limit"`
+}
+
+func (p Paging) limits() (defaultLimit, maxLimit int) {
+	maxLimit = p.MaxLimit
+	if maxLimit < 1 {
+		maxLimit = defaultPageLimit
+	}
+	defaultLimit = p.DefaultLimit
+	if defaultLimit < 1 || defaultLimit > maxLimit {
+		defaultLimit = min(defaultPageLimit, maxLimit)
+	}
+	return defaultLimit, maxLimit
+}
+
+// Reconfigure replaces the router's settings in one step. Requests already in progress finish with
+// the settings they started with.
+func (sr *MessageServiceRouter) Reconfigure(settings Settings) {
+	sr.settings.Store(&settings)
+}
+
+// current returns the settings in effect, which handlers load once so that each request sees a
+// consistent set.
+func (sr *MessageServiceRouter) current() *Settings {
+	return sr.settings.Load()
+}
+
+func (sr *MessageServiceRouter) getConfig(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, sr.Config())
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"bytes"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func Test_ShouldLimitPagesToConfiguredMaximum(t *testing.T) {
+	paging := Paging{DefaultLimit: 5, MaxLimit: 50}
+
+	_, limit := getPaging(url.Values{}, paging)
+	assert.Equal(t, 5, limit, "Default limit was not applied")
+
+	_, limit = getPaging(url.Values{"limit": {"40"}}, paging)
+	assert.Equal(t, 40, limit, "Requested limit within the maximum was not used")
+
+	_, limit = getPaging(url.Values{"limit": {"100"}}, paging)
+	assert.Equal(t, 50, limit, "Requested limit was not capped at the maximum")
+
+	_, limit = getPaging(url.Values{"limit": {"100"}}, Paging{})
+	assert.Equal(t, 20, limit, "Unset paging should cap pages at 20 results")
+}
+
+func Test_ShouldApplyReconfiguredSettingsToNewRequests(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	sr := &MessageServiceRouter{}
+	router = sr.NewServiceRouter(db)
+
+	sr.Reconfigure(Settings{Payload: PayloadRules{MaxLength: 5}})
+
+	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBufferString("Too long"))
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Reconfigured payload rules were not applied")
+}
+
+func Test_ShouldServeEffectiveConfig(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	config := func() map[string]any {
+		return map[string]any{"db": map[string]any{"password": "********"}}
+	}
+	router = (&MessageServiceRouter{Config: config, Admin: testAdmin}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("GET", "/admin/config", nil)
+	response := executeAdminRequest(req)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, `{"db":{"password":"********"}}`, response.Body.String(), "Response body does not match expected value")
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"amigo-tech-test/service/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStreamHeartbeat = 15 * time.Second
+	defaultStreamBuffer    = 64
+
+	// replayBatchSize is how many missed messages are loaded at a time when a stream resumes.
+	replayBatchSize = 100
+
+	// eventIdPrefix marks an event ID as a delivery sequence number, telling it apart from the message
+	// IDs that streams used as event IDs before messages were numbered in the order they are delivered.
+	eventIdPrefix = "seq-"
+)
+
+// Streams controls the message streams served on /messages/stream.
+type Streams struct {
+	// Heartbeat is how often a comment is sent on a quiet stream, so that proxies and clients can
+	// tell it is still open. Defaults to 15 seconds.
+	Heartbeat time.Duration `mapstructure:"heartbeat"`
+	// Buffer is how many events a stream may fall behind by before it is closed, defaulting to 64.
+	// Clients then reconnect with Last-Event-ID to catch up.
+	Buffer int `mapstructure:"buffer"`
+}
+
+func (s Streams) heartbeat() time.Duration {
+	if s.Heartbeat <= 0 {
+		return defaultStreamHeartbeat
+	}
+	return s.Heartbeat
+}
+
+func (s Streams) buffer() int {
+	if s.Buffer < 1 {
+		return defaultStreamBuffer
+	}
+	return s.Buffer
+}
+
+// streamFilter matches events against the message and ip parameters, as getMessages does.
+type streamFilter struct {
+	message   string
+	ipAddress string
+}
+
+// matches reports whether a stream should be sent an event. Deleted events are sent to every
+// stream, as the message is gone.
+func (f streamFilter) matches(event messageEvent) bool {
+	if event.Message == nil {
+		return true
+	}
+	return strings.Contains(event.Message.Value, f.message) && strings.HasPrefix(event.Message.IpAddress, f.ipAddress)
+}
+
+// eventStream writes Server-Sent Events, flushing each one to the client.
+type eventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// send writes an event. Only created events have an ID, which is the message's delivery sequence
+// number (e.g. "seq-42"), so that a client reconnecting with Last-Event-ID resumes after the last
+// message it was sent, including messages created before it but held back by moderation or scheduled
+// delivery.
+func (s *eventStream) send(event messageEvent) error {
+	data := []byte(fmt.Sprintf(`{"id":%d}`, event.Id))
+	if event.Message != nil {
+		m := *event.Message
+		m.ModerationReason = ""
+		var err error
+		if data, err = json.Marshal(m); err != nil {
+			return err
+		}
+	}
+
+	if event.Type == eventCreated && event.Message != nil {
+		fmt.Fprintf(s.w, "id: %s%d\n", eventIdPrefix, event.Message.DeliverySeq)
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+func (s *eventStream) heartbeat() error {
+	if _, err := fmt.Fprint(s.w, ": heartbeat\n\n"); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// streamMessages streams messages as they are created, updated and deleted, as Server-Sent Events,
+// filtered by the message and ip parameters. A client reconnecting with Last-Event-ID is first sent
+// the messages delivered after the one with that ID, which may also be a message ID sent by an earlier
+// version. Streams are closed when the service starts shutting down.
+func (sr *MessageServiceRouter) streamMessages(w http.ResponseWriter, r *http.Request) {
+	queryVals := r.URL.Query()
+	filter := streamFilter{
+		message:   getQueryParamOrDefault(queryVals, "message", ""),
+		ipAddress: getQueryParamOrDefault(queryVals, "ip", ""),
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	lastSeq, err := sr.resumeAfter(r.Context(), lastEventId)
+	if err == errInvalidEventId {
+		respondWithError(w, http.StatusBadRequest, "Invalid Last-Event-ID")
+		return
+	} else if err != nil {
+		respondWithStoreError(w, r.Context(), err)
+		return
+	}
+
+	// Subscribe before catching up, so that nothing created in the meantime is missed
+	events := sr.events.subscribe(sr.Streams.buffer())
+	defer sr.events.unsubscribe(events)
+
+	var missed []model.Message
+	if lastEventId != "" {
+		if missed, err = sr.messagesAfter(r.Context(), lastSeq, filter); err == model.ErrFilterTooShort || err == model.ErrFilterTooBroad {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		} else if err != nil {
+			respondWithStoreError(w, r.Context(), err)
+			return
+		}
+	}
+
+	// Streams outlive the server's write timeout, so lift it for this response
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	stream := &eventStream{w: w, rc: rc}
+	if err := stream.heartbeat(); err != nil {
+		return
+	}
+
+	for len(missed) > 0 {
+		for i := range missed {
+			if err := stream.send(messageEvent{Type: eventCreated, Id: missed[i].Id, Message: &missed[i]}); err != nil {
+				return
+			}
+			lastSeq = missed[i].DeliverySeq
+		}
+		if len(missed) < replayBatchSize {
+			break
+		}
+		var err error
+		if missed, err = sr.messagesAfter(r.Context(), lastSeq, filter); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(sr.Streams.heartbeat())
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sr.drained:
+			return
+		case event, ok := <-events:
+			if !ok {
+				// Dropped for falling behind; the client will reconnect and catch up
+				return
+			}
+			if (event.Type == eventCreated && event.Message != nil && event.Message.DeliverySeq <= lastSeq) || !filter.matches(event) {
+				continue
+			}
+			err = stream.send(event)
+		case <-heartbeat.C:
+			err = stream.heartbeat()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+var errInvalidEventId = errors.New("Invalid Last-Event-ID")
+
+// resumeAfter returns the delivery sequence number a stream resumes after, given the ID of the last
+// event the client was sent. Message IDs sent as event IDs by earlier versions are still accepted,
+// and resolved to the message's sequence number from the primary.
+func (sr *MessageServiceRouter) resumeAfter(ctx context.Context, lastEventId string) (int64, error) {
+	if lastEventId == "" {
+		return 0, nil
+	}
+	if seq, ok := strings.CutPrefix(lastEventId, eventIdPrefix); ok {
+		lastSeq, err := strconv.ParseInt(seq, 10, 64)
+		if err != nil || lastSeq < 0 {
+			return 0, errInvalidEventId
+		}
+		return lastSeq, nil
+	}
+
+	id, err := strconv.Atoi(lastEventId)
+	if err != nil || id < 0 {
+		return 0, errInvalidEventId
+	}
+
+	ctx, cancel := withTimeout(ctx, sr.current().Timeouts.Read)
+	defer cancel()
+
+	var lastSeq int64
+	err = sr.read(ctx, func(ctx context.Context) (err error) {
+		lastSeq, err = model.DeliverySeqOf(ctx, sr.db, id)
+		return err
+	})
+	return lastSeq, err
+}
+
+// messagesAfter loads the next batch of messages a resuming stream missed. They are read from the
+// primary, as a replica may not yet have every message the client was sent.
+func (sr *MessageServiceRouter) messagesAfter(ctx context.Context, lastSeq int64, filter streamFilter) ([]model.Message, error) {
+	ctx, cancel := withTimeout(ctx, sr.current().Timeouts.Search)
+	defer cancel()
+
+	var messages []model.Message
+	err := sr.read(ctx, func(ctx context.Context) (err error) {
+		messages, err = model.MessagesAfter(ctx, sr.db, sr.Storage, lastSeq, replayBatchSize, filter.message, filter.ipAddress)
+		return err
+	})
+	return messages, err
+}
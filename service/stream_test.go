@@ -0,0 +1,358 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeListener delivers the payloads notified by a test to every router listening on it, as the
+// trigger on the messages table does for instances listening on its channel.
+type fakeListener struct {
+	mu        sync.Mutex
+	listeners []func(payload []byte)
+}
+
+func (l *fakeListener) notify(payload string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, deliver := range l.listeners {
+		deliver([]byte(payload))
+	}
+}
+
+func (l *fakeListener) Listen(ctx context.Context, deliver func(payload []byte)) {
+	l.mu.Lock()
+	l.listeners = append(l.listeners, deliver)
+	l.mu.Unlock()
+	<-ctx.Done()
+}
+
+func (l *fakeListener) listening() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.listeners)
+}
+
+func newStreamServer(t *testing.T, sr *MessageServiceRouter, db *sql.DB) *httptest.Server {
+	server := httptest.NewServer(sr.NewServiceRouter(db))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { sr.Shutdown(context.Background()) })
+	return server
+}
+
+func openStream(t *testing.T, server *httptest.Server, query, lastEventId string) *bufio.Reader {
+	req, _ := http.NewRequest("GET", server.URL+"/messages/stream"+query, nil)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	response, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	t.Cleanup(func() { response.Body.Close() })
+
+	assert.Equal(t, http.StatusOK, response.StatusCode, "Response status code not as expected")
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"), "Content type not as expected")
+	return bufio.NewReader(response.Body)
+}
+
+// readEvent reads the next event from a stream, skipping heartbeats.
+func readEvent(t *testing.T, stream *bufio.Reader) string {
+	var event strings.Builder
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended before an event was read: %v", err)
+		}
+		if line == "\n" {
+			if event.Len() > 0 {
+				return event.String()
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, ":") {
+			event.WriteString(line)
+		}
+	}
+}
+
+// expectMessageLoad expects a visible message to be loaded, delivered in the order it was created
+// unless a delivery sequence number is given.
+func expectMessageLoad(mock sqlmock.Sqlmock, id int, value, ipAddress string, deliverySeq ...int) {
+	seq := id
+	if len(deliverySeq) > 0 {
+		seq = deliverySeq[0]
+	}
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}).AddRow(value, ipAddress, time.Now(), "approved", nil, seq))
+}
+
+func expectMessageDelete(mock sqlmock.Sqlmock, id int, status string, scheduled bool) {
+	mock.ExpectQuery("DELETE FROM messages WHERE id = \\$1 AND queue IS NULL RETURNING ip_address, owner, moderation_status, scheduled").
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address", "owner", "moderation_status", "scheduled"}).AddRow("127.0.0.1", nil, status, scheduled))
+}
+
+func createMessage(t *testing.T, server *httptest.Server, value string) {
+	response, err := http.Post(server.URL+"/messages/", "text/plain", bytes.NewBufferString(value))
+	assert.Nil(t, err)
+	response.Body.Close()
+}
+
+func Test_ShouldStreamCreatedMessagesMatchingFilter(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	server := newStreamServer(t, &MessageServiceRouter{}, db)
+
+	stream := openStream(t, server, "?message=hello", "")
+
+	mock.ExpectQuery("INSERT INTO messages").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(21))
+	expectMessageLoad(mock, 21, "something else", "127.0.0.1")
+	mock.ExpectQuery("INSERT INTO messages").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(22))
+	expectMessageLoad(mock, 22, "hello world", "127.0.0.1")
+
+	createMessage(t, server, "something else")
+	createMessage(t, server, "hello world")
+
+	event := readEvent(t, stream)
+	assert.True(t, strings.HasPrefix(event, "id: seq-22\nevent: created\ndata: {\"id\":22,\"value\":\"hello world\""), "Only the matching message should be streamed, got %q", event)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_ShouldStreamApprovedQuarantinedMessagesAsCreated(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	server := newStreamServer(t, &MessageServiceRouter{Admin: testAdmin}, db)
+
+	stream := openStream(t, server, "", "")
+
+	mock.ExpectQuery("UPDATE messages SET moderation_status").
+		WithArgs("approved", "quarantined", 22).
+		WillReturnRows(sqlmock.NewRows([]string{"moderation_status", "ip_address", "owner"}).AddRow("quarantined", "127.0.0.1", nil))
+	expectMessageLoad(mock, 22, "hello world", "127.0.0.1")
+	req, _ := http.NewRequest("POST", server.URL+"/admin/moderation/22/approve", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdmin.Token)
+	response, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	response.Body.Close()
+
+	event := readEvent(t, stream)
+	assert.True(t, strings.HasPrefix(event, "id: seq-22\nevent: created\n"), "A quarantined message should be created once approved, got %q", event)
+}
+
+func Test_ShouldStreamDeletedMessages(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	server := newStreamServer(t, &MessageServiceRouter{}, db)
+
+	stream := openStream(t, server, "?message=hello", "")
+
+	expectMessageDelete(mock, 21, "approved", false)
+	req, _ := http.NewRequest("DELETE", server.URL+"/messages/21", nil)
+	response, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	response.Body.Close()
+
+	assert.Equal(t, "event: deleted\ndata: {\"id\":21}\n", readEvent(t, stream), "Deleted event not as expected")
+}
+
+func Test_ShouldNotStreamDeletionOfMessagesNeverVisible(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	server := newStreamServer(t, &MessageServiceRouter{}, db)
+
+	stream := openStream(t, server, "", "")
+
+	expectMessageDelete(mock, 21, "quarantined", false)
+	expectMessageDelete(mock, 22, "approved", true)
+	expectMessageDelete(mock, 23, "approved", false)
+	for _, id := range []string{"21", "22", "23"} {
+		req, _ := http.NewRequest("DELETE", server.URL+"/messages/"+id, nil)
+		response, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		response.Body.Close()
+	}
+
+	assert.Equal(t, "event: deleted\ndata: {\"id\":23}\n", readEvent(t, stream), "Only the visible message's deletion should be streamed")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_ShouldResumeStreamFromLastEventId(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	server := newStreamServer(t, &MessageServiceRouter{}, db)
+
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages WHERE (.+) AND delivery_seq > \\$1 ORDER BY delivery_seq").
+		WithArgs(int64(20)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}).
+			AddRow(4, "first missed", "10.0.0.1", time.Now(), "approved", nil, 21).
+			AddRow(23, "second missed", "10.0.0.1", time.Now(), "flagged", nil, 22))
+
+	stream := openStream(t, server, "", "seq-20")
+
+	assert.True(t, strings.HasPrefix(readEvent(t, stream), "id: seq-21\nevent: created\ndata: {\"id\":4,"), "A message delivered after the last event should be replayed, even if created before it")
+	assert.Contains(t, readEvent(t, stream), "id: seq-22\n", "Second missed message should be replayed")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_ShouldResumeStreamFromMessageIdSentByEarlierVersions(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	server := newStreamServer(t, &MessageServiceRouter{}, db)
+
+	mock.ExpectQuery("SELECT delivery_seq FROM messages WHERE id <= \\$1 ORDER BY id DESC LIMIT 1").
+		WithArgs(17).
+		WillReturnRows(sqlmock.NewRows([]string{"delivery_seq"}).AddRow(20))
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages WHERE (.+) AND delivery_seq > \\$1 ORDER BY delivery_seq").
+		WithArgs(int64(20)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}).
+			AddRow(18, "missed", "10.0.0.1", time.Now(), "approved", nil, 21))
+
+	stream := openStream(t, server, "", "17")
+
+	assert.True(t, strings.HasPrefix(readEvent(t, stream), "id: seq-21\nevent: created\ndata: {\"id\":18,"), "A message delivered after the message with the last event ID should be replayed")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_ShouldStreamMessageDeliveredAfterLastEventIdWhenCreatedBeforeIt(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	server := newStreamServer(t, &MessageServiceRouter{Admin: testAdmin}, db)
+
+	mock.ExpectQuery("SELECT id, value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(int64(20)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}))
+
+	stream := openStream(t, server, "", "seq-20")
+
+	mock.ExpectQuery("UPDATE messages SET moderation_status").
+		WithArgs("approved", "quarantined", 5).
+		WillReturnRows(sqlmock.NewRows([]string{"moderation_status", "ip_address", "owner"}).AddRow("quarantined", "127.0.0.1", nil))
+	expectMessageLoad(mock, 5, "hello world", "127.0.0.1", 21)
+	req, _ := http.NewRequest("POST", server.URL+"/admin/moderation/5/approve", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdmin.Token)
+	response, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	response.Body.Close()
+
+	event := readEvent(t, stream)
+	assert.True(t, strings.HasPrefix(event, "id: seq-21\nevent: created\ndata: {\"id\":5,"), "A message approved after the last event should be streamed, got %q", event)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_ShouldRejectInvalidLastEventId(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+
+	for _, lastEventId := range []string{"abc", "seq-abc", "seq--1", "-1"} {
+		req, _ := http.NewRequest("GET", "/messages/stream", nil)
+		req.Header.Set("Last-Event-ID", lastEventId)
+		response := executeRequest(req)
+
+		assert.Equal(t, "{\"error\":\"Invalid Last-Event-ID\"}", response.Body.String(), "Response body for %q does not match expected value", lastEventId)
+	}
+}
+
+func Test_ShouldStreamChangesNotifiedByTheDatabase(t *testing.T) {
+	listener := &fakeListener{}
+
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	writerServer := newStreamServer(t, &MessageServiceRouter{EventListener: listener}, db)
+
+	otherDb, otherMock, _ := sqlmock.New()
+	defer otherDb.Close()
+	otherServer := newStreamServer(t, &MessageServiceRouter{EventListener: listener}, otherDb)
+
+	assert.Eventually(t, func() bool { return listener.listening() == 2 }, time.Second, time.Millisecond, "Both instances should be listening")
+	writerStream := openStream(t, writerServer, "", "")
+	otherStream := openStream(t, otherServer, "", "")
+
+	mock.ExpectQuery("INSERT INTO messages").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(31))
+	expectMessageLoad(mock, 31, "Test message value", "127.0.0.1")
+	expectMessageLoad(otherMock, 31, "Test message value", "127.0.0.1")
+
+	createMessage(t, writerServer, "Test message value")
+	assert.NotNil(t, mock.ExpectationsWereMet(), "Change should only be streamed once the database notifies it")
+	listener.notify(`{"type":"created","id":31}`)
+
+	assert.Contains(t, readEvent(t, otherStream), "id: seq-31\nevent: created\n", "Message created through another instance should be streamed")
+	assert.Contains(t, readEvent(t, writerStream), "id: seq-31\nevent: created\n", "Message created through this instance should be streamed")
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Nil(t, otherMock.ExpectationsWereMet())
+}
+
+func Test_ShouldCloseStreamsWhenDraining(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	sr := &MessageServiceRouter{}
+	server := newStreamServer(t, sr, db)
+
+	stream := openStream(t, server, "", "")
+	sr.Drain()
+
+	_, err := stream.ReadString('\n')
+	for err == nil {
+		_, err = stream.ReadString('\n')
+	}
+	assert.NotNil(t, err, "Stream should end when draining")
+}
+
+func Test_ShouldDropSubscriberWhichFallsBehind(t *testing.T) {
+	bus := newEventBus()
+	slow := bus.subscribe(1)
+
+	bus.publish(messageEvent{Type: eventDeleted, Id: 1})
+	bus.publish(messageEvent{Type: eventDeleted, Id: 2})
+
+	<-slow
+	_, open := <-slow
+	assert.False(t, open, "Subscriber more than its buffer behind should be dropped")
+	assert.True(t, bus.idle(), "Dropped subscriber should be removed")
+}
+
+// namedListener is a listener which names its channel, so that it can be checked against the
+// channel the triggers send events on.
+type namedListener struct {
+	fakeListener
+	channel string
+}
+
+func (l *namedListener) Channel() string {
+	return l.channel
+}
+
+func Test_ShouldReportTriggersSendingEventsOnAnotherChannel(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	sr := &MessageServiceRouter{}
+	sr.NewServiceRouter(db)
+	defer sr.Shutdown(context.Background())
+	sr.EventListener = &namedListener{channel: "message_events"}
+	logs, restore := captureLogs(t)
+	defer restore()
+
+	mock.ExpectQuery("SELECT DISTINCT tgargs FROM pg_trigger").
+		WillReturnRows(sqlmock.NewRows([]string{"tgargs"}).AddRow([]byte("message_events\x00")))
+	mock.ExpectQuery("SELECT DISTINCT tgargs FROM pg_trigger").
+		WillReturnRows(sqlmock.NewRows([]string{"tgargs"}).AddRow([]byte("other_events\x00")))
+
+	sr.checkEventChannel(context.Background())
+	assert.Equal(t, "", logs.String(), "Matching channel should not be reported")
+
+	sr.checkEventChannel(context.Background())
+	assert.Contains(t, logs.String(), `"trigger_channels":["other_events"]`, "Mismatched channel was not reported")
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Timeouts bound how long each kind of database operation may take. A zero timeout leaves the
+// operation bounded only by the request it belongs to.
+type Timeouts struct {
+	// Read applies to single lookups, such as fetching a message or blocked network.
+	Read time.Duration
+	// Search applies to paged searches of messages, the moderation queue and the audit log.
+	Search time.Duration
+	// Write applies to creates, updates and deletes, including recording audit entries.
+	Write time.Duration
+}
+
+// withTimeout derives the context for a database operation. The operation is cancelled when the
+// parent is, e.g. when the client disconnects, or once the timeout has passed.
+func withTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// respondWithStoreError responds to a failed database operation, distinguishing operations which
+// ran out of time (504), were cancelled along with the request or refused by the circuit breaker
+// (503) from other failures (500).
+func respondWithStoreError(w http.ResponseWriter, ctx context.Context, err error) {
+	status, message, retryAfter := storeError(ctx, err)
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	respondWithError(w, status, message)
+}
+
+// storeError returns the status and message to report a failed database operation with, and how
+// long the client should wait before retrying when the circuit breaker is open.
+func storeError(ctx context.Context, err error) (int, string, time.Duration) {
+	var circuitOpen *circuitOpenError
+	switch {
+	case errors.As(err, &circuitOpen):
+		return http.StatusServiceUnavailable, err.Error(), circuitOpen.retryAfter
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "Timed out waiting for the database", 0
+	case errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled):
+		return http.StatusServiceUnavailable, "Request cancelled before the database responded", 0
+	default:
+		return http.StatusInternalServerError, err.Error(), 0
+	}
+}
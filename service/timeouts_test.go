@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_ShouldRespondWithGatewayTimeoutWhenSearchTimesOut(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Timeouts: Timeouts{Search: 10 * time.Millisecond}}).NewServiceRouter(db)
+
+	mock.ExpectQuery("SELECT COUNT\\(id\\) FROM messages").
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	req, _ := http.NewRequest("GET", "/messages/", nil)
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, response.Code, "Search exceeding its timeout should return 504")
+	assert.Equal(t, "{\"error\":\"Timed out waiting for the database\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldRespondWithGatewayTimeoutWhenLookupTimesOut(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Timeouts: Timeouts{Read: 10 * time.Millisecond}}).NewServiceRouter(db)
+
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(11).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}))
+
+	req, _ := http.NewRequest("GET", "/messages/11", nil)
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, response.Code, "Lookup exceeding its timeout should return 504")
+}
+
+func Test_ShouldRespondWithServiceUnavailableWhenRequestCancelled(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Timeouts: Timeouts{Read: time.Second}}).NewServiceRouter(db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/messages/11", nil)
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Lookup abandoned with the request should return 503")
+}
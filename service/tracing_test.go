@@ -0,0 +1,49 @@
+package service
+
+import (
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func Test_ShouldTraceRequestWithinCallersTrace(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{}).NewServiceRouter(db)
+	dateCreated, _ := time.Parse(time.RFC3339, "2017-06-25T14:22:12.296925Z")
+
+	recorder := tracetest.NewSpanRecorder()
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	}()
+
+	columns := []string{"value", "ip_address", "date_created", "moderation_status", "key_id", "delivery_seq"}
+	mock.ExpectQuery("SELECT value, ip_address, date_created, moderation_status, key_id, delivery_seq FROM messages").
+		WithArgs(11).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("Test message value", "192.168.200.201", dateCreated, "approved", nil, 1))
+
+	req, _ := http.NewRequest("GET", "/messages/11", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	response := httptest.NewRecorder()
+	TraceRequests(router).ServeHTTP(response, req)
+
+	spans := recorder.Ended()
+	assert.Equal(t, 1, len(spans), "Expected a single span for the request")
+	span := spans[0]
+	assert.Equal(t, "GET /messages/{Id:[0-9]+}", span.Name(), "Span was not named after the route")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String(), "Span is not part of the caller's trace")
+	assert.Equal(t, "00f067aa0ba902b7", span.Parent().SpanID().String(), "Span is not a child of the caller's span")
+	assert.Contains(t, span.Attributes(), attribute.String("http.route", "/messages/{Id:[0-9]+}"))
+}
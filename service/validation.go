@@ -0,0 +1,108 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxBodyBytes = 1 << 20
+	defaultMinLength    = 1
+)
+
+// PayloadRules configures how message bodies are read and validated before they are stored.
+// Zero values fall back to a 1MB body limit, a minimum length of one character and no maximum length.
+type PayloadRules struct {
+	MaxBodyBytes      int64 `mapstructure:"max_body_bytes"`
+	MinLength         int   `mapstructure:"min_length"`
+	MaxLength         int   `mapstructure:"max_length"`
+	StripControlChars bool  `mapstructure:"strip_control_chars"`
+	NormalizeUnicode  bool  `mapstructure:"normalize_unicode"`
+}
+
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+type validationError struct {
+	Error      string      `json:"error"`
+	Violations []Violation `json:"violations"`
+	RequestId  string      `json:"request_id,omitempty"`
+}
+
+var errBodyTooLarge = errors.New("Message payload too large")
+
+func (rules PayloadRules) maxBodyBytes() int64 {
+	if rules.MaxBodyBytes <= 0 {
+		return defaultMaxBodyBytes
+	}
+	return rules.MaxBodyBytes
+}
+
+// readBody reads at most MaxBodyBytes from the request, returning errBodyTooLarge if the body is longer.
+func (rules PayloadRules) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, rules.maxBodyBytes()))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return nil, errBodyTooLarge
+	}
+	return body, err
+}
+
+// apply sanitises the message value and checks it against each rule, returning the value to store
+// along with every rule it violated.
+func (rules PayloadRules) apply(body []byte) (string, []Violation) {
+	var violations []Violation
+
+	if !utf8.Valid(body) {
+		violations = append(violations, Violation{"utf8", "Message must be valid UTF-8"})
+		body = []byte(strings.ToValidUTF8(string(body), ""))
+	}
+
+	value := string(body)
+	if rules.StripControlChars {
+		value = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+				return -1
+			}
+			return r
+		}, value)
+	}
+
+	if rules.NormalizeUnicode {
+		value = norm.NFC.String(value)
+	}
+
+	return value, append(violations, rules.checkLength(value)...)
+}
+
+// checkLength returns every length limit the value violates.
+func (rules PayloadRules) checkLength(value string) []Violation {
+	var violations []Violation
+
+	minLength := rules.MinLength
+	if minLength <= 0 {
+		minLength = defaultMinLength
+	}
+
+	length := utf8.RuneCountInString(value)
+	if length < minLength {
+		violations = append(violations, Violation{"min_length", fmt.Sprintf("Message must be at least %d characters", minLength)})
+	}
+	if rules.MaxLength > 0 && length > rules.MaxLength {
+		violations = append(violations, Violation{"max_length", fmt.Sprintf("Message must be at most %d characters", rules.MaxLength)})
+	}
+
+	return violations
+}
+
+func respondWithViolations(w http.ResponseWriter, violations []Violation) {
+	respondWithJSON(w, http.StatusBadRequest, validationError{"Invalid message payload", violations, responseRequestId(w)})
+}
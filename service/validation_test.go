@@ -0,0 +1,68 @@
+package service
+
+import (
+	"testing"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"bytes"
+	"strings"
+)
+
+func Test_ShouldRejectEmptyMessageByDefault(t *testing.T) {
+	_, violations := PayloadRules{}.apply([]byte(""))
+
+	assert.Equal(t, []Violation{{"min_length", "Message must be at least 1 characters"}}, violations, "Violations not as expected")
+}
+
+func Test_ShouldReportEveryViolatedRule(t *testing.T) {
+	_, violations := PayloadRules{MaxLength: 3}.apply([]byte("abc\xffdef"))
+
+	assert.Equal(t, 2, len(violations), "Expected two violations")
+	assert.Equal(t, "utf8", violations[0].Rule, "First violation not as expected")
+	assert.Equal(t, "max_length", violations[1].Rule, "Second violation not as expected")
+}
+
+func Test_ShouldStripControlCharactersButKeepWhitespace(t *testing.T) {
+	value, violations := PayloadRules{StripControlChars: true}.apply([]byte("line one\x00\x1b\nline\ttwo"))
+
+	assert.Nil(t, violations)
+	assert.Equal(t, "line one\nline\ttwo", value, "Control characters were not stripped as expected")
+}
+
+func Test_ShouldNormalizeUnicodeToNFC(t *testing.T) {
+	value, violations := PayloadRules{NormalizeUnicode: true, MaxLength: 4}.apply([]byte("cafe\u0301"))
+
+	assert.Nil(t, violations, "Length should be checked after normalization")
+	assert.Equal(t, "caf\u00e9", value, "Message was not normalized as expected")
+}
+
+func Test_ShouldFailToCreateMessageDueToInvalidPayload(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Payload: PayloadRules{MaxLength: 5}}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBuffer([]byte("Test message value")))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Invalid message payload\",\"violations\":[{\"rule\":\"max_length\",\"message\":\"Message must be at most 5 characters\"}]}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldFailToCreateMessageDueToPayloadTooLarge(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	router = (&MessageServiceRouter{Payload: PayloadRules{MaxBodyBytes: 10}}).NewServiceRouter(db)
+
+	req, _ := http.NewRequest("POST", "/messages/", strings.NewReader("Test message value"))
+	response := executeRequest(req)
+
+	err := mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Message payload too large\"}", response.Body.String(), "Response body does not match expected value")
+}
@@ -0,0 +1,451 @@
+package service
+
+import (
+	"amigo-tech-test/service/model"
+	"amigo-tech-test/util"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultWebhookMaxAttempts     = 8
+	defaultWebhookRetryBackoff    = 10 * time.Second
+	defaultWebhookRetryMaxBackoff = time.Hour
+	defaultWebhookTimeout         = 10 * time.Second
+	defaultWebhookPollInterval    = time.Second
+	defaultWebhookBatchSize       = 10
+
+	// webhookSecretBytes is the length of the secrets generated for webhooks created without one.
+	webhookSecretBytes = 32
+	// webhookResponseLimit is how much of a receiver's response is read, so that the connection can
+	// be reused, before it is discarded.
+	webhookResponseLimit = 64 << 10
+)
+
+// Webhooks controls the delivery of message events to the webhooks managed on /admin/webhooks/.
+type Webhooks struct {
+	// Enabled queues and delivers events to webhooks, and registers the endpoints managing them.
+	Enabled bool `mapstructure:"enabled"`
+	// MaxAttempts is how many times a delivery is attempted before it is marked dead, defaulting to 8.
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// RetryBackoff is the delay before the first retry, doubling with each retry up to
+	// RetryMaxBackoff. Defaults to 10 seconds, up to an hour.
+	RetryBackoff    time.Duration `mapstructure:"retry_backoff"`
+	RetryMaxBackoff time.Duration `mapstructure:"retry_max_backoff"`
+	// Timeout bounds each delivery, defaulting to 10 seconds.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// PollInterval is how often the queue is checked for deliveries which are due, defaulting to a
+	// second.
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	// BatchSize is how many deliveries are attempted at once, defaulting to 10.
+	BatchSize int `mapstructure:"batch_size"`
+	// AllowedNetworks are CIDR ranges of internal addresses, such as private, loopback or link-local
+	// ones, which webhooks may be delivered to. Deliveries to any other such address are refused.
+	AllowedNetworks []string `mapstructure:"allowed_networks"`
+}
+
+func (wh Webhooks) maxAttempts() int {
+	return orDefault(wh.MaxAttempts, defaultWebhookMaxAttempts)
+}
+
+func (wh Webhooks) backoff() util.Backoff {
+	backoff := util.Backoff{Initial: wh.RetryBackoff, Max: wh.RetryMaxBackoff}
+	if backoff.Initial <= 0 {
+		backoff.Initial = defaultWebhookRetryBackoff
+	}
+	if backoff.Max <= 0 {
+		backoff.Max = defaultWebhookRetryMaxBackoff
+	}
+	return backoff
+}
+
+func (wh Webhooks) timeout() time.Duration {
+	return orDefault(wh.Timeout, defaultWebhookTimeout)
+}
+
+func (wh Webhooks) pollInterval() time.Duration {
+	return orDefault(wh.PollInterval, defaultWebhookPollInterval)
+}
+
+func (wh Webhooks) batchSize() int {
+	return orDefault(wh.BatchSize, defaultWebhookBatchSize)
+}
+
+// allowedNetworks parses AllowedNetworks, ignoring any range which is not valid CIDR as the config
+// is validated before the service starts.
+func (wh Webhooks) allowedNetworks() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, value := range wh.AllowedNetworks {
+		if _, network, err := net.ParseCIDR(value); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// lease is how long a claimed delivery is held before any instance may attempt it again, allowing
+// for the delivery itself and recording its outcome.
+func (wh Webhooks) lease() time.Duration {
+	return 3 * wh.timeout()
+}
+
+var webhookEvents = []string{eventCreated, eventUpdated, eventDeleted,
+	model.EventClaimed, model.EventAcknowledged, model.EventReleased, model.EventDeadLettered}
+
+// signWebhook signs a delivery's timestamp and body with the webhook's secret, so that receivers
+// can check a delivery came from the service and reject replays of old ones.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookClient returns the client deliveries are posted with. The address each connection is
+// made to is checked once it has been resolved, so that a webhook cannot reach internal services
+// through its own host name or one which resolves differently later. Proxies are not used, as they
+// would be dialled instead of the webhook.
+func newWebhookClient(timeout time.Duration, allowed []*net.IPNet) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   webhookDialControl(allowed),
+	}).DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		// Redirects are not followed, and count as failed deliveries
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// internalNetworks are the special-purpose ranges webhooks are not delivered to: private, shared
+// (CGNAT), loopback, link-local, benchmarking, documentation, multicast and reserved addresses, and
+// the IPv6 ranges which translate to IPv4 addresses. IPv4-mapped IPv6 addresses are checked as IPv4.
+var internalNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// webhookDialControl refuses connections to addresses in internalNetworks, unless they are in one of
+// the allowed networks.
+func webhookDialControl(allowed []*net.IPNet) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			return fmt.Errorf("Webhook address %q is not an IP address", host)
+		}
+		addr = addr.Unmap()
+
+		internal := slices.ContainsFunc(internalNetworks, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+		if !internal {
+			return nil
+		}
+		for _, network := range allowed {
+			if network.Contains(addr.AsSlice()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("Webhook address %s is not allowed", addr)
+	}
+}
+
+// deliverWebhooks attempts the deliveries which are due until shutdown, finishing those in progress.
+func (sr *MessageServiceRouter) deliverWebhooks(ctx context.Context) {
+	pollBatches(ctx, sr.Webhooks.pollInterval(), nil, sr.Webhooks.batchSize(), sr.deliverWebhookBatch)
+}
+
+// deliverWebhookBatch claims a batch of deliveries which are due and attempts them concurrently,
+// returning how many were claimed.
+func (sr *MessageServiceRouter) deliverWebhookBatch(ctx context.Context) int {
+	claimCtx, cancel := withTimeout(ctx, sr.current().Timeouts.Write)
+	defer cancel()
+
+	var deliveries []model.WebhookDelivery
+	err := sr.write(claimCtx, func(ctx context.Context) (err error) {
+		deliveries, err = model.ClaimWebhookDeliveries(ctx, sr.db, sr.Storage, sr.Webhooks.batchSize(), sr.Webhooks.lease())
+		return err
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Unable to claim webhook deliveries", "error", err)
+		}
+		return 0
+	}
+
+	// Deliveries which have been claimed are finished even if shutdown begins
+	ctx = context.WithoutCancel(ctx)
+	var wg sync.WaitGroup
+	for i := range deliveries {
+		wg.Add(1)
+		go func(d *model.WebhookDelivery) {
+			defer wg.Done()
+			sr.attemptWebhook(ctx, d)
+		}(&deliveries[i])
+	}
+	wg.Wait()
+	return len(deliveries)
+}
+
+// attemptWebhook sends a delivery and records the outcome, scheduling a retry with backoff when it
+// fails or marking it dead once it has failed MaxAttempts times.
+func (sr *MessageServiceRouter) attemptWebhook(ctx context.Context, d *model.WebhookDelivery) {
+	responseStatus, err := sr.sendWebhook(ctx, d)
+
+	d.Attempts++
+	d.LastError = ""
+	if responseStatus != 0 {
+		d.ResponseStatus = &responseStatus
+	}
+	var retryIn time.Duration
+	switch {
+	case err == nil:
+		d.Status = model.DeliveryDelivered
+	case d.Attempts >= sr.Webhooks.maxAttempts():
+		d.Status = model.DeliveryDead
+		d.LastError = err.Error()
+		slog.WarnContext(ctx, "Webhook delivery failed too many times, giving up",
+			"error", err, "webhook_id", d.WebhookId, "delivery_id", d.Id, "attempts", d.Attempts)
+	default:
+		d.LastError = err.Error()
+		retryIn = sr.Webhooks.backoff().Delay(d.Attempts)
+	}
+
+	recordCtx, cancel := withTimeout(ctx, sr.current().Timeouts.Write)
+	defer cancel()
+
+	err = sr.write(recordCtx, func(ctx context.Context) error { return d.RecordWebhookAttempt(ctx, sr.db, retryIn) })
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to record webhook delivery, it will be attempted again",
+			"error", err, "webhook_id", d.WebhookId, "delivery_id", d.Id)
+	}
+}
+
+// sendWebhook posts a delivery's payload to its webhook, returning the response status. Anything
+// other than a 2xx response is a failure.
+func (sr *MessageServiceRouter) sendWebhook(ctx context.Context, d *model.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Url, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(d.Id))
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(d.Secret, timestamp, d.Payload))
+
+	response, err := sr.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, webhookResponseLimit))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("Webhook responded with %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+func (sr *MessageServiceRouter) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Search)
+	defer cancel()
+
+	var webhooks []model.Webhook
+	err := sr.read(ctx, func(ctx context.Context) (err error) {
+		webhooks, err = model.GetWebhooks(ctx, sr.db)
+		return err
+	})
+	if err != nil {
+		respondWithStoreError(w, ctx, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, webhooks)
+}
+
+// createWebhook subscribes a URL to message events. A secret is generated when none is given, and
+// is only ever returned in the response.
+func (sr *MessageServiceRouter) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var webhook model.Webhook
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if u, err := url.Parse(webhook.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook URL")
+		return
+	}
+	if len(webhook.Events) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Webhook must subscribe to at least one event")
+		return
+	}
+	for _, event := range webhook.Events {
+		if !slices.Contains(webhookEvents, event) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown webhook event %q", event))
+			return
+		}
+	}
+	if webhook.Secret == "" {
+		secret := make([]byte, webhookSecretBytes)
+		if _, err := rand.Read(secret); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Write)
+	defer cancel()
+
+	audit := sr.auditEntry(r, auditCreate, auditWebhook, 0)
+	if err := sr.write(ctx, func(ctx context.Context) error { return webhook.CreateWebhook(ctx, sr.db, sr.Storage, audit) }); err != nil {
+		respondWithStoreError(w, ctx, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, map[string]interface{}{"id": webhook.Id, "secret": webhook.Secret})
+}
+
+func (sr *MessageServiceRouter) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["Id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Write)
+	defer cancel()
+
+	webhook := model.Webhook{Id: id}
+	audit := sr.auditEntry(r, auditDelete, auditWebhook, id)
+	if err := sr.write(ctx, func(ctx context.Context) error { return webhook.DeleteWebhook(ctx, sr.db, audit) }); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Webhook not found")
+		default:
+			respondWithStoreError(w, ctx, err)
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// getWebhookDeliveries returns a page of a webhook's delivery log, newest first, optionally filtered
+// by status.
+func (sr *MessageServiceRouter) getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["Id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	queryVals := r.URL.Query()
+	offset, limit := getPaging(queryVals, sr.current().Paging)
+	status := getQueryParamOrDefault(queryVals, "status", "")
+	if status != "" && status != model.DeliveryPending && status != model.DeliveryDelivered && status != model.DeliveryDead {
+		respondWithError(w, http.StatusBadRequest, "Invalid delivery status")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Search)
+	defer cancel()
+
+	var result *model.Page
+	err = sr.read(ctx, func(ctx context.Context) (err error) {
+		result, err = model.GetWebhookDeliveries(ctx, sr.db, sr.Storage, id, status, offset, limit)
+		return err
+	})
+	if err != nil {
+		respondWithStoreError(w, ctx, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, result)
+}
+
+// retryWebhookDelivery queues a dead delivery to be attempted again.
+func (sr *MessageServiceRouter) retryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["Id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+	deliveryId, err := strconv.Atoi(vars["DeliveryId"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid delivery ID")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), sr.current().Timeouts.Write)
+	defer cancel()
+
+	if err := sr.write(ctx, func(ctx context.Context) error { return model.RetryWebhookDelivery(ctx, sr.db, id, deliveryId) }); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Dead delivery not found")
+		default:
+			respondWithStoreError(w, ctx, err)
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newWebhookRouter routes requests with webhooks enabled. The queue is never polled during a test,
+// which attempts deliveries itself. Deliveries may be made to the loopback receivers tests start
+// unless other networks are allowed.
+func newWebhookRouter(t *testing.T, webhooks Webhooks, db *sql.DB) *MessageServiceRouter {
+	webhooks.Enabled = true
+	webhooks.PollInterval = time.Hour
+	if webhooks.AllowedNetworks == nil {
+		webhooks.AllowedNetworks = []string{"127.0.0.0/8"}
+	}
+	sr := &MessageServiceRouter{Webhooks: webhooks, Admin: testAdmin}
+	router = sr.NewServiceRouter(db)
+	t.Cleanup(func() { sr.Shutdown(context.Background()) })
+	return sr
+}
+
+// errorContaining matches a recorded error message containing the text.
+type errorContaining string
+
+func (e errorContaining) Match(v driver.Value) bool {
+	message, ok := v.(string)
+	return ok && strings.Contains(message, string(e))
+}
+
+func expectDeliveryClaim(mock sqlmock.Sqlmock, url string, attempts int) {
+	mock.ExpectQuery("UPDATE webhook_deliveries SET next_attempt_at = (.+) FOR UPDATE SKIP LOCKED").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "webhook_id", "event", "message_id", "payload", "key_id", "attempts", "url", "secret", "key_id"}).
+			AddRow(7, 3, "created", 11, `{"event":"created","message_id":11}`, nil, attempts, url, "shh", nil))
+}
+
+func Test_ShouldCreateWebhookWithGeneratedSecret(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	newWebhookRouter(t, Webhooks{}, db)
+
+	mock.ExpectQuery("INSERT INTO webhooks").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(3, time.Now()))
+
+	req, _ := http.NewRequest("POST", "/admin/webhooks/", bytes.NewBufferString(`{"url":"https://example.com/hooks","events":["created"]}`))
+	response := executeAdminRequest(req)
+
+	var body struct {
+		Id     int    `json:"id"`
+		Secret string `json:"secret"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &body)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, http.StatusCreated, response.Code, "Response status code not as expected")
+	assert.Equal(t, 3, body.Id, "Webhook ID not as expected")
+	assert.Len(t, body.Secret, 64, "A secret should be generated")
+}
+
+func Test_ShouldRejectWebhookWithUnknownEvent(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	newWebhookRouter(t, Webhooks{}, db)
+
+	req, _ := http.NewRequest("POST", "/admin/webhooks/", bytes.NewBufferString(`{"url":"https://example.com/hooks","events":["edited"]}`))
+	response := executeAdminRequest(req)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Response status code not as expected")
+	assert.Equal(t, "{\"error\":\"Unknown webhook event \\\"edited\\\"\"}", response.Body.String(), "Response body does not match expected value")
+}
+
+func Test_ShouldQueueWebhooksMatchingCreatedMessage(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	newWebhookRouter(t, Webhooks{}, db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO messages").WillReturnRows(sqlmock.NewRows([]string{"id", "date_created"}).AddRow(11, time.Now()))
+	mock.ExpectQuery("SELECT (.+) FROM webhooks WHERE \\$1 = ANY\\(events\\)").
+		WithArgs("created").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "url", "events", "filter_message", "filter_ip", "date_created"}).
+			AddRow(1, "https://example.com/hello", "{created}", "hello", "", time.Now()).
+			AddRow(2, "https://example.com/other", "{created,deleted}", "other", "", time.Now()))
+	mock.ExpectExec("INSERT INTO webhook_deliveries").
+		WithArgs(1, "created", 11, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	req, _ := http.NewRequest("POST", "/messages/", bytes.NewBufferString("hello world"))
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusCreated, response.Code, "Response status code not as expected")
+	assert.Nil(t, mock.ExpectationsWereMet(), "Only the matching webhook should be queued")
+}
+
+func Test_ShouldDeliverSignedWebhook(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer receiver.Close()
+
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	sr := newWebhookRouter(t, Webhooks{}, db)
+
+	expectDeliveryClaim(mock, receiver.URL, 0)
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$1, attempts = \\$2, response_status = \\$3, last_error = \\$4, date_delivered = NOW\\(\\) WHERE id = \\$5").
+		WithArgs("delivered", 1, 200, "", 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.Equal(t, 1, sr.deliverWebhookBatch(context.Background()), "One delivery should be claimed")
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, `{"event":"created","message_id":11}`, string(body), "Payload not as expected")
+	assert.Equal(t, "7", received.Header.Get("X-Webhook-Delivery"), "Delivery ID not as expected")
+	assert.Equal(t, "created", received.Header.Get("X-Webhook-Event"), "Event not as expected")
+	assert.Equal(t, signWebhook("shh", received.Header.Get("X-Webhook-Timestamp"), body), received.Header.Get("X-Webhook-Signature"), "Signature not as expected")
+}
+
+func Test_ShouldRetryFailedWebhookDelivery(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	sr := newWebhookRouter(t, Webhooks{RetryBackoff: 20 * time.Second}, db)
+
+	expectDeliveryClaim(mock, receiver.URL, 0)
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$1, attempts = \\$2, response_status = \\$3, last_error = \\$4, next_attempt_at = NOW\\(\\) \\+ make_interval\\(secs => \\$5\\) WHERE id = \\$6").
+		WithArgs("pending", 1, 500, "Webhook responded with 500 Internal Server Error", sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	sr.deliverWebhookBatch(context.Background())
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_ShouldRefuseWebhookDeliveryToInternalAddress(t *testing.T) {
+	delivered := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered = true
+	}))
+	defer receiver.Close()
+
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	sr := newWebhookRouter(t, Webhooks{AllowedNetworks: []string{"10.0.0.0/8"}}, db)
+
+	expectDeliveryClaim(mock, receiver.URL, 0)
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$1, attempts = \\$2, response_status = \\$3, last_error = \\$4, next_attempt_at = (.+) WHERE id = \\$6").
+		WithArgs("pending", 1, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	sr.deliverWebhookBatch(context.Background())
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.False(t, delivered, "Delivery to a loopback address should be refused")
+}
+
+func Test_ShouldRefuseWebhookDeliveryToSharedAddressSpace(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	sr := newWebhookRouter(t, Webhooks{}, db)
+
+	expectDeliveryClaim(mock, "http://100.64.0.1/hooks", 0)
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$1, attempts = \\$2, response_status = \\$3, last_error = \\$4, next_attempt_at = (.+) WHERE id = \\$6").
+		WithArgs("pending", 1, nil, errorContaining("Webhook address 100.64.0.1 is not allowed"), sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	sr.deliverWebhookBatch(context.Background())
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_ShouldOnlyAllowWebhookAddressesOutsideInternalNetworks(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.1.0.0/16")
+	control := webhookDialControl([]*net.IPNet{allowed})
+
+	for _, tc := range []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1::1]:443", true},
+		{"10.1.2.3:80", true},
+		{"10.2.0.1:80", false},
+		{"127.0.0.1:8080", false},
+		{"[::1]:8080", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"192.168.1.10:80", false},
+		{"0.0.0.0:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"100.64.0.1:80", false},
+		{"0.1.2.3:80", false},
+		{"198.18.0.1:80", false},
+		{"224.0.0.1:80", false},
+		{"255.255.255.255:80", false},
+		{"[fd00::1]:80", false},
+		{"[64:ff9b::a9fe:a9fe]:80", false},
+	} {
+		err := control("tcp", tc.address, nil)
+		assert.Equal(t, tc.allowed, err == nil, "Address %s not checked as expected: %v", tc.address, err)
+	}
+}
+
+func Test_ShouldMarkWebhookDeliveryDeadAfterMaxAttempts(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	sr := newWebhookRouter(t, Webhooks{MaxAttempts: 3}, db)
+
+	// Nothing is listening on the port of a closed server
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	receiver.Close()
+
+	expectDeliveryClaim(mock, receiver.URL, 2)
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$1, attempts = \\$2, response_status = \\$3, last_error = \\$4 WHERE id = \\$5").
+		WithArgs("dead", 3, nil, sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	sr.deliverWebhookBatch(context.Background())
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_ShouldRetryDeadWebhookDelivery(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	newWebhookRouter(t, Webhooks{}, db)
+
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$1, attempts = \\$2, next_attempt_at = NOW\\(\\)").
+		WithArgs("pending", 0, 7, "dead", 3).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req, _ := http.NewRequest("POST", "/admin/webhooks/3/deliveries/7/retry", nil)
+	response := executeAdminRequest(req)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, http.StatusNotFound, response.Code, "Delivery which is not dead should not be retried")
+}
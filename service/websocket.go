@@ -0,0 +1,299 @@
+package service
+
+import (
+	"amigo-tech-test/service/model"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	socketSubscribe   = "subscribe"
+	socketUnsubscribe = "unsubscribe"
+	socketPost        = "post"
+
+	// socketWriteTimeout bounds each frame written to a socket, so that a client which stops reading
+	// cannot hold up its connection indefinitely.
+	socketWriteTimeout = 10 * time.Second
+	// socketFrameOverhead allows for the rest of a post request, and escaping in its value, when
+	// limiting the size of the frames read from a socket.
+	socketFrameOverhead = 4096
+)
+
+// upgrader accepts WebSocket connections from pages served from the same origin as the service, or
+// clients which do not send an Origin header.
+var upgrader = websocket.Upgrader{}
+
+// socketRequest is a request sent by a client over a socket. Id identifies the subscription for
+// subscribe and unsubscribe requests, and is echoed back in the acknowledgement of a post. DeliverAt
+// optionally schedules a posted message.
+type socketRequest struct {
+	Type      string    `json:"type"`
+	Id        string    `json:"id"`
+	Message   string    `json:"message"`
+	Ip        string    `json:"ip"`
+	Value     string    `json:"value"`
+	DeliverAt time.Time `json:"deliver_at"`
+}
+
+// socketFrame is sent to a client over a socket: an acknowledgement or error in reply to one of
+// its requests, or an event for one of its subscriptions.
+type socketFrame struct {
+	Type         string         `json:"type"`
+	Id           string         `json:"id,omitempty"`
+	Subscription string         `json:"subscription,omitempty"`
+	Event        string         `json:"event,omitempty"`
+	MessageId    int            `json:"message_id,omitempty"`
+	Message      *model.Message `json:"message,omitempty"`
+	Status       string         `json:"status,omitempty"`
+	Code         int            `json:"code,omitempty"`
+	Error        string         `json:"error,omitempty"`
+	Violations   []Violation    `json:"violations,omitempty"`
+	Reasons      []string       `json:"reasons,omitempty"`
+	RetryAfter   int            `json:"retry_after,omitempty"`
+	DeliverAt    *time.Time     `json:"deliver_at,omitempty"`
+}
+
+func errorFrame(id string, code int, message string) socketFrame {
+	return socketFrame{Type: "error", Id: id, Code: code, Error: message}
+}
+
+func (e *messageError) frame(id string) socketFrame {
+	frame := errorFrame(id, e.Status, e.Message)
+	frame.Violations = e.Violations
+	frame.Reasons = e.Reasons
+	frame.RetryAfter = int(math.Ceil(e.RetryAfter.Seconds()))
+	return frame
+}
+
+// socket is a client connected on /ws. Frames are queued for a single writer, and a client which
+// falls more than the stream buffer behind is disconnected rather than queueing without limit.
+type socket struct {
+	sr   *MessageServiceRouter
+	conn *websocket.Conn
+	// r is the upgrade request, which posts are attributed to as if they were made over HTTP.
+	r    *http.Request
+	send chan socketFrame
+	wg   sync.WaitGroup
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	closeCode int
+	closeText string
+
+	mu     sync.Mutex
+	feeds  map[string]streamFilter
+	events chan messageEvent
+}
+
+// serveWebSocket lets clients subscribe to filtered feeds of message events and post messages over
+// a single connection. Posts are handled one at a time, in the order they are sent, so a client
+// posting faster than messages can be stored is slowed down rather than queued.
+func (sr *MessageServiceRouter) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already responded with the error
+		return
+	}
+
+	// Posts are abandoned once the client has gone, as they would be over HTTP
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	s := &socket{
+		sr:     sr,
+		conn:   conn,
+		r:      r.WithContext(ctx),
+		send:   make(chan socketFrame, sr.Streams.buffer()),
+		closed: make(chan struct{}),
+		feeds:  map[string]streamFilter{},
+	}
+	s.wg.Add(1)
+	go s.writeFrames()
+
+	s.readRequests()
+	s.close(websocket.CloseNormalClosure, "")
+
+	s.mu.Lock()
+	if s.events != nil {
+		sr.events.unsubscribe(s.events)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *socket) readRequests() {
+	timeout := 2 * s.sr.Streams.heartbeat()
+	s.conn.SetReadLimit(2*s.sr.current().Payload.maxBodyBytes() + socketFrameOverhead)
+	s.conn.SetReadDeadline(time.Now().Add(timeout))
+	s.conn.SetPongHandler(func(string) error { return s.conn.SetReadDeadline(time.Now().Add(timeout)) })
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(timeout))
+
+		var req socketRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			s.enqueue(errorFrame("", http.StatusBadRequest, "Invalid request"))
+			continue
+		}
+		switch req.Type {
+		case socketSubscribe:
+			s.subscribe(req)
+		case socketUnsubscribe:
+			s.unsubscribe(req)
+		case socketPost:
+			s.post(req)
+		default:
+			s.enqueue(errorFrame(req.Id, http.StatusBadRequest, "Unknown request type"))
+		}
+	}
+}
+
+// subscribe adds or replaces a feed. The socket subscribes to the event bus with its first feed,
+// so that events are only loaded for sockets which have asked for them.
+func (s *socket) subscribe(req socketRequest) {
+	if req.Id == "" {
+		s.enqueue(errorFrame(req.Id, http.StatusBadRequest, "Subscription ID is required"))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.feeds[req.Id] = streamFilter{message: req.Message, ipAddress: req.Ip}
+	if s.events == nil {
+		s.events = s.sr.events.subscribe(s.sr.Streams.buffer())
+		s.wg.Add(1)
+		go s.forwardEvents(s.events)
+	}
+	s.enqueue(socketFrame{Type: "subscribed", Id: req.Id})
+}
+
+func (s *socket) unsubscribe(req socketRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.feeds[req.Id]; !ok {
+		s.enqueue(errorFrame(req.Id, http.StatusNotFound, "Subscription not found"))
+		return
+	}
+	delete(s.feeds, req.Id)
+	s.enqueue(socketFrame{Type: "unsubscribed", Id: req.Id})
+}
+
+// forwardEvents sends each event to every feed it matches until the socket unsubscribes from the
+// event bus, or the bus drops it for falling behind.
+func (s *socket) forwardEvents(events chan messageEvent) {
+	defer s.wg.Done()
+
+	for event := range events {
+		s.mu.Lock()
+		for id, filter := range s.feeds {
+			if filter.matches(event) {
+				s.enqueue(eventFrame(id, event))
+			}
+		}
+		s.mu.Unlock()
+	}
+	s.dropSlowConsumer()
+}
+
+func eventFrame(subscription string, event messageEvent) socketFrame {
+	frame := socketFrame{Type: "event", Subscription: subscription, Event: event.Type, MessageId: event.Id}
+	if event.Message != nil {
+		m := *event.Message
+		m.ModerationReason = ""
+		frame.Message = &m
+	}
+	return frame
+}
+
+// post stores a message with the same checks as a POST to /messages/, acknowledging it with the
+// new message's ID.
+func (s *socket) post(req socketRequest) {
+	settings := s.sr.current()
+	if int64(len(req.Value)) > settings.Payload.maxBodyBytes() {
+		s.enqueue(errorFrame(req.Id, http.StatusRequestEntityTooLarge, errBodyTooLarge.Error()))
+		return
+	}
+	if s.sr.blockList != nil && s.sr.blocked(s.r) {
+		s.enqueue(errorFrame(req.Id, http.StatusForbidden, "Requests from this address are blocked"))
+		return
+	}
+
+	m, failure := s.sr.newMessage(s.r, settings, []byte(req.Value), req.DeliverAt)
+	if failure != nil {
+		s.enqueue(failure.frame(req.Id))
+		return
+	}
+	s.enqueue(socketFrame{Type: "ack", Id: req.Id, MessageId: m.Id, Status: m.Status, DeliverAt: m.DeliverAt})
+}
+
+// enqueue queues a frame for the writer without blocking, disconnecting the client if its queue
+// is full.
+func (s *socket) enqueue(frame socketFrame) {
+	select {
+	case s.send <- frame:
+	case <-s.closed:
+	default:
+		s.dropSlowConsumer()
+	}
+}
+
+func (s *socket) dropSlowConsumer() {
+	select {
+	case <-s.closed:
+	default:
+		slog.WarnContext(s.r.Context(), "Disconnecting WebSocket client which fell behind")
+		s.close(websocket.ClosePolicyViolation, "Too slow")
+	}
+}
+
+// close starts closing the socket with a close frame, which the writer sends before closing the
+// connection.
+func (s *socket) close(code int, text string) {
+	s.closeOnce.Do(func() {
+		s.closeCode, s.closeText = code, text
+		close(s.closed)
+	})
+}
+
+func (s *socket) writeFrames() {
+	defer s.wg.Done()
+	defer s.conn.Close()
+
+	ping := time.NewTicker(s.sr.Streams.heartbeat())
+	defer ping.Stop()
+
+	drained := s.sr.drained
+	for {
+		var err error
+		select {
+		case frame := <-s.send:
+			s.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+			err = s.conn.WriteJSON(frame)
+		case <-ping.C:
+			err = s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteTimeout))
+		case <-drained:
+			drained = nil
+			s.close(websocket.CloseGoingAway, "Server shutting down")
+		case <-s.closed:
+			s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(s.closeCode, s.closeText),
+				time.Now().Add(socketWriteTimeout))
+			return
+		}
+		if err != nil {
+			s.close(websocket.CloseAbnormalClosure, "")
+			return
+		}
+	}
+}
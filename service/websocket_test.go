@@ -0,0 +1,126 @@
+package service
+
+import (
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openSocket(t *testing.T, server *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Failed to open socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) socketFrame {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame socketFrame
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatalf("Socket closed before a frame was read: %v", err)
+	}
+	return frame
+}
+
+func Test_ShouldAcknowledgeMessagePostedOverWebSocket(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	server := newStreamServer(t, &MessageServiceRouter{}, db)
+
+	mock.ExpectQuery("INSERT INTO messages").
+		WithArgs("Test message value", "127.0.0.1", "approved", "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(41))
+
+	conn := openSocket(t, server)
+	conn.WriteJSON(socketRequest{Type: "post", Id: "p1", Value: "Test message value"})
+
+	assert.Equal(t, socketFrame{Type: "ack", Id: "p1", MessageId: 41, Status: "approved"}, readFrame(t, conn), "Acknowledgement not as expected")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_ShouldValidateMessagePostedOverWebSocket(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	server := newStreamServer(t, &MessageServiceRouter{}, db)
+
+	conn := openSocket(t, server)
+	conn.WriteJSON(socketRequest{Type: "post", Id: "p1", Value: ""})
+
+	frame := readFrame(t, conn)
+	assert.Equal(t, "error", frame.Type, "Frame type not as expected")
+	assert.Equal(t, "p1", frame.Id, "Error should be for the post")
+	assert.Equal(t, 400, frame.Code, "Error code not as expected")
+	assert.Equal(t, []Violation{{"min_length", "Message must be at least 1 characters"}}, frame.Violations, "Violations not as expected")
+}
+
+func Test_ShouldSendEventsForMatchingSubscriptions(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	server := newStreamServer(t, &MessageServiceRouter{}, db)
+
+	conn := openSocket(t, server)
+	conn.WriteJSON(socketRequest{Type: "subscribe", Id: "hello", Message: "hello"})
+	conn.WriteJSON(socketRequest{Type: "subscribe", Id: "everything"})
+	conn.WriteJSON(socketRequest{Type: "unsubscribe", Id: "everything"})
+	assert.Equal(t, socketFrame{Type: "subscribed", Id: "hello"}, readFrame(t, conn))
+	assert.Equal(t, socketFrame{Type: "subscribed", Id: "everything"}, readFrame(t, conn))
+	assert.Equal(t, socketFrame{Type: "unsubscribed", Id: "everything"}, readFrame(t, conn))
+
+	mock.ExpectQuery("INSERT INTO messages").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(21))
+	expectMessageLoad(mock, 21, "something else", "127.0.0.1")
+	mock.ExpectQuery("INSERT INTO messages").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(22))
+	expectMessageLoad(mock, 22, "hello world", "127.0.0.1")
+
+	createMessage(t, server, "something else")
+	createMessage(t, server, "hello world")
+
+	frame := readFrame(t, conn)
+	assert.Equal(t, "event", frame.Type, "Frame type not as expected")
+	assert.Equal(t, "hello", frame.Subscription, "Only the matching subscription should be sent the event")
+	assert.Equal(t, "created", frame.Event, "Event not as expected")
+	assert.Equal(t, 22, frame.MessageId, "Only the matching message should be sent")
+	assert.Equal(t, "hello world", frame.Message.Value, "Message not as expected")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func Test_ShouldDisconnectSlowWebSocketClient(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	sr := &MessageServiceRouter{Streams: Streams{Buffer: 1}}
+	server := newStreamServer(t, sr, db)
+
+	conn := openSocket(t, server)
+	conn.WriteJSON(socketRequest{Type: "subscribe", Id: "everything"})
+	readFrame(t, conn)
+
+	for id := 1; id <= 10000; id++ {
+		sr.events.publish(messageEvent{Type: eventDeleted, Id: id})
+	}
+
+	var err error
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for err == nil {
+		_, _, err = conn.ReadMessage()
+	}
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "Client which fell behind should be disconnected, got %v", err)
+}
+
+func Test_ShouldCloseWebSocketsWhenDraining(t *testing.T) {
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+	sr := &MessageServiceRouter{}
+	server := newStreamServer(t, sr, db)
+
+	conn := openSocket(t, server)
+	sr.Drain()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "Socket should be closed when draining, got %v", err)
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// workers tracks the router's background goroutines so that shutdown can stop them and wait for
+// any work in progress to be flushed.
+type workers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWorkers() *workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workers{ctx: ctx, cancel: cancel}
+}
+
+// run starts fn in the background. The context passed to fn is cancelled when shutdown begins, after
+// which fn should finish any work in progress and return.
+func (w *workers) run(fn func(ctx context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		fn(w.ctx)
+	}()
+}
+
+// pollBatches calls batch every interval, and whenever wake receives, until ctx is cancelled. A
+// batch as large as batchSize suggests a backlog, so batch is called again straight away rather than
+// waiting. A nil wake channel never wakes.
+func pollBatches(ctx context.Context, interval time.Duration, wake <-chan struct{}, batchSize int, batch func(ctx context.Context) int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+		for ctx.Err() == nil && batch(ctx) == batchSize {
+		}
+	}
+}
+
+// orDefault returns value, or fallback when value is not set.
+func orDefault[T int | time.Duration](value, fallback T) T {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// shutdown signals every worker to stop, then waits for them to return or the context to expire.
+func (w *workers) shutdown(ctx context.Context) error {
+	w.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"testing"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"time"
+)
+
+func Test_ShouldWaitForWorkersToFlushOnShutdown(t *testing.T) {
+	w := newWorkers()
+	flushed := false
+
+	w.run(func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		flushed = true
+	})
+
+	err := w.shutdown(context.Background())
+	assert.Nil(t, err)
+
+	assert.True(t, flushed, "Shutdown returned before the worker finished")
+}
+
+func Test_ShouldStopWaitingForWorkersWhenShutdownTimesOut(t *testing.T) {
+	w := newWorkers()
+	release := make(chan struct{})
+	defer close(release)
+
+	w.run(func(ctx context.Context) {
+		<-release
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := w.shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func Test_ShouldPollBatchesAgainWhileBatchesAreFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wake := make(chan struct{}, 1)
+	sizes := []int{10, 10, 3}
+	calls := 0
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pollBatches(ctx, time.Hour, wake, 10, func(ctx context.Context) int {
+			size := sizes[calls]
+			calls++
+			if calls == len(sizes) {
+				cancel()
+			}
+			return size
+		})
+	}()
+	wake <- struct{}{}
+	<-done
+
+	assert.Equal(t, 3, calls, "Batches should be polled until one is not full")
+}
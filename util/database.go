@@ -1,6 +1,18 @@
 package util
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/XSAM/otelsql"
+	"github.com/lib/pq"
+	"io"
+	"net"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.18.0"
+	"regexp"
+)
 
 type DatabaseConnector interface {
 	Open(connectionString string) (*sql.DB, error)
@@ -8,6 +20,69 @@ type DatabaseConnector interface {
 
 type PostgresDatabaseConnector struct {}
 
+// Open connects to Postgres, recording a span for each statement when tracing is enabled.
 func (PostgresDatabaseConnector) Open(connectionString string) (*sql.DB, error) {
-	return sql.Open("postgres", connectionString)
+	return otelsql.Open("postgres", connectionString,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			DisableQuery:         true,
+			OmitConnResetSession: true,
+			OmitRows:             true,
+		}),
+		otelsql.WithAttributesGetter(statementAttributes))
+}
+
+// statementAttributes records the statement on its span, sanitized in case any values were written
+// into it rather than passed as arguments.
+func statementAttributes(ctx context.Context, method otelsql.Method, query string, args []driver.NamedValue) []attribute.KeyValue {
+	if query == "" {
+		return nil
+	}
+	return []attribute.KeyValue{semconv.DBStatementKey.String(SanitizeQuery(query))}
+}
+
+var queryLiteral = regexp.MustCompile(`'(?:[^']|'')*'|\$?\b\d+(?:\.\d+)?\b`)
+
+// SanitizeQuery replaces the string and numeric literals in a SQL statement with "?", leaving
+// placeholders such as $1 in place.
+func SanitizeQuery(query string) string {
+	return queryLiteral.ReplaceAllStringFunc(query, func(literal string) string {
+		if literal[0] == '$' {
+			return literal
+		}
+		return "?"
+	})
+}
+
+// IsTransientError reports whether a database operation failed in a way which may succeed if it is
+// tried again, such as a dropped connection or a database which is starting up or shutting down.
+// Operations cancelled or timed out by their context are not transient, as there is no time left.
+func IsTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"53300", // too_many_connections
+			"57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03": // cannot_connect_now
+			return true
+		}
+		// Class 08 covers connection exceptions
+		return pqErr.Code.Class() == "08"
+	}
+	return false
 }
@@ -0,0 +1,25 @@
+package util
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ShouldSanitizeQueryLiterals(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT value FROM messages WHERE value = 'hello world'", "SELECT value FROM messages WHERE value = ?"},
+		{"SELECT value FROM messages WHERE value = 'it''s here' AND ip_address = '10.0.0.1'", "SELECT value FROM messages WHERE value = ? AND ip_address = ?"},
+		{"SELECT value FROM messages WHERE value = ''", "SELECT value FROM messages WHERE value = ?"},
+		{"SELECT value FROM messages WHERE value LIKE '%$1%'", "SELECT value FROM messages WHERE value LIKE ?"},
+		{"SELECT value FROM messages LIMIT 20 OFFSET 40", "SELECT value FROM messages LIMIT ? OFFSET ?"},
+		{"SELECT value FROM messages WHERE id > $1 LIMIT $2", "SELECT value FROM messages WHERE id > $1 LIMIT $2"},
+		{"SELECT value FROM messages WHERE id IN ($1,2,$3) AND score > 0.75", "SELECT value FROM messages WHERE id IN ($1,?,$3) AND score > ?"},
+		{"SELECT $10+1", "SELECT $10+?"},
+		{"SELECT col1, v2_total FROM table2 WHERE sha256(value) = $1", "SELECT col1, v2_total FROM table2 WHERE sha256(value) = $1"},
+	} {
+		assert.Equal(t, tc.expected, SanitizeQuery(tc.query), "Query not sanitized as expected: %s", tc.query)
+	}
+}
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// AESGCMSealer encrypts values with AES-GCM, prefixing each ciphertext with its random nonce. The
+// additional data given when a value is sealed is authenticated along with it, and must be given
+// again to open it.
+type AESGCMSealer struct {
+	aead cipher.AEAD
+}
+
+func NewAESGCMSealer(key []byte) (*AESGCMSealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCMSealer{aead}, nil
+}
+
+func (s *AESGCMSealer) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func (s *AESGCMSealer) Open(ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < s.aead.NonceSize() {
+		return nil, errors.New("Ciphertext is too short")
+	}
+	nonce, sealed := ciphertext[:s.aead.NonceSize()], ciphertext[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, sealed, additionalData)
+}
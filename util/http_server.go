@@ -1,16 +1,101 @@
 package util
 
 import (
+	"context"
 	"net/http"
+	"sync"
+	"time"
 )
 
 type HttpServer interface {
 	ListenAndServe(addr string, router http.Handler) error
+	Shutdown(ctx context.Context) error
 }
 
-type DefaultHttpServer struct {}
+// DefaultHttpServer serves plain HTTP unless TLS is configured. Zero timeouts are unlimited.
+type DefaultHttpServer struct {
+	TLS *TLSConfig
+	// ReadHeaderTimeout bounds how long a client may take to send the request headers.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds how long a client may take to send the whole request, including the body.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds how long a request may take from the end of its headers to the end of the
+	// response.
+	WriteTimeout time.Duration
+	// IdleTimeout bounds how long a keep-alive connection waits for the next request.
+	IdleTimeout time.Duration
 
-func (DefaultHttpServer) ListenAndServe(addr string, router http.Handler) error {
-	return http.ListenAndServe(addr, router)
+	mu           sync.Mutex
+	servers      []*http.Server
+	shuttingDown bool
 }
 
+// ListenAndServe blocks until the server fails or is shut down, returning nil after a shutdown.
+func (s *DefaultHttpServer) ListenAndServe(addr string, router http.Handler) error {
+	server := s.newServer(addr, router)
+	if s.TLS == nil {
+		return s.serve(server, server.ListenAndServe)
+	}
+
+	config, certificate, err := s.TLS.serverConfig()
+	if err != nil {
+		return err
+	}
+	defer certificate.Close()
+	server.TLSConfig = config
+	listenAndServeTLS := func() error { return server.ListenAndServeTLS("", "") }
+
+	if s.TLS.RedirectAddr == "" {
+		return s.serve(server, listenAndServeTLS)
+	}
+
+	redirect := s.newServer(s.TLS.RedirectAddr, httpsRedirect(addr))
+
+	errs := make(chan error, 2)
+	go func() { errs <- s.serve(redirect, redirect.ListenAndServe) }()
+	go func() { errs <- s.serve(server, listenAndServeTLS) }()
+	return <-errs
+}
+
+func (s *DefaultHttpServer) newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+	}
+}
+
+func (s *DefaultHttpServer) serve(server *http.Server, listenAndServe func() error) error {
+	s.mu.Lock()
+	if s.shuttingDown {
+		s.mu.Unlock()
+		return nil
+	}
+	s.servers = append(s.servers, server)
+	s.mu.Unlock()
+
+	if err := listenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting new connections and waits for in-flight requests to complete, until the
+// context expires.
+func (s *DefaultHttpServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	servers := s.servers
+	s.mu.Unlock()
+
+	var result error
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,195 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Keyring holds the key encryption keys used for envelope encryption, along with the key used to
+// build blind index tokens. It is loaded from a JSON file of base64 encoded 256-bit keys:
+//
+//	{
+//	  "active_key": "2017-07",
+//	  "keys": { "2017-06": "...", "2017-07": "..." },
+//	  "index_key": "..."
+//	}
+//
+// New values are always encrypted with the active key. Older keys must stay in the file until every
+// value encrypted with them has been rotated.
+type Keyring struct {
+	active   string
+	keys     map[string]*AESGCMSealer
+	indexKey []byte
+}
+
+type keyringFile struct {
+	ActiveKey string            `json:"active_key"`
+	Keys      map[string]string `json:"keys"`
+	IndexKey  string            `json:"index_key"`
+}
+
+const envelopeVersion = 1
+
+var ErrUnknownKey = errors.New("Value was encrypted with a key which is not in the keyring")
+
+func LoadKeyring(path string) (*Keyring, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyringFile
+	if err := json.Unmarshal(contents, &file); err != nil {
+		return nil, fmt.Errorf("Keyring %s is not valid JSON: %s", path, err)
+	}
+
+	keys := make(map[string][]byte, len(file.Keys))
+	for id, encoded := range file.Keys {
+		if keys[id], err = decodeKey(encoded); err != nil {
+			return nil, fmt.Errorf("Keyring %s has an invalid key %q: %s", path, id, err)
+		}
+	}
+
+	indexKey, err := decodeKey(file.IndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("Keyring %s has an invalid index key: %s", path, err)
+	}
+	return NewKeyring(file.ActiveKey, keys, indexKey)
+}
+
+func NewKeyring(active string, keys map[string][]byte, indexKey []byte) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("Active key %q is not in the keyring", active)
+	}
+
+	sealers := make(map[string]*AESGCMSealer, len(keys))
+	for id, key := range keys {
+		if len(id) > 255 {
+			return nil, fmt.Errorf("Key ID %q is too long", id)
+		}
+		sealer, err := NewAESGCMSealer(key)
+		if err != nil {
+			return nil, err
+		}
+		sealers[id] = sealer
+	}
+	return &Keyring{active, sealers, indexKey}, nil
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("expected a 32 byte key, found %d bytes", len(key))
+	}
+	return key, nil
+}
+
+func (k *Keyring) ActiveKeyId() string {
+	return k.active
+}
+
+// Seal encrypts the plaintext under a new random data key, which is itself encrypted with the active
+// key. The additional data, such as where the value is stored, is authenticated with the value, so
+// the value only opens with the same additional data. The result is self-describing:
+//
+//	version (1 byte) | key ID length (1) | key ID | wrapped data key length (2) | wrapped data key | sealed value
+func (k *Keyring) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	dataSealer, err := NewAESGCMSealer(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := dataSealer.Seal(plaintext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := k.keys[k.active].Seal(dataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := make([]byte, 0, 4+len(k.active)+len(wrappedKey)+len(sealed))
+	envelope = append(envelope, envelopeVersion, byte(len(k.active)))
+	envelope = append(envelope, k.active...)
+	envelope = binary.BigEndian.AppendUint16(envelope, uint16(len(wrappedKey)))
+	envelope = append(envelope, wrappedKey...)
+	return append(envelope, sealed...), nil
+}
+
+func (k *Keyring) Open(envelope, additionalData []byte) ([]byte, error) {
+	keyId, wrappedKey, sealed, err := splitEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	keySealer, ok := k.keys[keyId]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	dataKey, err := keySealer.Open(wrappedKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	dataSealer, err := NewAESGCMSealer(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return dataSealer.Open(sealed, additionalData)
+}
+
+func splitEnvelope(envelope []byte) (keyId string, wrappedKey, sealed []byte, err error) {
+	malformed := errors.New("Malformed encrypted value")
+	if len(envelope) < 2 || envelope[0] != envelopeVersion {
+		return "", nil, nil, malformed
+	}
+
+	idEnd := 2 + int(envelope[1])
+	if len(envelope) < idEnd+2 {
+		return "", nil, nil, malformed
+	}
+
+	keyEnd := idEnd + 2 + int(binary.BigEndian.Uint16(envelope[idEnd:]))
+	if len(envelope) < keyEnd {
+		return "", nil, nil, malformed
+	}
+	return string(envelope[2:idEnd]), envelope[idEnd+2 : keyEnd], envelope[keyEnd:], nil
+}
+
+// IndexTokens returns a blind index token for every three character sequence in the value, so that
+// substring searches can be run against encrypted values without revealing their contents. Values
+// shorter than three characters have no tokens.
+func (k *Keyring) IndexTokens(value string) []string {
+	runes := []rune(value)
+	seen := make(map[string]bool)
+	tokens := []string{}
+
+	for i := 0; i+3 <= len(runes); i++ {
+		mac := hmac.New(sha256.New, k.indexKey)
+		mac.Write([]byte(string(runes[i : i+3])))
+		token := hex.EncodeToString(mac.Sum(nil)[:8])
+
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"context"
+	"log/slog"
+	"time"
+	"github.com/lib/pq"
+)
+
+const (
+	listenerMinReconnect = time.Second
+	listenerMaxReconnect = time.Minute
+	// listenerPingInterval is how often an idle listener checks its connection, so that a dropped
+	// connection is noticed and re-established.
+	listenerPingInterval = 90 * time.Second
+)
+
+// PostgresListener receives the payloads sent with NOTIFY on a channel, such as those sent by the
+// trigger on the messages table, by every instance connected to the same database.
+type PostgresListener struct {
+	connectionString string
+	channel          string
+}
+
+// NewPostgresListener returns a listener for the channel. Each call to Listen opens its own
+// connection.
+func NewPostgresListener(connectionString, channel string) *PostgresListener {
+	return &PostgresListener{connectionString: connectionString, channel: channel}
+}
+
+// Channel returns the channel listened on.
+func (l *PostgresListener) Channel() string {
+	return l.channel
+}
+
+// Listen delivers the payloads sent on the channel until the context is cancelled. The connection
+// is re-established automatically if it is lost, but payloads sent while it is down are missed.
+func (l *PostgresListener) Listen(ctx context.Context, deliver func(payload []byte)) {
+	listener := pq.NewListener(l.connectionString, listenerMinReconnect, listenerMaxReconnect, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			slog.Warn("Lost connection listening for events", "channel", l.channel, "error", err)
+		case pq.ListenerEventConnectionAttemptFailed:
+			slog.Warn("Failed to connect to listen for events", "channel", l.channel, "error", err)
+		case pq.ListenerEventReconnected:
+			slog.Warn("Reconnected to listen for events, any sent while disconnected were missed", "channel", l.channel)
+		}
+	})
+	defer listener.Close()
+
+	// Closing the listener unblocks Listen, which waits for a connection, and closes Notify
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	if err := listener.Listen(l.channel); err != nil {
+		if ctx.Err() == nil {
+			slog.Error("Error listening for events", "channel", l.channel, "error", err)
+		}
+		return
+	}
+
+	ping := time.NewTicker(listenerPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case notification, ok := <-listener.Notify:
+			if !ok {
+				return
+			}
+			// A nil notification follows a reconnection
+			if notification != nil {
+				deliver([]byte(notification.Extra))
+			}
+		case <-ping.C:
+			go listener.Ping()
+		}
+	}
+}
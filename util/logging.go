@@ -0,0 +1,81 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+)
+
+// ParseLogLevel parses a level name, e.g. "debug", "info", "warn" or "error".
+func ParseLogLevel(level string) (slog.Level, error) {
+	var parsed slog.Level
+	if level == "" {
+		return parsed, nil
+	}
+	if err := parsed.UnmarshalText([]byte(level)); err != nil {
+		return parsed, fmt.Errorf("Unknown log level %q", level)
+	}
+	return parsed, nil
+}
+
+// NewLogger creates a logger writing lines in the given format at or above the given level, which
+// may be a *slog.LevelVar to change the level while the logger is in use. Lines logged with a
+// context carrying a request ID or a trace include them.
+func NewLogger(w io.Writer, level slog.Leveler, format string) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", LogFormatJSON:
+		handler = slog.NewJSONHandler(w, options)
+	case LogFormatText:
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return nil, fmt.Errorf("Unknown log format %q", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+type requestIdKey struct{}
+
+// WithRequestId returns a copy of the context carrying the ID of the request it belongs to.
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestId returns the ID of the request the context belongs to, or an empty string if it has none.
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request ID and trace, if any, to each line logged with a context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestId(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,14 @@
+package util
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogPublisher logs each event it is asked to publish, for running the outbox without a message broker.
+type LogPublisher struct{}
+
+func (LogPublisher) Publish(ctx context.Context, eventId, event string, messageId int, payload []byte) error {
+	slog.InfoContext(ctx, "Published event", "event_id", eventId, "event", event, "message_id", messageId, "payload", string(payload))
+	return nil
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Replicas spreads reads across read replicas round-robin, skipping any which failed their last
+// health check, and any which have not yet passed one. Its methods are safe to call on a nil
+// receiver, which has no replicas.
+type Replicas struct {
+	dbs     []*sql.DB
+	healthy []atomic.Bool
+	next    atomic.Uint64
+}
+
+// NewReplicas returns the replicas to read from, or nil when there are none.
+func NewReplicas(dbs ...*sql.DB) *Replicas {
+	if len(dbs) == 0 {
+		return nil
+	}
+	return &Replicas{dbs: dbs, healthy: make([]atomic.Bool, len(dbs))}
+}
+
+// Pick returns the next healthy replica, or nil when there is none.
+func (r *Replicas) Pick() *sql.DB {
+	if r == nil {
+		return nil
+	}
+	start := r.next.Add(1)
+	for i := range r.dbs {
+		index := int((start + uint64(i)) % uint64(len(r.dbs)))
+		if r.healthy[index].Load() {
+			return r.dbs[index]
+		}
+	}
+	return nil
+}
+
+// Check pings every replica, taking those which fail to respond within the timeout out of rotation
+// until a later check succeeds. A zero timeout leaves each ping bounded only by the context.
+func (r *Replicas) Check(ctx context.Context, timeout time.Duration) {
+	if r == nil {
+		return
+	}
+	for i, db := range r.dbs {
+		err := ping(ctx, db, timeout)
+		healthy := err == nil
+		if r.healthy[i].Swap(healthy) == healthy {
+			continue
+		}
+		if healthy {
+			slog.Info("Read replica in rotation", "replica", i)
+		} else {
+			slog.Warn("Read replica failed its health check", "replica", i, "error", err)
+		}
+	}
+}
+
+func ping(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return db.PingContext(ctx)
+}
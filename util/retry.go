@@ -0,0 +1,61 @@
+package util
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff describes the delays between attempts, starting at Initial and doubling up to Max. Each
+// delay is jittered by up to half, so that clients failing together do not retry together.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+func (b Backoff) next(delay time.Duration) time.Duration {
+	delay *= 2
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	return delay
+}
+
+// Delay returns the jittered delay before the attempt following the given one, for callers which
+// schedule their own retries.
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Initial
+	for i := 1; i < attempt && (b.Max <= 0 || delay < b.Max); i++ {
+		delay = b.next(delay)
+	}
+	return jitter(delay)
+}
+
+func jitter(delay time.Duration) time.Duration {
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + rand.N(delay/2)
+}
+
+// Retry calls fn until it succeeds, fails with an error which is not retryable, has been called the
+// given number of times (without limit when zero), or the context is done. The error from the last
+// call is returned.
+func Retry(ctx context.Context, attempts int, backoff Backoff, retryable func(error) bool, fn func(context.Context) error) error {
+	delay := backoff.Initial
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !retryable(err) || (attempts > 0 && attempt >= attempts) {
+			return err
+		}
+
+		timer := time.NewTimer(jitter(delay))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay = backoff.next(delay)
+	}
+}
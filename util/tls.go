@@ -0,0 +1,182 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	ClientAuthRequire  = "require"
+	ClientAuthOptional = "optional"
+)
+
+type TLSConfig struct {
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// ClientCAFile enables mutual TLS, verifying client certificates against the CA bundle it holds.
+	ClientCAFile string `mapstructure:"client_ca_file"`
+	// ClientAuth is either ClientAuthRequire (the default) or ClientAuthOptional, which accepts
+	// clients without a certificate but still verifies those which present one.
+	ClientAuth string `mapstructure:"client_auth"`
+	// RedirectAddr, when set, is the address of a plain HTTP listener redirecting requests to HTTPS.
+	RedirectAddr string `mapstructure:"redirect_addr"`
+}
+
+// serverConfig returns the server's TLS settings, along with the watcher reloading its certificate,
+// which must be closed once the server stops.
+func (c *TLSConfig) serverConfig() (*tls.Config, io.Closer, error) {
+	certificate, err := newCertificateReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certificate.getCertificate,
+	}
+
+	if c.ClientCAFile == "" {
+		return config, certificate, nil
+	}
+
+	if err := c.verifyClients(config); err != nil {
+		certificate.Close()
+		return nil, nil, err
+	}
+	return config, certificate, nil
+}
+
+func (c *TLSConfig) verifyClients(config *tls.Config) error {
+	bundle, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(bundle) {
+		return fmt.Errorf("No certificates found in %s", c.ClientCAFile)
+	}
+
+	switch c.ClientAuth {
+	case "", ClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return fmt.Errorf("Unknown client auth mode %q", c.ClientAuth)
+	}
+	return nil
+}
+
+// certificateReloader serves a certificate and key pair from disk, loading them again whenever
+// either file changes so that renewed certificates are picked up without a restart.
+type certificateReloader struct {
+	certFile, keyFile string
+
+	certificate atomic.Pointer[tls.Certificate]
+	watcher     *fsnotify.Watcher
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS requires both a certificate and a key file")
+	}
+
+	r := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// The directories are watched rather than the files, as renewals often replace the files, or
+	// swap a symlink to the directory holding them, rather than writing to them
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	r.watcher = watcher
+	go r.watch()
+	return r, nil
+}
+
+// watch reloads the pair whenever anything changes in their directories, until the watcher is
+// closed. The current certificate is kept if the files are mid-update and fail to load, and the
+// pair is loaded again once the update is complete.
+func (r *certificateReloader) watch() {
+	for {
+		select {
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if err := r.load(); err != nil {
+				slog.Debug("Unable to reload TLS certificate, keeping the current one", "error", err)
+			}
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("Error watching TLS certificate files", "error", err)
+		}
+	}
+}
+
+func (r *certificateReloader) load() error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.certificate.Store(&certificate)
+	return nil
+}
+
+func (r *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate.Load(), nil
+}
+
+// Close stops watching for changes to the certificate.
+func (r *certificateReloader) Close() error {
+	return r.watcher.Close()
+}
+
+// httpsRedirect permanently redirects every request to the same URL on the HTTPS listener at addr.
+func httpsRedirect(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// ClientSubject returns the subject of the verified client certificate a request was made with, or
+// an empty string if the client did not present one.
+func ClientSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.String()
+}
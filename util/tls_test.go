@@ -0,0 +1,227 @@
+package util
+
+import (
+	"testing"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// testCertificate is a certificate and key generated for a test, signed by the given parent or
+// self-signed when there is none.
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	der         []byte
+}
+
+func newTestCertificate(t *testing.T, commonName string, serial int64, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		parent = &testCertificate{certificate: template, key: key}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent.certificate, &key.PublicKey, parent.key)
+	assert.Nil(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCertificate{certificate: certificate, key: key, der: der}
+}
+
+// write saves the certificate and key as PEM files in dir, returning their paths.
+func (c *testCertificate) write(t *testing.T, dir, name string) (string, string) {
+	key, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600))
+	return certFile, keyFile
+}
+
+func (c *testCertificate) tlsCertificate() *tls.Certificate {
+	return &tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func servedCommonName(t *testing.T, r *certificateReloader) string {
+	certificate, err := r.getCertificate(nil)
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	assert.Nil(t, err)
+	return leaf.Subject.CommonName
+}
+
+func Test_ShouldReloadCertificateWhenFilesChange(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := newTestCertificate(t, "original", 1, nil).write(t, dir, "server")
+
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	defer reloader.Close()
+	assert.Equal(t, "original", servedCommonName(t, reloader), "Initial certificate was not served")
+
+	newTestCertificate(t, "renewed", 2, nil).write(t, dir, "server")
+
+	assert.Eventually(t, func() bool { return servedCommonName(t, reloader) == "renewed" }, 5*time.Second, 10*time.Millisecond, "Renewed certificate was not loaded")
+}
+
+func Test_ShouldKeepServingCertificateWhileFilesAreMidUpdate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := newTestCertificate(t, "original", 1, nil).write(t, dir, "server")
+
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	defer reloader.Close()
+
+	// Only the certificate has been replaced so far, so it does not match the key
+	renewed := newTestCertificate(t, "renewed", 2, nil)
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: renewed.der}), 0600))
+
+	assert.Never(t, func() bool { return servedCommonName(t, reloader) != "original" }, 200*time.Millisecond, 10*time.Millisecond, "Current certificate should be served until the pair loads")
+
+	renewed.write(t, dir, "server")
+	assert.Eventually(t, func() bool { return servedCommonName(t, reloader) == "renewed" }, 5*time.Second, 10*time.Millisecond, "Renewed pair was not loaded")
+}
+
+func Test_ShouldFailToCreateCertificateReloaderWithoutKeyFile(t *testing.T) {
+	_, err := newCertificateReloader("server.crt", "")
+
+	assert.EqualError(t, err, "TLS requires both a certificate and a key file")
+}
+
+// mutualTLSServer starts a server with the config built from the given client auth mode, which
+// responds with the subject of the client certificate. Clients must use the returned root pool.
+func mutualTLSServer(t *testing.T, clientAuth string) (*httptest.Server, *testCertificate, *x509.CertPool) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "test-ca", 1, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCertificate(t, "localhost", 2, ca).write(t, dir, "server")
+
+	config := &TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: clientAuth}
+	serverConfig, certificate, err := config.serverConfig()
+	assert.Nil(t, err)
+	t.Cleanup(func() { certificate.Close() })
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, ClientSubject(r))
+	}))
+	server.TLS = serverConfig
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	return server, ca, roots
+}
+
+// clientRequest makes a request to the server, presenting the certificate if there is one, even when
+// it is not signed by a CA the server accepts. The server name is set so that the server's own
+// certificate is chosen rather than httptest's.
+func clientRequest(server *httptest.Server, roots *x509.CertPool, certificate *tls.Certificate) (string, error) {
+	config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if certificate != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return certificate, nil }
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	defer client.CloseIdleConnections()
+
+	response, err := client.Get(server.URL)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	return string(body), err
+}
+
+func Test_ShouldRequireClientCertificate(t *testing.T) {
+	server, ca, roots := mutualTLSServer(t, ClientAuthRequire)
+	client := newTestCertificate(t, "ops-client", 3, ca)
+
+	subject, err := clientRequest(server, roots, client.tlsCertificate())
+	assert.Nil(t, err)
+	assert.Equal(t, "CN=ops-client", subject, "Client certificate subject was not available to the handler")
+
+	_, err = clientRequest(server, roots, nil)
+	assert.NotNil(t, err, "Client without a certificate should be refused")
+
+	untrusted := newTestCertificate(t, "stranger", 4, nil)
+	_, err = clientRequest(server, roots, untrusted.tlsCertificate())
+	assert.NotNil(t, err, "Client certificate from an unknown CA should be refused")
+}
+
+func Test_ShouldAcceptClientsWithoutCertificateWhenOptional(t *testing.T) {
+	server, ca, roots := mutualTLSServer(t, ClientAuthOptional)
+	client := newTestCertificate(t, "ops-client", 3, ca)
+
+	subject, err := clientRequest(server, roots, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", subject, "Client without a certificate should have no subject")
+
+	subject, err = clientRequest(server, roots, client.tlsCertificate())
+	assert.Nil(t, err)
+	assert.Equal(t, "CN=ops-client", subject, "Client certificate subject was not available to the handler")
+
+	untrusted := newTestCertificate(t, "stranger", 4, nil)
+	_, err = clientRequest(server, roots, untrusted.tlsCertificate())
+	assert.NotNil(t, err, "Client certificate presented from an unknown CA should still be refused")
+}
+
+func Test_ShouldFailToConfigureUnknownClientAuthMode(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "test-ca", 1, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCertificate(t, "localhost", 2, ca).write(t, dir, "server")
+
+	config := &TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: "sometimes"}
+	_, _, err := config.serverConfig()
+
+	assert.EqualError(t, err, `Unknown client auth mode "sometimes"`)
+}
+
+func Test_ShouldRedirectToHTTPS(t *testing.T) {
+	for _, tc := range []struct {
+		addr     string
+		host     string
+		expected string
+	}{
+		{":8443", "example.com:8080", "https://example.com:8443/messages?offset=20"},
+		{":443", "example.com:8080", "https://example.com/messages?offset=20"},
+		{"0.0.0.0:8443", "example.com", "https://example.com:8443/messages?offset=20"},
+	} {
+		req := httptest.NewRequest("GET", "http://"+tc.host+"/messages?offset=20", nil)
+		response := httptest.NewRecorder()
+
+		httpsRedirect(tc.addr).ServeHTTP(response, req)
+
+		assert.Equal(t, http.StatusPermanentRedirect, response.Code, "Response status code not as expected")
+		assert.Equal(t, tc.expected, response.Header().Get("Location"), "Redirect location not as expected for %s", tc.addr)
+	}
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.18.0"
+	"os"
+)
+
+const (
+	TraceExporterStdout = "stdout"
+	TraceExporterOTLP   = "otlp"
+)
+
+type TracingConfig struct {
+	// Exporter is TraceExporterStdout, TraceExporterOTLP, or empty to disable tracing.
+	Exporter string `mapstructure:"exporter"`
+	// Endpoint is the host:port of the OTLP/HTTP collector, e.g. "localhost:4318".
+	Endpoint string `mapstructure:"endpoint"`
+	// Insecure sends spans to the collector over plain HTTP.
+	Insecure    bool   `mapstructure:"insecure"`
+	ServiceName string `mapstructure:"service_name"`
+	// SampleRatio is the fraction of new traces recorded, between 0 and 1. Requests which are part of
+	// an existing trace follow the caller's sampling decision.
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+// StartTracing installs a global tracer provider exporting spans as configured, along with the W3C
+// trace context propagator. The returned provider must be shut down to flush any buffered spans. It is
+// nil, and no spans are recorded, when no exporter is configured.
+func StartTracing(ctx context.Context, config TracingConfig) (*sdktrace.TracerProvider, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "":
+		return nil, nil
+	case TraceExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TraceExporterOTLP:
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("Unknown trace exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(config.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider, nil
+}